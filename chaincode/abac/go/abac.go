@@ -19,6 +19,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -29,6 +30,19 @@ import (
 type SimpleChaincode struct {
 }
 
+// transferMaxAttribute is the certificate attribute holding the largest amount
+// the caller may transfer at once
+const transferMaxAttribute = "transfer.max"
+
+// validateEntity refuses names in the composite key namespace, where the
+// chaincode keeps its own records such as the policy
+func validateEntity(name string) error {
+	if name == "" || strings.HasPrefix(name, "\x00") {
+		return fmt.Errorf("Invalid entity name %q", name)
+	}
+	return nil
+}
+
 // Init initializes the chaincode
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
@@ -54,11 +68,17 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 
 	// Initialize the chaincode
 	A = args[0]
+	B = args[2]
+	if err = validateEntity(A); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = validateEntity(B); err != nil {
+		return shim.Error(err.Error())
+	}
 	Aval, err = strconv.Atoi(args[1])
 	if err != nil {
 		return shim.Error("Expecting integer value for asset holding")
 	}
-	B = args[2]
 	Bval, err = strconv.Atoi(args[3])
 	if err != nil {
 		return shim.Error("Expecting integer value for asset holding")
@@ -76,28 +96,93 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	// Both accounts are owned by the identity that initialized them
+	owner, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = putAccountOwner(stub, A, owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = putAccountOwner(stub, B, owner); err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("abac Invoke")
 	function, args := stub.GetFunctionAndParameters()
+
+	// Expired and revoked certificates can't call any function
+	if err := checkCertificate(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// setPolicy and the deny-list functions are checked against the admin
+	// attribute, every other function against its rule in the policy
+	if function == "setPolicy" {
+		return t.setPolicy(stub, args)
+	} else if function == "revokeCertificate" {
+		return t.revokeCertificate(stub, args)
+	} else if function == "restoreCertificate" {
+		return t.restoreCertificate(stub, args)
+	}
+	var grant *Grant
+	if err := authorize(stub, function); err != nil {
+		// A grant from a principal that is authorized stands in for the caller
+		var grantErr error
+		if grant, grantErr = delegatedAuthority(stub, function, args); grantErr != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	if function == "invoke" {
 		// Make payment of X units from A to B
-		return t.invoke(stub, args)
+		return t.invoke(stub, args, grant)
 	} else if function == "delete" {
 		// Deletes an entity from its state
-		return t.delete(stub, args)
+		return t.delete(stub, args, grant)
 	} else if function == "query" {
 		// the old "Query" is now implemtned in invoke
 		return t.query(stub, args)
+	} else if function == "getPolicy" {
+		// Returns the policy stored on the ledger
+		return t.getPolicyDocument(stub, args)
+	} else if function == "listRevokedCertificates" {
+		// Returns the deny-list of certificates
+		return t.listRevokedCertificates(stub, args)
+	} else if function == "whoAmI" {
+		// Returns the caller's certificate details
+		return t.whoAmI(stub, args)
+	} else if function == "grant" {
+		// Lets another identity act on the caller's behalf
+		return t.grant(stub, args)
+	} else if function == "revokeGrant" {
+		return t.revokeGrant(stub, args)
+	} else if function == "listGrants" {
+		return t.listGrants(stub, args)
+	} else if function == "createAccount" {
+		// Creates an empty account owned by the caller
+		return t.createAccount(stub, args)
+	} else if function == "getOwner" {
+		return t.getOwner(stub, args)
+	} else if function == "setOwner" {
+		return t.setOwner(stub, args)
+	} else if function == "approveTransfer" {
+		// Approves a transfer held for approvals, executing it with the last one
+		return t.approveTransfer(stub, args)
+	} else if function == "listPendingTransfers" {
+		return t.listPendingTransfers(stub, args)
 	}
 
-	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
+	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\" \"setPolicy\" \"getPolicy\" \"revokeCertificate\" \"restoreCertificate\" \"listRevokedCertificates\" \"whoAmI\" \"grant\" \"revokeGrant\" \"listGrants\" \"createAccount\" \"getOwner\" \"setOwner\" \"approveTransfer\" \"listPendingTransfers\"")
 }
 
-// Transaction makes payment of X units from A to B
-func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// Transaction makes payment of X units from A to B, only the owner of A, an
+// admin or a grantee of the owner can debit A
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string, grant *Grant) pb.Response {
 	var A, B string    // Entities
 	var Aval, Bval int // Asset holdings
 	var X int          // Transaction value
@@ -109,6 +194,12 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 
 	A = args[0]
 	B = args[1]
+	if err = validateEntity(A); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = validateEntity(B); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Get the state from the ledger
 	// TODO: will be nice to have a GetAllState call to ledger
@@ -135,6 +226,30 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 	if err != nil {
 		return shim.Error("Invalid transaction amount, expecting a integer value")
 	}
+	if X <= 0 {
+		return shim.Error("Invalid transaction amount, expecting a positive value")
+	}
+	if grant, err = authorizeAccount(stub, "invoke", A, X, grant); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Callers with a transfer.max attribute can't move more than its value
+	maxTransfer, found, err := cid.GetAttributeInt(stub, transferMaxAttribute)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found && int64(X) > maxTransfer {
+		return shim.Error(fmt.Sprintf("Transfer of %d is above the caller's %s of %d", X, transferMaxAttribute, maxTransfer))
+	}
+
+	// Transfers above the approval threshold wait for approvers
+	policy, err := getPolicy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if policy != nil && policy.Approvals != nil && X > policy.Approvals.Threshold {
+		return requestApproval(stub, policy.Approvals, A, B, X, grant)
+	}
 	Aval = Aval - X
 	Bval = Bval + X
 	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
@@ -153,19 +268,28 @@ func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(nil)
 }
 
-// Deletes an entity from state
-func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// Deletes an entity from state, with the same restriction as debiting it
+func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string, grant *Grant) pb.Response {
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
 	A := args[0]
+	if err := validateEntity(A); err != nil {
+		return shim.Error(err.Error())
+	}
+	if _, err := authorizeAccount(stub, "delete", A, 0, grant); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Delete the key from the state in ledger
 	err := stub.DelState(A)
 	if err != nil {
 		return shim.Error("Failed to delete state")
 	}
+	if err = delAccountOwner(stub, A); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
@@ -180,6 +304,9 @@ func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string)
 	}
 
 	A = args[0]
+	if err = validateEntity(A); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Get the state from the ledger
 	Avalbytes, err := stub.GetState(A)
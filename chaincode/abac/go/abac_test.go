@@ -0,0 +1,204 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	initializer = cidtest.Identity{MSPID: "Org1MSP", CommonName: "init", Attributes: map[string]interface{}{"abac.init": "true"}}
+	admin       = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{"abac.admin": "true"}}
+	alice       = cidtest.Identity{MSPID: "Org1MSP", CommonName: "alice"}
+	bob         = cidtest.Identity{MSPID: "Org2MSP", CommonName: "bob"}
+)
+
+func checkBalance(t *testing.T, stub *cidtest.Stub, account string, balance int) {
+	t.Helper()
+	if value := string(stub.CheckInvoke(t, alice, "query", account)); value != strconv.Itoa(balance) {
+		t.Fatalf("%s holds %s, expected %d", account, value, balance)
+	}
+}
+
+// principal returns the MSP ID and ID of an identity, as whoAmI reports them
+func principal(t *testing.T, stub *cidtest.Stub, id cidtest.Identity) (string, string) {
+	var info CertificateInfo
+	if err := json.Unmarshal(stub.CheckInvoke(t, id, "whoAmI"), &info); err != nil {
+		t.Fatal(err)
+	}
+	return info.MSPID, info.ID
+}
+
+// newStub initializes a with 100 and b with 200, owned by alice and bob
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("abac", new(SimpleChaincode))
+	if res := stub.InitAs(initializer, "init", "a", "100", "b", "200"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	aliceMSP, aliceID := principal(t, stub, alice)
+	bobMSP, bobID := principal(t, stub, bob)
+	stub.CheckInvoke(t, initializer, "setOwner", "a", aliceMSP, aliceID)
+	stub.CheckInvoke(t, initializer, "setOwner", "b", bobMSP, bobID)
+	return stub
+}
+
+func TestAbac_Init(t *testing.T) {
+	stub := cidtest.NewStub("abac", new(SimpleChaincode))
+
+	for _, id := range []cidtest.Identity{alice, admin} {
+		if res := stub.InitAs(id, "init", "a", "100", "b", "200"); res.Status == shim.OK || !strings.Contains(res.Message, "abac.init") {
+			t.Fatalf("Init by %s returned %d %q", id.CommonName, res.Status, res.Message)
+		}
+	}
+	if res := stub.InitAs(initializer, "init", "\x00abac~policy\x00", "100", "b", "200"); res.Status == shim.OK || !strings.Contains(res.Message, "Invalid entity name") {
+		t.Fatalf("Init with a composite key returned %d %q", res.Status, res.Message)
+	}
+	if res := stub.InitAs(initializer, "init", "a", "100", "b", "200"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	checkBalance(t, stub, "a", 100)
+	checkBalance(t, stub, "b", 200)
+}
+
+func TestAbac_Invoke(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, alice, "invoke", "a", "b", "10")
+	checkBalance(t, stub, "a", 90)
+	checkBalance(t, stub, "b", 210)
+	stub.CheckInvoke(t, bob, "invoke", "b", "a", "30")
+	checkBalance(t, stub, "a", 120)
+	checkBalance(t, stub, "b", 180)
+
+	// only the owner or an admin can debit an account
+	stub.CheckInvokeError(t, bob, "Only the owner of a or an admin can invoke it", "invoke", "a", "b", "10")
+	stub.CheckInvoke(t, admin, "invoke", "a", "b", "20")
+	checkBalance(t, stub, "a", 100)
+
+	stub.CheckInvokeError(t, alice, "Incorrect number of arguments. Expecting 3", "invoke", "a", "b")
+	stub.CheckInvokeError(t, alice, "Entity not found", "invoke", "a", "c", "1")
+	stub.CheckInvokeError(t, alice, "Entity not found", "invoke", "c", "a", "1")
+	stub.CheckInvokeError(t, alice, "expecting a integer value", "invoke", "a", "b", "x")
+	stub.CheckInvokeError(t, alice, "expecting a positive value", "invoke", "a", "b", "-5")
+	stub.CheckInvokeError(t, alice, "expecting a positive value", "invoke", "a", "b", "0")
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "invoke", "\x00abac~owner", "b", "1")
+	stub.CheckInvokeError(t, alice, "Invalid invoke function name", "transfer", "a", "b", "1")
+	checkBalance(t, stub, "a", 100)
+	checkBalance(t, stub, "b", 200)
+}
+
+func TestAbac_QueryAndDelete(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, alice, "Nil amount for c", "query", "c")
+	stub.CheckInvokeError(t, alice, "Expecting name of the person to query", "query")
+
+	stub.CheckInvokeError(t, bob, "Only the owner of a or an admin can delete it", "delete", "a")
+	stub.CheckInvoke(t, alice, "delete", "a")
+	stub.CheckInvokeError(t, alice, "Nil amount for a", "query", "a")
+	stub.CheckInvokeError(t, alice, "Account a has no owner", "getOwner", "a")
+
+	stub.CheckInvoke(t, admin, "delete", "b")
+	stub.CheckInvokeError(t, alice, "Incorrect number of arguments. Expecting 1", "delete")
+}
+
+func TestAbac_Accounts(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, alice, "createAccount", "c")
+	checkBalance(t, stub, "c", 0)
+	stub.CheckInvokeError(t, bob, "Account c already exists", "createAccount", "c")
+	stub.CheckInvokeError(t, bob, "Invalid entity name", "createAccount", "")
+	stub.CheckInvokeError(t, bob, "Expecting the account name", "createAccount")
+
+	// alice hands c over to bob, then can't take it back
+	bobMSP, bobID := principal(t, stub, bob)
+	aliceMSP, aliceID := principal(t, stub, alice)
+	stub.CheckInvoke(t, alice, "setOwner", "c", bobMSP, bobID)
+	stub.CheckInvokeError(t, alice, "Only the owner of c or an admin can change its owner", "setOwner", "c", aliceMSP, aliceID)
+	stub.CheckInvoke(t, admin, "setOwner", "c", aliceMSP, aliceID)
+
+	stub.CheckInvokeError(t, alice, "Entity not found", "setOwner", "d", aliceMSP, aliceID)
+	stub.CheckInvokeError(t, alice, "must be non-empty", "setOwner", "c", "", aliceID)
+	stub.CheckInvokeError(t, alice, "Expecting the account name", "getOwner")
+}
+
+// The policy is kept under a composite key, no function reaches it as an entity
+func TestAbac_EntityNames(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, admin, "setPolicy", `{"default":"allow"}`)
+	policyKey := "\x00abac~policy\x00"
+
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "query", policyKey)
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "query", "")
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "invoke", "a", policyKey, "1")
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "delete", policyKey)
+	stub.CheckInvoke(t, alice, "getPolicy")
+}
+
+func TestAbac_TransferMax(t *testing.T) {
+	stub := newStub(t)
+	limited := alice
+	limited.Attributes = map[string]interface{}{"transfer.max": 25}
+
+	stub.CheckInvoke(t, limited, "invoke", "a", "b", "25")
+	stub.CheckInvokeError(t, limited, "Transfer of 26 is above the caller's transfer.max of 25", "invoke", "a", "b", "26")
+
+	// certificates from before typed attributes hold the number as a string
+	limited.Attributes = map[string]interface{}{"transfer.max": "25"}
+	stub.CheckInvokeError(t, limited, "Transfer of 26 is above the caller's transfer.max of 25", "invoke", "a", "b", "26")
+
+	limited.Attributes = map[string]interface{}{"transfer.max": "lots"}
+	stub.CheckInvokeError(t, limited, "not an integer", "invoke", "a", "b", "1")
+	checkBalance(t, stub, "a", 75)
+}
+
+func TestAbac_NoCreator(t *testing.T) {
+	stub := newStub(t)
+	stub.SetCreator(nil)
+	if res := stub.MockInvoke("nocreator", [][]byte{[]byte("query"), []byte("a")}); res.Status == shim.OK {
+		t.Fatalf("A call without a creator should have failed")
+	}
+}
+
+// Property: transfers between accounts conserve the total, whether they
+// succeed or not
+func TestAbac_TransfersConserveTotal(t *testing.T) {
+	stub := newStub(t)
+	property := func(amounts []int8, fromBob []bool) bool {
+		for i, amount := range amounts {
+			from, to, owner := "a", "b", alice
+			if i < len(fromBob) && fromBob[i] {
+				from, to, owner = "b", "a", bob
+			}
+			stub.InvokeAs(owner, "invoke", from, to, strconv.Itoa(int(amount)))
+		}
+		a, _ := strconv.Atoi(string(stub.State["a"]))
+		b, _ := strconv.Atoi(string(stub.State["b"]))
+		return a+b == 300
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 20}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ApprovalRule is the part of the policy that holds transfers above Threshold
+// until Required identities with Attribute set to "true" approved them. A
+// pending transfer that isn't approved within ExpiresAfter (a Go duration such
+// as "72h") expires. A transfer whose account changed owner, or whose grant was
+// revoked, expired or used up while it waited, is cancelled instead of executed.
+type ApprovalRule struct {
+	Threshold    int    `json:"threshold"`
+	Required     int    `json:"required"`
+	Attribute    string `json:"attribute,omitempty"`
+	ExpiresAfter string `json:"expiresAfter"`
+}
+
+// PendingTransfer is a transfer waiting for approvals. Owner is the owner of
+// From when the transfer was requested, GrantID the grant it was requested
+// under, if any; the amount is only recorded against the grant on execution.
+type PendingTransfer struct {
+	ID           string     `json:"id"`
+	From         string     `json:"from"`
+	To           string     `json:"to"`
+	Amount       int        `json:"amount"`
+	Requester    Principal  `json:"requester"`
+	Owner        *Principal `json:"owner,omitempty"`
+	GrantID      string     `json:"grantId,omitempty"`
+	Required     int        `json:"required"`
+	Attribute    string     `json:"attribute"`
+	Approvals    []Approval `json:"approvals"`
+	Status       string     `json:"status"`
+	CreatedAt    string     `json:"createdAt"`
+	ExpiresAt    string     `json:"expiresAt"`
+	ExecutedAt   string     `json:"executedAt,omitempty"`
+	CancelReason string     `json:"cancelReason,omitempty"`
+}
+
+// Approval records who approved a pending transfer and when
+type Approval struct {
+	Approver Principal `json:"approver"`
+	TxId     string    `json:"txId"`
+	At       string    `json:"at"`
+}
+
+const (
+	pendingObject            = "abac~pending"
+	defaultApproverAttribute = "abac.approver"
+
+	statusPending   = "pending"
+	statusExecuted  = "executed"
+	statusExpired   = "expired"
+	statusCancelled = "cancelled"
+)
+
+// validate checks the approval rule of a policy
+func (r *ApprovalRule) validate() error {
+	if r.Threshold < 0 {
+		return fmt.Errorf("Approval threshold can't be negative")
+	}
+	if r.Required < 1 {
+		return fmt.Errorf("Approvals must require at least one approver")
+	}
+	expiresAfter, err := time.ParseDuration(r.ExpiresAfter)
+	if err != nil || expiresAfter <= 0 {
+		return fmt.Errorf("Approval expiresAfter must be a positive duration such as \"72h\"")
+	}
+	return nil
+}
+
+// approverAttribute returns the attribute approvers must have set to "true"
+func (r *ApprovalRule) approverAttribute() string {
+	if r.Attribute == "" {
+		return defaultApproverAttribute
+	}
+	return r.Attribute
+}
+
+func getPendingTransfer(stub shim.ChaincodeStubInterface, id string) (*PendingTransfer, error) {
+	key, err := stub.CreateCompositeKey(pendingObject, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	pendingBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get pending transfer %s: %s", id, err)
+	}
+	if pendingBytes == nil {
+		return nil, fmt.Errorf("Pending transfer %s not found", id)
+	}
+	pending := &PendingTransfer{}
+	if err = json.Unmarshal(pendingBytes, pending); err != nil {
+		return nil, fmt.Errorf("Failed to decode pending transfer %s: %s", id, err)
+	}
+	return pending, nil
+}
+
+func putPendingTransfer(stub shim.ChaincodeStubInterface, pending *PendingTransfer) ([]byte, error) {
+	key, err := stub.CreateCompositeKey(pendingObject, []string{pending.ID})
+	if err != nil {
+		return nil, err
+	}
+	pendingBytes, err := json.Marshal(pending)
+	if err != nil {
+		return nil, err
+	}
+	return pendingBytes, stub.PutState(key, pendingBytes)
+}
+
+// expired reports whether a pending transfer ran out of time at now
+func (p *PendingTransfer) expired(now time.Time) bool {
+	expiresAt, err := time.Parse(time.RFC3339, p.ExpiresAt)
+	return err != nil || now.After(expiresAt)
+}
+
+// requestApproval stores a transfer above the approval threshold as pending
+// instead of executing it, and returns it. grant is the grant the caller debits
+// A under, if any; the amount authorizing the call recorded against it is
+// given back until the transfer executes.
+func requestApproval(stub shim.ChaincodeStubInterface, rule *ApprovalRule, A, B string, X int, grant *Grant) pb.Response {
+	requester, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := getAccountOwner(stub, A)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	expiresAfter, _ := time.ParseDuration(rule.ExpiresAfter)
+
+	pending := &PendingTransfer{
+		ID:        stub.GetTxID(),
+		From:      A,
+		To:        B,
+		Amount:    X,
+		Requester: requester,
+		Owner:     owner,
+		Required:  rule.Required,
+		Attribute: rule.approverAttribute(),
+		Approvals: []Approval{},
+		Status:    statusPending,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(expiresAfter).Format(time.RFC3339),
+	}
+	if grant != nil {
+		pending.GrantID = grant.ID
+		grant.Used -= X
+		if err = putGrant(stub, grant); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	pendingBytes, err := putPendingTransfer(stub, pending)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("Transfer of %d from %s to %s is pending as %s\n", X, A, B, pending.ID)
+	return shim.Success(pendingBytes)
+}
+
+// checkStillAuthorized returns why a pending transfer can't execute anymore,
+// or "" when the owner of its account is unchanged and its grant, if any, is
+// still active with the amount left, which it then records against the grant
+func checkStillAuthorized(stub shim.ChaincodeStubInterface, pending *PendingTransfer, now time.Time) (string, error) {
+	owner, err := getAccountOwner(stub, pending.From)
+	if err != nil {
+		return "", err
+	}
+	if (owner == nil) != (pending.Owner == nil) || (owner != nil && *owner != *pending.Owner) {
+		return "The owner of " + pending.From + " changed", nil
+	}
+	if pending.GrantID == "" {
+		return "", nil
+	}
+	grant, err := getGrant(stub, pending.GrantID)
+	if err != nil {
+		return "", err
+	}
+	if !grant.active(now) {
+		return "Grant " + grant.ID + " was revoked or expired", nil
+	}
+	if grant.MaxAmount-grant.Used < pending.Amount {
+		return fmt.Sprintf("Grant %s has %d left", grant.ID, grant.MaxAmount-grant.Used), nil
+	}
+	grant.Used += pending.Amount
+	return "", putGrant(stub, grant)
+}
+
+// executeTransfer moves X units from A to B once a transfer is approved
+func executeTransfer(stub shim.ChaincodeStubInterface, A, B string, X int) error {
+	Avalbytes, err := stub.GetState(A)
+	if err != nil {
+		return fmt.Errorf("Failed to get state")
+	}
+	if Avalbytes == nil {
+		return fmt.Errorf("Entity %s not found", A)
+	}
+	Bvalbytes, err := stub.GetState(B)
+	if err != nil {
+		return fmt.Errorf("Failed to get state")
+	}
+	if Bvalbytes == nil {
+		return fmt.Errorf("Entity %s not found", B)
+	}
+	Aval, _ := strconv.Atoi(string(Avalbytes))
+	Bval, _ := strconv.Atoi(string(Bvalbytes))
+
+	Aval = Aval - X
+	Bval = Bval + X
+	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
+
+	if err = stub.PutState(A, []byte(strconv.Itoa(Aval))); err != nil {
+		return err
+	}
+	return stub.PutState(B, []byte(strconv.Itoa(Bval)))
+}
+
+// approveTransfer records the caller's approval of a pending transfer, and
+// executes it with the last approval needed. The requester can't approve its
+// own transfer and nobody can approve twice. A transfer approved after it
+// expired is marked expired instead, and one that isn't authorized anymore
+// when the last approval comes in is marked cancelled.
+func (t *SimpleChaincode) approveTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the pending transfer ID")
+	}
+	pending, err := getPendingTransfer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pending.Status != statusPending {
+		return shim.Error("Transfer " + pending.ID + " is " + pending.Status)
+	}
+
+	if err = cid.AssertAttributeValue(stub, pending.Attribute, "true"); err != nil {
+		return shim.Error(err.Error())
+	}
+	approver, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if approver == pending.Requester {
+		return shim.Error("The requester can't approve its own transfer")
+	}
+	for _, approval := range pending.Approvals {
+		if approval.Approver == approver {
+			return shim.Error("Transfer " + pending.ID + " was already approved by the caller")
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if pending.expired(now) {
+		pending.Status = statusExpired
+	} else {
+		pending.Approvals = append(pending.Approvals, Approval{Approver: approver, TxId: stub.GetTxID(), At: now.Format(time.RFC3339)})
+		if len(pending.Approvals) >= pending.Required {
+			reason, err := checkStillAuthorized(stub, pending, now)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if reason != "" {
+				pending.Status = statusCancelled
+				pending.CancelReason = reason
+			} else {
+				if err = executeTransfer(stub, pending.From, pending.To, pending.Amount); err != nil {
+					return shim.Error(err.Error())
+				}
+				pending.Status = statusExecuted
+				pending.ExecutedAt = now.Format(time.RFC3339)
+			}
+		}
+	}
+
+	pendingBytes, err := putPendingTransfer(stub, pending)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pendingBytes)
+}
+
+// listPendingTransfers returns the transfers with a status, "pending" by
+// default. Pending transfers past their expiry are reported as expired.
+func (t *SimpleChaincode) listPendingTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting an optional status")
+	}
+	status := statusPending
+	if len(args) == 1 {
+		status = args[0]
+	}
+	if status != statusPending && status != statusExecuted && status != statusExpired && status != statusCancelled {
+		return shim.Error("Expecting status \"pending\", \"executed\", \"expired\" or \"cancelled\", not " + status)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(pendingObject, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	transfers := []PendingTransfer{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var pending PendingTransfer
+		if err = json.Unmarshal(queryResponse.Value, &pending); err != nil {
+			return shim.Error(err.Error())
+		}
+		if pending.Status == statusPending && pending.expired(now) {
+			pending.Status = statusExpired
+		}
+		if pending.Status == status {
+			transfers = append(transfers, pending)
+		}
+	}
+
+	transfersBytes, err := json.Marshal(transfers)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(transfersBytes)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+var (
+	approver1 = cidtest.Identity{MSPID: "Org1MSP", CommonName: "approver1", Attributes: map[string]interface{}{"abac.approver": "true"}}
+	approver2 = cidtest.Identity{MSPID: "Org2MSP", CommonName: "approver2", Attributes: map[string]interface{}{"abac.approver": true}}
+)
+
+// newApprovalStub holds transfers above 50 for 2 approvals within an hour
+func newApprovalStub(t *testing.T) *cidtest.Stub {
+	stub := newStub(t)
+	setPolicy(t, stub, Policy{Approvals: &ApprovalRule{Threshold: 50, Required: 2, ExpiresAfter: "1h"}})
+	return stub
+}
+
+func checkPending(t *testing.T, payload []byte, status string, approvals int) PendingTransfer {
+	var pending PendingTransfer
+	if err := json.Unmarshal(payload, &pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.Status != status || len(pending.Approvals) != approvals {
+		t.Fatalf("Transfer is %s with %d approvals, expected %s with %d", pending.Status, len(pending.Approvals), status, approvals)
+	}
+	return pending
+}
+
+func listPending(t *testing.T, stub *cidtest.Stub, status string) []PendingTransfer {
+	var transfers []PendingTransfer
+	if err := json.Unmarshal(stub.CheckInvoke(t, alice, "listPendingTransfers", status), &transfers); err != nil {
+		t.Fatal(err)
+	}
+	return transfers
+}
+
+func TestApprovals_Execute(t *testing.T) {
+	stub := newApprovalStub(t)
+
+	// at the threshold transfers go through at once
+	stub.CheckInvoke(t, alice, "invoke", "a", "b", "50")
+	checkBalance(t, stub, "a", 50)
+
+	pending := checkPending(t, stub.CheckInvoke(t, bob, "invoke", "b", "a", "80"), statusPending, 0)
+	if pending.From != "b" || pending.To != "a" || pending.Amount != 80 || pending.Attribute != "abac.approver" {
+		t.Fatalf("Pending transfer is %+v", pending)
+	}
+	checkBalance(t, stub, "b", 250)
+
+	stub.CheckInvokeError(t, alice, "abac.approver", "approveTransfer", pending.ID)
+	checkPending(t, stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID), statusPending, 1)
+	stub.CheckInvokeError(t, approver1, "was already approved by the caller", "approveTransfer", pending.ID)
+	checkBalance(t, stub, "b", 250)
+
+	checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", pending.ID), statusExecuted, 2)
+	checkBalance(t, stub, "a", 130)
+	checkBalance(t, stub, "b", 170)
+	stub.CheckInvokeError(t, approver2, "is executed", "approveTransfer", pending.ID)
+
+	if transfers := listPending(t, stub, statusExecuted); len(transfers) != 1 || transfers[0].ID != pending.ID {
+		t.Fatalf("listPendingTransfers returned %+v", transfers)
+	}
+	if transfers := listPending(t, stub, statusPending); len(transfers) != 0 {
+		t.Fatalf("listPendingTransfers returned %+v", transfers)
+	}
+}
+
+func TestApprovals_RequesterCantApprove(t *testing.T) {
+	stub := newApprovalStub(t)
+	requester := alice
+	requester.Attributes = map[string]interface{}{"abac.approver": "true"}
+	pending := checkPending(t, stub.CheckInvoke(t, requester, "invoke", "a", "b", "60"), statusPending, 0)
+	stub.CheckInvokeError(t, requester, "The requester can't approve its own transfer", "approveTransfer", pending.ID)
+}
+
+// expirePending moves the expiry of a pending transfer into the past
+func expirePending(t *testing.T, stub *cidtest.Stub, pending PendingTransfer) {
+	key, _ := stub.CreateCompositeKey(pendingObject, []string{pending.ID})
+	if stub.State[key] == nil {
+		t.Fatalf("Pending transfer %s is not stored under %s", pending.ID, key)
+	}
+	pending.ExpiresAt = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	pendingBytes, _ := json.Marshal(pending)
+	stub.State[key] = pendingBytes
+}
+
+func TestApprovals_Expiry(t *testing.T) {
+	stub := newApprovalStub(t)
+	pending := checkPending(t, stub.CheckInvoke(t, alice, "invoke", "a", "b", "60"), statusPending, 0)
+	expirePending(t, stub, pending)
+
+	if transfers := listPending(t, stub, statusExpired); len(transfers) != 1 {
+		t.Fatalf("listPendingTransfers returned %+v", transfers)
+	}
+	checkPending(t, stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID), statusExpired, 0)
+	stub.CheckInvokeError(t, approver2, "is expired", "approveTransfer", pending.ID)
+	checkBalance(t, stub, "a", 100)
+}
+
+func TestApprovals_Errors(t *testing.T) {
+	stub := newApprovalStub(t)
+	stub.CheckInvokeError(t, approver1, "Pending transfer nope not found", "approveTransfer", "nope")
+	stub.CheckInvokeError(t, approver1, "Expecting the pending transfer ID", "approveTransfer")
+	stub.CheckInvokeError(t, alice, "Expecting status", "listPendingTransfers", "done")
+	stub.CheckInvokeError(t, alice, "Expecting an optional status", "listPendingTransfers", "pending", "executed")
+
+	// the account may be deleted while the transfer waits
+	pending := checkPending(t, stub.CheckInvoke(t, alice, "invoke", "a", "b", "60"), statusPending, 0)
+	stub.CheckInvoke(t, alice, "delete", "a")
+	stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID)
+	checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", pending.ID), statusCancelled, 2)
+}
+
+func TestApprovals_OwnerChanged(t *testing.T) {
+	stub := newApprovalStub(t)
+	pending := checkPending(t, stub.CheckInvoke(t, alice, "invoke", "a", "b", "60"), statusPending, 0)
+	if pending.Owner == nil || pending.Owner.ID == "" || pending.GrantID != "" {
+		t.Fatalf("Pending transfer is %+v", pending)
+	}
+
+	// alice hands a to bob, her transfer out of it must not go through
+	bobMSP, bobID := principal(t, stub, bob)
+	stub.CheckInvoke(t, alice, "setOwner", "a", bobMSP, bobID)
+	checkPending(t, stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID), statusPending, 1)
+	cancelled := checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", pending.ID), statusCancelled, 2)
+	if cancelled.CancelReason != "The owner of a changed" || cancelled.ExecutedAt != "" {
+		t.Fatalf("Cancelled transfer is %+v", cancelled)
+	}
+	checkBalance(t, stub, "a", 100)
+	checkBalance(t, stub, "b", 200)
+	stub.CheckInvokeError(t, approver1, "is cancelled", "approveTransfer", pending.ID)
+	if transfers := listPending(t, stub, statusCancelled); len(transfers) != 1 || transfers[0].ID != pending.ID {
+		t.Fatalf("listPendingTransfers returned %+v", transfers)
+	}
+}
+
+func TestApprovals_Grant(t *testing.T) {
+	stub := newApprovalStub(t)
+	grant := checkGrant(t, stub, alice, carol, "invoke", "a", "100")
+
+	// the grant is only charged when the transfer executes
+	pending := checkPending(t, stub.CheckInvoke(t, carol, "invoke", "a", "b", "60"), statusPending, 0)
+	if pending.GrantID != grant.ID {
+		t.Fatalf("Pending transfer is %+v, expected grant %s", pending, grant.ID)
+	}
+	if grants := listGrants(t, stub, carol, "grantee"); grants[0].Used != 0 {
+		t.Fatalf("Grant used %d before the transfer executed", grants[0].Used)
+	}
+	second := checkPending(t, stub.CheckInvoke(t, carol, "invoke", "a", "b", "60"), statusPending, 0)
+
+	stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID)
+	checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", pending.ID), statusExecuted, 2)
+	if grants := listGrants(t, stub, carol, "grantee"); grants[0].Used != 60 {
+		t.Fatalf("Grant used %d after the transfer executed", grants[0].Used)
+	}
+	checkBalance(t, stub, "a", 40)
+
+	// the second transfer no longer fits in the grant
+	stub.CheckInvoke(t, approver1, "approveTransfer", second.ID)
+	cancelled := checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", second.ID), statusCancelled, 2)
+	if cancelled.CancelReason != "Grant "+grant.ID+" has 40 left" {
+		t.Fatalf("Cancelled transfer is %+v", cancelled)
+	}
+	checkBalance(t, stub, "a", 40)
+}
+
+func TestApprovals_GrantRevoked(t *testing.T) {
+	stub := newApprovalStub(t)
+	grant := checkGrant(t, stub, alice, carol, "invoke", "a", "100")
+	pending := checkPending(t, stub.CheckInvoke(t, carol, "invoke", "a", "b", "60"), statusPending, 0)
+
+	stub.CheckInvoke(t, alice, "revokeGrant", grant.ID)
+	stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID)
+	cancelled := checkPending(t, stub.CheckInvoke(t, approver2, "approveTransfer", pending.ID), statusCancelled, 2)
+	if cancelled.CancelReason != "Grant "+grant.ID+" was revoked or expired" {
+		t.Fatalf("Cancelled transfer is %+v", cancelled)
+	}
+	checkBalance(t, stub, "a", 100)
+	if grants := listGrants(t, stub, alice, "grantor"); grants[0].Used != 0 {
+		t.Fatalf("Revoked grant used %d", grants[0].Used)
+	}
+}
+
+func TestApprovals_ExpiredTransferKeepsGrant(t *testing.T) {
+	stub := newApprovalStub(t)
+	checkGrant(t, stub, alice, carol, "invoke", "a", "100")
+	pending := checkPending(t, stub.CheckInvoke(t, carol, "invoke", "a", "b", "60"), statusPending, 0)
+	expirePending(t, stub, pending)
+	checkPending(t, stub.CheckInvoke(t, approver1, "approveTransfer", pending.ID), statusExpired, 0)
+
+	// the whole grant is still there
+	stub.CheckInvoke(t, carol, "invoke", "a", "b", "50")
+	stub.CheckInvoke(t, carol, "invoke", "a", "b", "50")
+	checkBalance(t, stub, "a", 0)
+}
@@ -0,0 +1,387 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Principal is an identity as cid sees it, the MSP ID plus the ID of the certificate
+type Principal struct {
+	MSPID string `json:"mspId"`
+	ID    string `json:"id"`
+}
+
+// Grant lets the grantee call Function on Account on behalf of the grantor until
+// NotAfter. Grants for invoke also bound the total amount the grantee may move
+// out of Account; Used counts what was moved so far.
+type Grant struct {
+	ID        string    `json:"id"`
+	Grantor   Principal `json:"grantor"`
+	Grantee   Principal `json:"grantee"`
+	Function  string    `json:"function"`
+	Account   string    `json:"account"`
+	MaxAmount int       `json:"maxAmount,omitempty"`
+	Used      int       `json:"used"`
+	NotAfter  string    `json:"notAfter"`
+	GrantedAt string    `json:"grantedAt"`
+	RevokedAt string    `json:"revokedAt,omitempty"`
+}
+
+const (
+	grantObject  = "abac~grant"
+	granteeIndex = "abac~grantee~account~grant"
+	grantorIndex = "abac~grantor~grant"
+)
+
+// delegableFunctions are the functions a grant can be given for, true when the
+// function moves an amount. Reads such as query stay under the policy alone, a
+// grant can't open them to a caller the policy denies.
+var delegableFunctions = map[string]bool{
+	"invoke": true,
+	"delete": false,
+}
+
+// getCaller returns the principal that submitted the transaction
+func getCaller(stub shim.ChaincodeStubInterface) (Principal, error) {
+	id, err := cid.New(stub)
+	if err != nil {
+		return Principal{}, err
+	}
+	mspID, err := id.GetMSPID()
+	if err != nil {
+		return Principal{}, err
+	}
+	certID, err := id.GetID()
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{MSPID: mspID, ID: certID}, nil
+}
+
+func getGrant(stub shim.ChaincodeStubInterface, grantID string) (*Grant, error) {
+	key, err := stub.CreateCompositeKey(grantObject, []string{grantID})
+	if err != nil {
+		return nil, err
+	}
+	grantBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get grant %s: %s", grantID, err)
+	}
+	if grantBytes == nil {
+		return nil, fmt.Errorf("Grant %s not found", grantID)
+	}
+	grant := &Grant{}
+	if err = json.Unmarshal(grantBytes, grant); err != nil {
+		return nil, fmt.Errorf("Failed to decode grant %s: %s", grantID, err)
+	}
+	return grant, nil
+}
+
+func putGrant(stub shim.ChaincodeStubInterface, grant *Grant) error {
+	key, err := stub.CreateCompositeKey(grantObject, []string{grant.ID})
+	if err != nil {
+		return err
+	}
+	grantBytes, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, grantBytes)
+}
+
+// active reports whether a grant can still be used at now
+func (g *Grant) active(now time.Time) bool {
+	notAfter, err := time.Parse(time.RFC3339, g.NotAfter)
+	return err == nil && g.RevokedAt == "" && !now.After(notAfter)
+}
+
+// useGrant finds an active grant to the caller for function on account with at
+// least amount left, from grantor or from anyone when grantor is nil, and records
+// the amount against it
+func useGrant(stub shim.ChaincodeStubInterface, grantor *Principal, function, account string, amount int) (*Grant, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(granteeIndex, []string{caller.MSPID, caller.ID, account})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		grant, err := getGrant(stub, keyParts[3])
+		if err != nil {
+			return nil, err
+		}
+		if grant.Function != function || !grant.active(now) {
+			continue
+		}
+		if grantor != nil && grant.Grantor != *grantor {
+			continue
+		}
+		if delegableFunctions[function] && grant.MaxAmount-grant.Used < amount {
+			continue
+		}
+		if delegableFunctions[function] {
+			grant.Used += amount
+			if err = putGrant(stub, grant); err != nil {
+				return nil, err
+			}
+		}
+		return grant, nil
+	}
+	return nil, fmt.Errorf("No grant allows the caller to %s %s", function, account)
+}
+
+// delegatedAuthority looks for a grant covering a call the caller isn't
+// authorized for on its own, from the account's owner when it has one
+func delegatedAuthority(stub shim.ChaincodeStubInterface, function string, args []string) (*Grant, error) {
+	movesAmount, ok := delegableFunctions[function]
+	if !ok || len(args) == 0 {
+		return nil, fmt.Errorf("%s can't be delegated", function)
+	}
+	amount := 0
+	if movesAmount {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("Incorrect number of arguments. Expecting 3")
+		}
+		var err error
+		if amount, err = strconv.Atoi(args[2]); err != nil {
+			return nil, fmt.Errorf("Invalid transaction amount, expecting a integer value")
+		}
+	}
+	owner, err := getAccountOwner(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return useGrant(stub, owner, function, args[0], amount)
+}
+
+// grant lets another identity call a function on an account on the caller's
+// behalf. Args are the grantee's MSP ID and ID (as returned by whoAmI), the
+// function, the account, the largest total amount for invoke ("0" otherwise)
+// and the RFC 3339 time the grant expires. The caller must be allowed to call
+// the function itself, and can't grant more than its own transfer.max.
+func (t *SimpleChaincode) grant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting grantee MSP ID, grantee ID, function, account, max amount and expiry")
+	}
+	grantor, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant := &Grant{
+		ID:       stub.GetTxID(),
+		Grantor:  grantor,
+		Grantee:  Principal{MSPID: args[0], ID: args[1]},
+		Function: args[2],
+		Account:  args[3],
+	}
+	if grant.Grantee.MSPID == "" || grant.Grantee.ID == "" {
+		return shim.Error("Grantee MSP ID and ID must be non-empty")
+	}
+	if grant.Grantee == grantor {
+		return shim.Error("Can't grant to yourself")
+	}
+	if err = validateEntity(grant.Account); err != nil {
+		return shim.Error(err.Error())
+	}
+	movesAmount, ok := delegableFunctions[grant.Function]
+	if !ok {
+		return shim.Error("Function " + grant.Function + " can't be delegated")
+	}
+	if grant.MaxAmount, err = strconv.Atoi(args[4]); err != nil {
+		return shim.Error("Expecting integer value for max amount")
+	}
+	if movesAmount && grant.MaxAmount <= 0 {
+		return shim.Error("Max amount must be positive for " + grant.Function)
+	}
+	if !movesAmount && grant.MaxAmount != 0 {
+		return shim.Error("Max amount must be 0 for " + grant.Function)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	notAfter, err := time.Parse(time.RFC3339, args[5])
+	if err != nil {
+		return shim.Error("Expiry must be an RFC 3339 time: " + err.Error())
+	}
+	if !notAfter.After(now) {
+		return shim.Error("Expiry must be in the future")
+	}
+	grant.NotAfter = notAfter.UTC().Format(time.RFC3339)
+	grant.GrantedAt = now.Format(time.RFC3339)
+
+	// A principal can only delegate authority it has
+	if err = authorize(stub, grant.Function); err != nil {
+		return shim.Error(err.Error())
+	}
+	if movesAmount {
+		maxTransfer, found, err := cid.GetAttributeInt(stub, transferMaxAttribute)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if found && int64(grant.MaxAmount) > maxTransfer {
+			return shim.Error(fmt.Sprintf("Max amount %d is above the caller's %s of %d", grant.MaxAmount, transferMaxAttribute, maxTransfer))
+		}
+	}
+
+	if err = putGrant(stub, grant); err != nil {
+		return shim.Error(err.Error())
+	}
+	granteeKey, err := stub.CreateCompositeKey(granteeIndex, []string{grant.Grantee.MSPID, grant.Grantee.ID, grant.Account, grant.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grantorKey, err := stub.CreateCompositeKey(grantorIndex, []string{grantor.MSPID, grantor.ID, grant.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(granteeKey, []byte{0x00}); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(grantorKey, []byte{0x00}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	grantBytes, err := json.Marshal(grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(grantBytes)
+}
+
+// revokeGrant ends a grant before it expires, it can be revoked by its grantor,
+// renounced by its grantee or revoked by an admin
+func (t *SimpleChaincode) revokeGrant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the grant ID")
+	}
+	grant, err := getGrant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if grant.RevokedAt != "" {
+		return shim.Error("Grant " + grant.ID + " was already revoked")
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != grant.Grantor && caller != grant.Grantee {
+		if err = cid.AssertAttributeValue(stub, adminAttribute, "true"); err != nil {
+			return shim.Error("Only the grantor, the grantee or an admin can revoke grant " + grant.ID)
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant.RevokedAt = now.Format(time.RFC3339)
+	if err = putGrant(stub, grant); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The grantor index keeps revoked grants so they can still be listed
+	granteeKey, err := stub.CreateCompositeKey(granteeIndex, []string{grant.Grantee.MSPID, grant.Grantee.ID, grant.Account, grant.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(granteeKey); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// listGrants returns the grants the caller gave ("grantor") or received
+// ("grantee", the default). Received grants only include unrevoked ones.
+func (t *SimpleChaincode) listGrants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting an optional \"grantor\" or \"grantee\"")
+	}
+	role := "grantee"
+	if len(args) == 1 {
+		role = args[0]
+	}
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var index string
+	switch role {
+	case "grantee":
+		index = granteeIndex
+	case "grantor":
+		index = grantorIndex
+	default:
+		return shim.Error("Expecting \"grantor\" or \"grantee\", not " + role)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{caller.MSPID, caller.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	grants := []Grant{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		grant, err := getGrant(stub, keyParts[len(keyParts)-1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		grants = append(grants, *grant)
+	}
+
+	grantsBytes, err := json.Marshal(grants)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(grantsBytes)
+}
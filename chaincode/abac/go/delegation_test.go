@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+var carol = cidtest.Identity{MSPID: "Org2MSP", CommonName: "carol"}
+
+// org1Policy lets only Org1MSP, alice but not bob or carol, call functions
+var org1Policy = Policy{Rules: map[string]PolicyRule{
+	"invoke": {Name: "org1", Expression: `mspid == "Org1MSP"`},
+	"delete": {Name: "org1", Expression: `mspid == "Org1MSP"`},
+	"query":  {Name: "org1", Expression: `mspid == "Org1MSP"`},
+}}
+
+func checkGrant(t *testing.T, stub *cidtest.Stub, grantor, grantee cidtest.Identity, function, account, maxAmount string) Grant {
+	mspID, id := principal(t, stub, grantee)
+	var grant Grant
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := json.Unmarshal(stub.CheckInvoke(t, grantor, "grant", mspID, id, function, account, maxAmount, expiry), &grant); err != nil {
+		t.Fatal(err)
+	}
+	return grant
+}
+
+func listGrants(t *testing.T, stub *cidtest.Stub, id cidtest.Identity, role string) []Grant {
+	var grants []Grant
+	if err := json.Unmarshal(stub.CheckInvoke(t, id, "listGrants", role), &grants); err != nil {
+		t.Fatal(err)
+	}
+	return grants
+}
+
+func TestDelegation_Invoke(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, org1Policy)
+	stub.CheckInvokeError(t, carol, "Access denied by rule org1 for invoke", "invoke", "a", "b", "1")
+
+	grant := checkGrant(t, stub, alice, carol, "invoke", "a", "50")
+	if grant.MaxAmount != 50 || grant.Used != 0 || grant.Function != "invoke" {
+		t.Fatalf("grant returned %+v", grant)
+	}
+
+	stub.CheckInvoke(t, carol, "invoke", "a", "b", "30")
+	stub.CheckInvoke(t, carol, "invoke", "a", "b", "20")
+	stub.CheckInvokeError(t, carol, "Access denied by rule org1 for invoke", "invoke", "a", "b", "1")
+	checkBalance(t, stub, "a", 50)
+
+	// the grant covers a, not b
+	stub.CheckInvokeError(t, carol, "Access denied by rule org1 for invoke", "invoke", "b", "a", "1")
+
+	grants := listGrants(t, stub, carol, "grantee")
+	if len(grants) != 1 || grants[0].Used != 50 {
+		t.Fatalf("listGrants returned %+v", grants)
+	}
+	if grants = listGrants(t, stub, alice, "grantor"); len(grants) != 1 || grants[0].ID != grant.ID {
+		t.Fatalf("listGrants returned %+v", grants)
+	}
+}
+
+func TestDelegation_Delete(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, org1Policy)
+	stub.CheckInvokeError(t, carol, "Access denied by rule org1 for delete", "delete", "a")
+	checkGrant(t, stub, alice, carol, "delete", "a", "0")
+	stub.CheckInvoke(t, carol, "delete", "a")
+	stub.CheckInvokeError(t, alice, "Nil amount for a", "query", "a")
+}
+
+func TestDelegation_OwnerCheck(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvokeError(t, carol, "Only the owner of a or an admin can delete it", "delete", "a")
+	checkGrant(t, stub, alice, carol, "delete", "a", "0")
+	stub.CheckInvoke(t, carol, "delete", "a")
+}
+
+func TestDelegation_OnlyFromOwner(t *testing.T) {
+	stub := newStub(t)
+	// bob can grant on a, but a grant from him doesn't count since he doesn't own a
+	checkGrant(t, stub, bob, carol, "invoke", "a", "50")
+	stub.CheckInvokeError(t, carol, "Only the owner of a or an admin can invoke it", "invoke", "a", "b", "10")
+}
+
+// Reads are left to the policy, a grant can't open them to a caller it denies
+func TestDelegation_QueryIsNotDelegable(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, org1Policy)
+	mspID, id := principal(t, stub, carol)
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	stub.CheckInvokeError(t, alice, "Function query can't be delegated", "grant", mspID, id, "query", "a", "0", expiry)
+	checkGrant(t, stub, alice, carol, "delete", "a", "0")
+	stub.CheckInvokeError(t, carol, "Access denied by rule org1 for query", "query", "a")
+}
+
+func TestDelegation_Revoke(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, org1Policy)
+	grant := checkGrant(t, stub, alice, carol, "invoke", "a", "50")
+
+	stub.CheckInvokeError(t, bob, "Only the grantor, the grantee or an admin", "revokeGrant", grant.ID)
+	stub.CheckInvoke(t, alice, "revokeGrant", grant.ID)
+	stub.CheckInvokeError(t, alice, "was already revoked", "revokeGrant", grant.ID)
+	stub.CheckInvokeError(t, carol, "Access denied", "invoke", "a", "b", "1")
+	if grants := listGrants(t, stub, carol, "grantee"); len(grants) != 0 {
+		t.Fatalf("listGrants returned %+v after the grant was revoked", grants)
+	}
+
+	// grantees can renounce and admins revoke
+	grant = checkGrant(t, stub, alice, carol, "invoke", "a", "50")
+	stub.CheckInvoke(t, carol, "revokeGrant", grant.ID)
+	grant = checkGrant(t, stub, alice, carol, "invoke", "a", "50")
+	stub.CheckInvoke(t, admin, "revokeGrant", grant.ID)
+
+	stub.CheckInvokeError(t, alice, "Grant nope not found", "revokeGrant", "nope")
+	stub.CheckInvokeError(t, alice, "Expecting the grant ID", "revokeGrant")
+}
+
+func TestDelegation_Expiry(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, org1Policy)
+	grant := checkGrant(t, stub, alice, carol, "invoke", "a", "50")
+
+	// move the expiry into the past
+	key, _ := stub.CreateCompositeKey(grantObject, []string{grant.ID})
+	grant.NotAfter = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	grantBytes, _ := json.Marshal(grant)
+	stub.State[key] = grantBytes
+
+	stub.CheckInvokeError(t, carol, "Access denied", "invoke", "a", "b", "1")
+}
+
+func TestDelegation_GrantErrors(t *testing.T) {
+	stub := newStub(t)
+	mspID, id := principal(t, stub, carol)
+	aliceMSP, aliceID := principal(t, stub, alice)
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	stub.CheckInvokeError(t, alice, "Incorrect number of arguments", "grant", mspID, id, "invoke", "a", "50")
+	stub.CheckInvokeError(t, alice, "must be non-empty", "grant", "", id, "invoke", "a", "50", expiry)
+	stub.CheckInvokeError(t, alice, "Can't grant to yourself", "grant", aliceMSP, aliceID, "invoke", "a", "50", expiry)
+	stub.CheckInvokeError(t, alice, "Invalid entity name", "grant", mspID, id, "invoke", "", "50", expiry)
+	stub.CheckInvokeError(t, alice, "Function setPolicy can't be delegated", "grant", mspID, id, "setPolicy", "a", "0", expiry)
+	stub.CheckInvokeError(t, alice, "Expecting integer value for max amount", "grant", mspID, id, "invoke", "a", "x", expiry)
+	stub.CheckInvokeError(t, alice, "Max amount must be positive for invoke", "grant", mspID, id, "invoke", "a", "0", expiry)
+	stub.CheckInvokeError(t, alice, "Max amount must be 0 for delete", "grant", mspID, id, "delete", "a", "5", expiry)
+	stub.CheckInvokeError(t, alice, "Expiry must be an RFC 3339 time", "grant", mspID, id, "invoke", "a", "50", "tomorrow")
+	stub.CheckInvokeError(t, alice, "Expiry must be in the future", "grant", mspID, id, "invoke", "a", "50", "2000-01-01T00:00:00Z")
+
+	limited := alice
+	limited.Attributes = map[string]interface{}{"transfer.max": 20}
+	stub.CheckInvokeError(t, limited, "Max amount 50 is above the caller's transfer.max of 20", "grant", mspID, id, "invoke", "a", "50", expiry)
+
+	// a principal can only delegate what the policy lets it do
+	setPolicy(t, stub, Policy{Rules: map[string]PolicyRule{"invoke": {Name: "org2", Expression: `mspid == "Org2MSP"`}}})
+	stub.CheckInvokeError(t, alice, "Access denied by rule org2", "grant", mspID, id, "invoke", "a", "50", expiry)
+
+	stub.CheckInvokeError(t, alice, `Expecting "grantor" or "grantee"`, "listGrants", "owner")
+}
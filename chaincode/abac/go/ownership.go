@@ -0,0 +1,193 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ownerObject prefixes the owner of each account. Accounts created before
+// ownership existed have no owner and can only be debited by an admin until
+// one is set with setOwner.
+const ownerObject = "abac~owner"
+
+// getAccountOwner returns the owner of an account, nil when it has none
+func getAccountOwner(stub shim.ChaincodeStubInterface, account string) (*Principal, error) {
+	key, err := stub.CreateCompositeKey(ownerObject, []string{account})
+	if err != nil {
+		return nil, err
+	}
+	ownerBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the owner of %s: %s", account, err)
+	}
+	if ownerBytes == nil {
+		return nil, nil
+	}
+	owner := &Principal{}
+	if err = json.Unmarshal(ownerBytes, owner); err != nil {
+		return nil, fmt.Errorf("Failed to decode the owner of %s: %s", account, err)
+	}
+	return owner, nil
+}
+
+func putAccountOwner(stub shim.ChaincodeStubInterface, account string, owner Principal) error {
+	key, err := stub.CreateCompositeKey(ownerObject, []string{account})
+	if err != nil {
+		return err
+	}
+	ownerBytes, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, ownerBytes)
+}
+
+func delAccountOwner(stub shim.ChaincodeStubInterface, account string) error {
+	key, err := stub.CreateCompositeKey(ownerObject, []string{account})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// isAdmin reports whether the caller has the admin attribute
+func isAdmin(stub shim.ChaincodeStubInterface) bool {
+	return cid.AssertAttributeValue(stub, adminAttribute, "true") == nil
+}
+
+// authorizeAccount checks that the caller may call function on account: it is
+// the owner, an admin, or holds a grant from the owner. grant is the grant the
+// call was already let through the policy with, if any, so it isn't used twice.
+// It returns the grant the call is made under, nil for the owner or an admin.
+func authorizeAccount(stub shim.ChaincodeStubInterface, function, account string, amount int, grant *Grant) (*Grant, error) {
+	caller, err := getCaller(stub)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := getAccountOwner(stub, account)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && *owner == caller {
+		return nil, nil
+	}
+	if isAdmin(stub) {
+		return nil, nil
+	}
+	if owner == nil {
+		return nil, fmt.Errorf("Account %s has no owner, only an admin can %s it", account, function)
+	}
+	if grant != nil && grant.Grantor == *owner && grant.Function == function && grant.Account == account {
+		return grant, nil
+	}
+	if grant, err = useGrant(stub, owner, function, account, amount); err != nil {
+		return nil, fmt.Errorf("Only the owner of %s or an admin can %s it: %s", account, function, err)
+	}
+	return grant, nil
+}
+
+// createAccount creates an empty account owned by the caller
+func (t *SimpleChaincode) createAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the account name")
+	}
+	account := args[0]
+	if err := validateEntity(account); err != nil {
+		return shim.Error(err.Error())
+	}
+	accountBytes, err := stub.GetState(account)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	if accountBytes != nil {
+		return shim.Error("Account " + account + " already exists")
+	}
+
+	owner, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(account, []byte("0")); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = putAccountOwner(stub, account, owner); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// getOwner returns the owner of an account
+func (t *SimpleChaincode) getOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the account name")
+	}
+	owner, err := getAccountOwner(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner == nil {
+		return shim.Error("Account " + args[0] + " has no owner")
+	}
+	ownerBytes, err := json.Marshal(owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ownerBytes)
+}
+
+// setOwner hands an account to another identity; args are the account and the
+// new owner's MSP ID and ID. Only the owner or an admin can do it.
+func (t *SimpleChaincode) setOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting account, owner MSP ID and owner ID")
+	}
+	account := args[0]
+	newOwner := Principal{MSPID: args[1], ID: args[2]}
+	if newOwner.MSPID == "" || newOwner.ID == "" {
+		return shim.Error("Owner MSP ID and ID must be non-empty")
+	}
+	accountBytes, err := stub.GetState(account)
+	if err != nil {
+		return shim.Error("Failed to get state")
+	}
+	if accountBytes == nil {
+		return shim.Error("Entity not found")
+	}
+
+	caller, err := getCaller(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := getAccountOwner(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if (owner == nil || *owner != caller) && !isAdmin(stub) {
+		return shim.Error("Only the owner of " + account + " or an admin can change its owner")
+	}
+
+	if err = putAccountOwner(stub, account, newOwner); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
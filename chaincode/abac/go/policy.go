@@ -0,0 +1,417 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Policy maps function names to the rule a caller must satisfy to call them.
+// It is stored on the ledger and replaced with setPolicy, by callers with the
+// abac.admin attribute set to "true". Functions without a rule are allowed
+// when Default is "allow" (or empty) and denied when it is "deny".
+//
+// A rule expression combines comparisons with &&, || and !, and parentheses:
+//
+//	mspid == "Org1MSP" && (attr.abac.role == "teller" || ou != "client")
+//
+// mspid is the caller's MSP ID, attr.<name> the value of a certificate
+// attribute ("" when the caller doesn't have it) and ou is true for == when
+// any of the certificate's organizational units matches. true and false are
+// also expressions.
+//
+// Approvals, when set, holds transfers above a threshold until enough approvers
+// approved them, see ApprovalRule.
+type Policy struct {
+	Default   string                `json:"default"`
+	Rules     map[string]PolicyRule `json:"rules"`
+	Approvals *ApprovalRule         `json:"approvals,omitempty"`
+}
+
+// PolicyRule is a named expression, the name is reported when the rule denies a call
+type PolicyRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+const (
+	adminAttribute = "abac.admin"
+	policyObject   = "abac~policy"
+)
+
+// policyKey is a composite key, so it can never be the name of an entity
+func policyKey(stub shim.ChaincodeStubInterface) (string, error) {
+	return stub.CreateCompositeKey(policyObject, []string{})
+}
+
+// getPolicy reads the policy from the ledger, nil when none was set
+func getPolicy(stub shim.ChaincodeStubInterface) (*Policy, error) {
+	key, err := policyKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	policyBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the policy: %s", err)
+	}
+	if policyBytes == nil {
+		return nil, nil
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(policyBytes, policy); err != nil {
+		return nil, fmt.Errorf("Failed to decode the policy: %s", err)
+	}
+	return policy, nil
+}
+
+// validate checks the default and parses every rule
+func (p *Policy) validate() error {
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("Policy default must be \"allow\" or \"deny\", not %q", p.Default)
+	}
+	for function, rule := range p.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("The rule for %s has no name", function)
+		}
+		if _, err := parsePolicyExpression(rule.Expression); err != nil {
+			return fmt.Errorf("Rule %s for %s: %s", rule.Name, function, err)
+		}
+	}
+	if p.Approvals != nil {
+		return p.Approvals.validate()
+	}
+	return nil
+}
+
+// authorize evaluates the rule of a function for the caller. Without a policy
+// on the ledger every function is allowed.
+func authorize(stub shim.ChaincodeStubInterface, function string) error {
+	policy, err := getPolicy(stub)
+	if err != nil || policy == nil {
+		return err
+	}
+	rule, ok := policy.Rules[function]
+	if !ok {
+		if policy.Default == "deny" {
+			return fmt.Errorf("Access denied: no rule allows %s", function)
+		}
+		return nil
+	}
+
+	expression, err := parsePolicyExpression(rule.Expression)
+	if err != nil {
+		return fmt.Errorf("Access denied by rule %s: %s", rule.Name, err)
+	}
+	id, err := cid.New(stub)
+	if err != nil {
+		return fmt.Errorf("Access denied by rule %s: %s", rule.Name, err)
+	}
+	allowed, err := expression.eval(id)
+	if err != nil {
+		return fmt.Errorf("Access denied by rule %s: %s", rule.Name, err)
+	}
+	if !allowed {
+		return fmt.Errorf("Access denied by rule %s for %s", rule.Name, function)
+	}
+	return nil
+}
+
+// setPolicy replaces the policy, only callers with the admin attribute can
+// change it, whatever the policy says, so a policy can't lock admins out
+func (t *SimpleChaincode) setPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting the policy JSON")
+	}
+	if err := cid.AssertAttributeValue(stub, adminAttribute, "true"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal([]byte(args[0]), policy); err != nil {
+		return shim.Error("Failed to decode the policy: " + err.Error())
+	}
+	if err := policy.validate(); err != nil {
+		return shim.Error(err.Error())
+	}
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := policyKey(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(key, policyBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// getPolicyDocument returns the policy stored on the ledger, or null
+func (t *SimpleChaincode) getPolicyDocument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	policy, err := getPolicy(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(policyBytes)
+}
+
+// policyExpression is a parsed rule expression
+type policyExpression interface {
+	eval(id cid.ClientIdentity) (bool, error)
+}
+
+type literalExpression bool
+
+type notExpression struct {
+	operand policyExpression
+}
+
+type binaryExpression struct {
+	and         bool // && when true, || otherwise
+	left, right policyExpression
+}
+
+type comparisonExpression struct {
+	subject string // mspid, ou or attr.<name>
+	equal   bool   // == when true, != otherwise
+	value   string
+}
+
+func (e literalExpression) eval(id cid.ClientIdentity) (bool, error) {
+	return bool(e), nil
+}
+
+func (e notExpression) eval(id cid.ClientIdentity) (bool, error) {
+	result, err := e.operand.eval(id)
+	return !result, err
+}
+
+func (e binaryExpression) eval(id cid.ClientIdentity) (bool, error) {
+	left, err := e.left.eval(id)
+	if err != nil {
+		return false, err
+	}
+	if left != e.and { // false && x, true || x
+		return left, nil
+	}
+	return e.right.eval(id)
+}
+
+func (e comparisonExpression) eval(id cid.ClientIdentity) (bool, error) {
+	var matches bool
+	switch {
+	case e.subject == "mspid":
+		mspid, err := id.GetMSPID()
+		if err != nil {
+			return false, err
+		}
+		matches = mspid == e.value
+	case e.subject == "ou":
+		cert, err := id.GetX509Certificate()
+		if err != nil {
+			return false, err
+		}
+		if cert != nil {
+			for _, ou := range cert.Subject.OrganizationalUnit {
+				if ou == e.value {
+					matches = true
+					break
+				}
+			}
+		}
+	default:
+		value, _, err := id.GetAttributeValue(strings.TrimPrefix(e.subject, "attr."))
+		if err != nil {
+			return false, err
+		}
+		matches = value == e.value
+	}
+	return matches == e.equal, nil
+}
+
+// parsePolicyExpression parses a rule expression, see Policy for the syntax
+func parsePolicyExpression(expression string) (policyExpression, error) {
+	tokens, err := tokenizePolicyExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := &policyParser{tokens: tokens}
+	result, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos].text)
+	}
+	return result, nil
+}
+
+type policyToken struct {
+	text   string
+	quoted bool // a string literal, text is unquoted
+}
+
+var policyOperators = map[string]bool{"==": true, "!=": true, "&&": true, "||": true}
+
+func tokenizePolicyExpression(expression string) ([]policyToken, error) {
+	var tokens []policyToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, policyToken{text: string(r)})
+			i++
+		case r == '!' && (i+1 >= len(runes) || runes[i+1] != '='):
+			tokens = append(tokens, policyToken{text: "!"})
+			i++
+		case i+1 < len(runes) && policyOperators[string(runes[i:i+2])]:
+			tokens = append(tokens, policyToken{text: string(runes[i : i+2])})
+			i += 2
+		case r == '"':
+			var value []rune
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, policyToken{text: string(value), quoted: true})
+			i++
+		case unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || strings.ContainsRune("._-", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, policyToken{text: string(runes[start:i])})
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return tokens, nil
+}
+
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+func (p *policyParser) next() (policyToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return policyToken{}, false
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	return token, true
+}
+
+func (p *policyParser) accept(operator string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == operator {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) parseOr() (policyExpression, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right policyExpression
+		right, err = p.parseAnd()
+		left = binaryExpression{and: false, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *policyParser) parseAnd() (policyExpression, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right policyExpression
+		right, err = p.parseUnary()
+		left = binaryExpression{and: true, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *policyParser) parseUnary() (policyExpression, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		return notExpression{operand}, err
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *policyParser) parseComparison() (policyExpression, error) {
+	subject, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	if subject.quoted {
+		return nil, fmt.Errorf("expecting mspid, ou or attr.<name> before %q", subject.text)
+	}
+	switch {
+	case subject.text == "true" || subject.text == "false":
+		return literalExpression(subject.text == "true"), nil
+	case subject.text == "mspid" || subject.text == "ou":
+	case strings.HasPrefix(subject.text, "attr.") && len(subject.text) > len("attr."):
+	default:
+		return nil, fmt.Errorf("unknown %s, expecting mspid, ou or attr.<name>", subject.text)
+	}
+
+	comparison := comparisonExpression{subject: subject.text}
+	switch {
+	case p.accept("=="):
+		comparison.equal = true
+	case p.accept("!="):
+	default:
+		return nil, fmt.Errorf("expecting == or != after %s", subject.text)
+	}
+	value, ok := p.next()
+	if !ok || !value.quoted {
+		return nil, fmt.Errorf("expecting a quoted string after %s", subject.text)
+	}
+	comparison.value = value.text
+	return comparison, nil
+}
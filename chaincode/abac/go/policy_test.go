@@ -0,0 +1,111 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func setPolicy(t *testing.T, stub *cidtest.Stub, policy Policy) {
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.CheckInvoke(t, admin, "setPolicy", string(policyBytes))
+}
+
+func TestPolicy_SetAndGet(t *testing.T) {
+	stub := newStub(t)
+
+	if policy := stub.CheckInvoke(t, alice, "getPolicy"); string(policy) != "null" {
+		t.Fatalf("getPolicy returned %s before a policy was set", policy)
+	}
+
+	policy := `{"default":"deny","rules":{"getPolicy":{"name":"anyone","expression":"true"}}}`
+	stub.CheckInvokeError(t, alice, "abac.admin", "setPolicy", policy)
+	stub.CheckInvoke(t, admin, "setPolicy", policy)
+	var stored Policy
+	if err := json.Unmarshal(stub.CheckInvoke(t, alice, "getPolicy"), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Default != "deny" || stored.Rules["getPolicy"].Name != "anyone" {
+		t.Fatalf("getPolicy returned %+v", stored)
+	}
+
+	// query has no rule so it's denied now, but admins can always replace the policy
+	stub.CheckInvokeError(t, alice, "Access denied: no rule allows query", "query", "a")
+	stub.CheckInvoke(t, admin, "setPolicy", `{"default":"allow"}`)
+	stub.CheckInvoke(t, alice, "query", "a")
+
+	stub.CheckInvokeError(t, admin, "Expecting the policy JSON", "setPolicy")
+	stub.CheckInvokeError(t, admin, "Failed to decode the policy", "setPolicy", "{")
+	stub.CheckInvokeError(t, admin, `must be "allow" or "deny"`, "setPolicy", `{"default":"maybe"}`)
+	stub.CheckInvokeError(t, admin, "The rule for query has no name", "setPolicy", `{"rules":{"query":{"expression":"true"}}}`)
+	stub.CheckInvokeError(t, admin, "Rule r for query", "setPolicy", `{"rules":{"query":{"name":"r","expression":"mspid =="}}}`)
+	stub.CheckInvokeError(t, admin, "at least one approver", "setPolicy", `{"approvals":{"threshold":10,"required":0,"expiresAfter":"1h"}}`)
+}
+
+func TestPolicy_Rules(t *testing.T) {
+	stub := newStub(t)
+	setPolicy(t, stub, Policy{Rules: map[string]PolicyRule{
+		"invoke": {Name: "org1", Expression: `mspid == "Org1MSP"`},
+		"delete": {Name: "auditors", Expression: `attr.abac.role == "auditor" || ou == "audit"`},
+		"query":  {Name: "not-org2", Expression: `!(mspid == "Org2MSP")`},
+	}})
+
+	stub.CheckInvoke(t, alice, "invoke", "a", "b", "1")
+	stub.CheckInvokeError(t, bob, "Access denied by rule org1 for invoke", "invoke", "b", "a", "1")
+	stub.CheckInvoke(t, alice, "query", "a")
+	stub.CheckInvokeError(t, bob, "Access denied by rule not-org2 for query", "query", "a")
+
+	stub.CheckInvokeError(t, alice, "Access denied by rule auditors for delete", "delete", "a")
+	auditor := alice
+	auditor.Attributes = map[string]interface{}{"abac.role": "auditor"}
+	stub.CheckInvoke(t, auditor, "delete", "a")
+	// the OU passes the rule, but the certificate isn't bob's so the owner check fails
+	auditor = bob
+	auditor.OUs = []string{"audit"}
+	stub.CheckInvokeError(t, auditor, "Only the owner of b or an admin can delete it", "delete", "b")
+}
+
+func TestPolicy_Expressions(t *testing.T) {
+	for expression, valid := range map[string]bool{
+		`true`:           true,
+		`false || !true`: true,
+		`mspid == "Org1MSP" && (ou != "client" || attr.x == "1")`: true,
+		`attr.a.b.c != ""`:  true,
+		`mspid`:             false,
+		`mspid = "Org1MSP"`: false,
+		`mspid == Org1MSP`:  false,
+		`mspid == "Org1MSP`: false,
+		`cn == "alice"`:     false,
+		`(true`:             false,
+		`true true`:         false,
+		`true $ false`:      false,
+		``:                  false,
+	} {
+		_, err := parsePolicyExpression(expression)
+		if valid && err != nil {
+			t.Errorf("%q failed to parse: %s", expression, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%q should not parse", expression)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// revokedObject prefixes the deny-list of certificates, keyed by issuer DN and
+// serial number since serial numbers are only unique per issuer
+const revokedObject = "abac~revoked"
+
+// Revocation is a deny-list entry, certificates on the list can't call the chaincode
+type Revocation struct {
+	IssuerDN     string `json:"issuerDN"`
+	SerialNumber string `json:"serialNumber"`
+	Reason       string `json:"reason"`
+	RevokedBy    string `json:"revokedBy"`
+	RevokedAt    string `json:"revokedAt"`
+	TxId         string `json:"txId"`
+}
+
+// CertificateInfo describes the caller's certificate, as returned by whoAmI
+type CertificateInfo struct {
+	MSPID        string `json:"mspId"`
+	ID           string `json:"id"`
+	SubjectDN    string `json:"subjectDN"`
+	IssuerDN     string `json:"issuerDN"`
+	SerialNumber string `json:"serialNumber"`
+	NotBefore    string `json:"notBefore"`
+	NotAfter     string `json:"notAfter"`
+}
+
+// txTime returns the transaction timestamp, the time certificates are checked at
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Failed to get the transaction timestamp: %s", err)
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// checkCertificate refuses callers whose certificate isn't valid at the
+// transaction timestamp or is on the deny-list
+func checkCertificate(stub shim.ChaincodeStubInterface) error {
+	id, err := cid.New(stub)
+	if err != nil {
+		return err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	if err = id.AssertValidAt(now); err != nil {
+		return err
+	}
+
+	issuer, _ := id.GetIssuerDN()
+	serial, err := id.GetSerialNumber()
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey(revokedObject, []string{issuer, serial})
+	if err != nil {
+		return err
+	}
+	revocationBytes, err := stub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get the deny-list: %s", err)
+	}
+	if revocationBytes != nil {
+		return fmt.Errorf("Certificate %s issued by %s is revoked", serial, issuer)
+	}
+	return nil
+}
+
+// revokeCertificate adds a certificate to the deny-list; args are the serial
+// number in hexadecimal, the issuer DN and an optional reason
+func (t *SimpleChaincode) revokeCertificate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number, issuer DN and optionally a reason")
+	}
+	if err := cid.AssertAttributeValue(stub, adminAttribute, "true"); err != nil {
+		return shim.Error(err.Error())
+	}
+	if args[0] == "" || args[1] == "" {
+		return shim.Error("Serial number and issuer DN must be non-empty")
+	}
+
+	revocation := &Revocation{SerialNumber: args[0], IssuerDN: args[1]}
+	if len(args) == 3 {
+		revocation.Reason = args[2]
+	}
+	revokedBy, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revocation.RevokedBy = revokedBy
+	revocation.RevokedAt = now.Format(time.RFC3339)
+	revocation.TxId = stub.GetTxID()
+
+	key, err := stub.CreateCompositeKey(revokedObject, []string{revocation.IssuerDN, revocation.SerialNumber})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revocationBytes, err := json.Marshal(revocation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(key, revocationBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(revocationBytes)
+}
+
+// restoreCertificate removes a certificate from the deny-list; args are the
+// serial number and the issuer DN
+func (t *SimpleChaincode) restoreCertificate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number and issuer DN")
+	}
+	if err := cid.AssertAttributeValue(stub, adminAttribute, "true"); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(revokedObject, []string{args[1], args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	revocationBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if revocationBytes == nil {
+		return shim.Error("Certificate " + args[0] + " issued by " + args[1] + " is not revoked")
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// listRevokedCertificates returns the deny-list, optionally only the entries
+// of one issuer DN
+func (t *SimpleChaincode) listRevokedCertificates(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting an optional issuer DN")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(revokedObject, args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	revocations := []Revocation{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var revocation Revocation
+		if err = json.Unmarshal(queryResponse.Value, &revocation); err != nil {
+			return shim.Error(err.Error())
+		}
+		revocations = append(revocations, revocation)
+	}
+
+	revocationsBytes, err := json.Marshal(revocations)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(revocationsBytes)
+}
+
+// whoAmI returns the details of the caller's certificate, including what an
+// admin needs to revoke it
+func (t *SimpleChaincode) whoAmI(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+	id, err := cid.New(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	info := CertificateInfo{}
+	if info.MSPID, err = id.GetMSPID(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if info.ID, err = id.GetID(); err != nil {
+		return shim.Error(err.Error())
+	}
+	if info.SerialNumber, err = id.GetSerialNumber(); err != nil {
+		return shim.Error(err.Error())
+	}
+	info.SubjectDN, _ = id.GetSubjectDN()
+	info.IssuerDN, _ = id.GetIssuerDN()
+	notBefore, notAfter, _ := id.GetValidity()
+	info.NotBefore = notBefore.UTC().Format(time.RFC3339)
+	info.NotAfter = notAfter.UTC().Format(time.RFC3339)
+
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(infoBytes)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestRevocation_RevokeAndRestore(t *testing.T) {
+	stub := newStub(t)
+	revoked := alice
+	revoked.SerialNumber = big.NewInt(0xabc)
+
+	var info CertificateInfo
+	if err := json.Unmarshal(stub.CheckInvoke(t, revoked, "whoAmI"), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.SerialNumber != "abc" || info.SubjectDN != "CN=alice" || info.MSPID != "Org1MSP" {
+		t.Fatalf("whoAmI returned %+v", info)
+	}
+
+	stub.CheckInvokeError(t, alice, "abac.admin", "revokeCertificate", "abc", info.IssuerDN)
+	stub.CheckInvoke(t, admin, "revokeCertificate", "abc", info.IssuerDN, "key compromise")
+	stub.CheckInvokeError(t, revoked, "Certificate abc issued by "+info.IssuerDN+" is revoked", "query", "a")
+	stub.CheckInvokeError(t, revoked, "is revoked", "whoAmI")
+	// the same identity with another certificate is still allowed
+	stub.CheckInvoke(t, alice, "query", "a")
+
+	var revocations []Revocation
+	if err := json.Unmarshal(stub.CheckInvoke(t, alice, "listRevokedCertificates"), &revocations); err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 1 || revocations[0].SerialNumber != "abc" || revocations[0].Reason != "key compromise" || revocations[0].TxId == "" {
+		t.Fatalf("listRevokedCertificates returned %+v", revocations)
+	}
+	if list := stub.CheckInvoke(t, alice, "listRevokedCertificates", "CN=someone else"); string(list) != "[]" {
+		t.Fatalf("listRevokedCertificates for another issuer returned %s", list)
+	}
+
+	stub.CheckInvokeError(t, alice, "abac.admin", "restoreCertificate", "abc", info.IssuerDN)
+	stub.CheckInvoke(t, admin, "restoreCertificate", "abc", info.IssuerDN)
+	stub.CheckInvoke(t, revoked, "query", "a")
+	stub.CheckInvokeError(t, admin, "is not revoked", "restoreCertificate", "abc", info.IssuerDN)
+
+	stub.CheckInvokeError(t, admin, "Expecting serial number, issuer DN", "revokeCertificate", "abc")
+	stub.CheckInvokeError(t, admin, "must be non-empty", "revokeCertificate", "", info.IssuerDN)
+	stub.CheckInvokeError(t, admin, "Expecting serial number and issuer DN", "restoreCertificate", "abc")
+	stub.CheckInvokeError(t, alice, "Expecting an optional issuer DN", "listRevokedCertificates", "a", "b")
+	stub.CheckInvokeError(t, alice, "Expecting 0", "whoAmI", "extra")
+}
+
+func TestRevocation_Validity(t *testing.T) {
+	stub := newStub(t)
+
+	expired := alice
+	expired.NotBefore = time.Now().Add(-48 * time.Hour)
+	expired.NotAfter = time.Now().Add(-24 * time.Hour)
+	stub.CheckInvokeError(t, expired, "Certificate expired at", "query", "a")
+
+	early := alice
+	early.NotBefore = time.Now().Add(24 * time.Hour)
+	early.NotAfter = time.Now().Add(48 * time.Hour)
+	stub.CheckInvokeError(t, early, "Certificate is not valid before", "query", "a")
+}
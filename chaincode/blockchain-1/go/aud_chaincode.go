@@ -34,7 +34,6 @@ under the License.
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
 
 // INDEXES TO SUPPORT COUCHDB RICH QUERIES
@@ -46,8 +45,8 @@ under the License.
 // CouchDB index JSON syntax as documented at:
 // http://docs.couchdb.org/en/2.1.1/api/database/find.html#db-index
 //
-// This marbles02 example chaincode demonstrates a packaged
-// index which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json.
+// This chaincode packages the indexes its queries use, starting with
+// META-INF/statedb/couchdb/indexes/indexEntityPeriod.json.
 // For deployment of chaincode to production environments, it is recommended
 // to define any indexes alongside chaincode so that the chaincode and supporting indexes
 // are deployed automatically as a unit, once the chaincode has been installed on a peer and
@@ -60,7 +59,7 @@ under the License.
 // chaincode in the META-INF/statedb/couchdb/indexes directory, for packaging and deployment
 // to managed environments.
 //
-// In the examples below you can find index definitions that support marbles02
+// In the examples below you can find index definitions that support this
 // chaincode queries, along with the syntax that you can use in development environments
 // to create the indexes in the CouchDB Fauxton interface or a curl command line utility.
 //
@@ -73,30 +72,34 @@ under the License.
 //Inside couchdb docker container
 // http://127.0.0.1:5984/
 
-// Index for docType, owner.
-// Note that docType and owner fields must be prefixed with the "data" wrapper
+// Index for docType, 被审计单位 (audited entity), 财务报表截止日/期间 (period).
+// Note that the fields must be prefixed with the "data" wrapper
 //
 // Index definition for use with Fauxton interface
-// {"index":{"fields":["data.docType","data.owner"]},"ddoc":"indexOwnerDoc", "name":"indexOwner","type":"json"}
+// {"index":{"fields":["data.docType","data.被审计单位","data.财务报表截止日/期间"]},"ddoc":"indexEntityPeriodDoc", "name":"indexEntityPeriod","type":"json"}
 //
 // Example curl command line to define index in the CouchDB channel_chaincode database
-// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"data.docType\",\"data.owner\"]},\"name\":\"indexOwner\",\"ddoc\":\"indexOwnerDoc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
+// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"data.docType\",\"data.被审计单位\",\"data.财务报表截止日/期间\"]},\"name\":\"indexEntityPeriod\",\"ddoc\":\"indexEntityPeriodDoc\",\"type\":\"json\"}" http://hostname:port/myc_mycc/_index
 //
 
-// Index for docType, owner, size (descending order).
-// Note that docType, owner and size fields must be prefixed with the "data" wrapper
+// Index for docType, 财务报表截止日/期间 (period).
+// Note that the fields must be prefixed with the "data" wrapper
 //
 // Index definition for use with Fauxton interface
-// {"index":{"fields":[{"data.size":"desc"},{"data.docType":"desc"},{"data.owner":"desc"}]},"ddoc":"indexSizeSortDoc", "name":"indexSizeSortDesc","type":"json"}
+// {"index":{"fields":["data.docType","data.财务报表截止日/期间"]},"ddoc":"indexPeriodDoc", "name":"indexPeriod","type":"json"}
 //
 // Example curl command line to define index in the CouchDB channel_chaincode database
-// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[{\"data.size\":\"desc\"},{\"data.docType\":\"desc\"},{\"data.owner\":\"desc\"}]},\"ddoc\":\"indexSizeSortDoc\", \"name\":\"indexSizeSortDesc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
+// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"data.docType\",\"data.财务报表截止日/期间\"]},\"name\":\"indexPeriod\",\"ddoc\":\"indexPeriodDoc\",\"type\":\"json\"}" http://hostname:port/myc_mycc/_index
 
-// Rich Query with index design doc and index name specified (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"marble\",\"owner\":\"tom\"}, \"use_index\":[\"_design/indexOwnerDoc\", \"indexOwner\"]}"]}'
+// List the indexes packaged with the chaincode, to pick a use_index value:
+//   peer chaincode query -C myc -n mycc -c '{"Args":["listIndexes"]}'
+
+// Audit Infos of an audited entity, latest period first, optionally for a single period (uses indexEntityPeriod):
+//   peer chaincode query -C myc -n mycc -c '{"Args":["queryInfosByEntity","某某公司"]}'
+//   peer chaincode query -C myc -n mycc -c '{"Args":["queryInfosByEntity","某某公司","2017-12-31"]}'
 
-// Rich Query with index design doc specified only (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":{\"$eq\":\"marble\"},\"owner\":{\"$eq\":\"tom\"},\"size\":{\"$gt\":0}},\"fields\":[\"docType\",\"owner\",\"size\"],\"sort\":[{\"size\":\"desc\"}],\"use_index\":\"_design/indexSizeSortDoc\"}"]}'
+// Rich Query with index design doc and index name specified (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc -n mycc -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"Info\",\"财务报表截止日/期间\":\"2017-12-31\"},\"use_index\":[\"_design/indexPeriodDoc\",\"indexPeriod\"]}"]}'
 
 package main
 
@@ -175,10 +178,12 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.delete(stub, args)
 	} else if function == "readInfo" { //read a marble
 		return t.readInfo(stub, args)
-	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query
-		return t.queryMarblesByOwner(stub, args)
 	} else if function == "queryMarbles" { //find marbles based on an ad hoc rich query
 		return t.queryMarbles(stub, args)
+	} else if function == "queryInfosByEntity" { //parameterized rich query on the packaged indexes
+		return t.queryInfosByEntity(stub, args)
+	} else if function == "listIndexes" { //list the packaged CouchDB indexes
+		return t.listIndexes(stub, args)
 	} else if function == "getHistoryForInfo" { //get history of values for a marble
 		return t.getHistoryForInfo(stub, args)
 	} else if function == "getMarblesByRange" { //get marbles based on range query
@@ -395,6 +400,11 @@ func (t *SimpleChaincode) readInfo(stub shim.ChaincodeStubInterface, args []stri
 		return shim.Error("Incorrect number of arguments. Expecting code of the student to query")
 	}
 
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	code = args[0]
 	valAsbytes, err := stub.GetState(code) //get the student from chaincode state
 	if err != nil {
@@ -467,7 +477,11 @@ func (t *SimpleChaincode) readInfo(stub shim.ChaincodeStubInterface, args []stri
 	fmt.Println("- end readInfo (success)" + "\n")
 	//return shim.Success(buffer.Bytes())
 
-	return shim.Success(valAsbytes)
+	visibleAsBytes, err := visibleRecord(guard, valAsbytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(visibleAsBytes)
 }
 
 // ==================================================
@@ -646,6 +660,11 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	startKey := args[0]
 	endKey := args[1]
 
@@ -665,6 +684,10 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		visibleAsBytes, err := visibleRecord(guard, queryResponse.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -675,8 +698,8 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 		buffer.WriteString("\"")
 
 		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
+		// Record is a JSON object, with only the fields the caller may see
+		buffer.WriteString(string(visibleAsBytes))
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
@@ -761,35 +784,42 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 // ============================================================================================
 
 // ===== Example: Parameterized rich query =================================================
-// queryMarblesByOwner queries for marbles based on a passed in owner.
-// This is an example of a parameterized query where the query logic is baked into the chaincode,
-// and accepting a single query parameter (owner).
+// queryInfosByEntity queries for the audit Infos of an audited entity (被审计单位),
+// latest period first, optionally for a single period (财务报表截止日/期间).
+// Uses the packaged indexEntityPeriod.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
-func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SimpleChaincode) queryInfosByEntity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "bob"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0            1
+	// "某某公司", "2017-12-31"
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting audited entity and optional period")
 	}
-
-	owner := strings.ToLower(args[0])
-
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
-
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
-	if err != nil {
-		return shim.Error(err.Error())
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
 	}
-	return shim.Success(queryResults)
+	selector := map[string]interface{}{"docType": "Info", "被审计单位": args[0]}
+	if len(args) == 2 {
+		selector["财务报表截止日/期间"] = args[1]
+	} else {
+		// the sort field has to be in the selector for CouchDB to use the index
+		selector["财务报表截止日/期间"] = map[string]interface{}{"$gt": nil}
+	}
+	query := map[string]interface{}{
+		"selector":  selector,
+		"sort":      []map[string]string{{"docType": "desc"}, {"被审计单位": "desc"}, {"财务报表截止日/期间": "desc"}},
+		"use_index": []string{"_design/indexEntityPeriodDoc", "indexEntityPeriod"},
+	}
+
+	return runGuardedQuery(stub, query)
 }
 
 // ===== Example: Ad hoc rich query ========================================================
 // queryMarbles uses a query string to perform a query for marbles.
-// Query string matching state database syntax is passed in and executed as is.
+// Query string matching state database syntax is checked by guardQuery before it is executed.
 // Supports ad hoc queries that can be defined at runtime by the client.
-// If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
+// If this is not desired, follow the queryInfosByEntity example for parameterized queries.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -800,7 +830,14 @@ func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	queryString := args[0]
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryString, err := guardQuery(guard, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -865,6 +902,11 @@ func (t *SimpleChaincode) getHistoryForInfo(stub shim.ChaincodeStubInterface, ar
 
 	fmt.Printf("- start getHistoryForInfo: %s\n", studentCode)
 
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	resultsIterator, err := stub.GetHistoryForKey(studentCode)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -898,7 +940,11 @@ func (t *SimpleChaincode) getHistoryForInfo(stub shim.ChaincodeStubInterface, ar
 		if response.IsDelete {
 			buffer.WriteString("null")
 		} else {
-			buffer.WriteString(string(response.Value))
+			visibleAsBytes, err := visibleRecord(guard, response.Value)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			buffer.WriteString(string(visibleAsBytes))
 		}
 
 		buffer.WriteString(",\n  \"Timestamp\":")
@@ -0,0 +1,267 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Luxurioust/excelize"
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	user  = cidtest.Identity{MSPID: "Org1MSP", CommonName: "user"}
+	admin = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{adminAttribute: "true"}}
+)
+
+// checkInfo reads a working paper as admin, who sees every field
+func checkInfo(t *testing.T, stub *cidtest.Stub, entity string) Info {
+	var info Info
+	if err := json.Unmarshal(stub.CheckInvoke(t, admin, "readInfo", entity), &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// withArg returns infoArgs with argument i replaced by value
+func withArg(i int, value string) []string {
+	args := append([]string(nil), infoArgs...)
+	args[i] = value
+	return args
+}
+
+// infoArgs are the initInfo and updateInfo arguments for the working paper of 北京某科技有限公司
+var infoArgs = []string{"北京某科技有限公司", "A1", "货币资金", "2017-12-31", "张三", "2018-01-15", "李四", "2018-01-20", "是", "是", "是", "否", "否"}
+
+// newStub returns the working papers of 北京某科技有限公司 and 上海某贸易有限公司
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("aud", new(SimpleChaincode))
+	if res := stub.InitAs(user, "init"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.CheckInvoke(t, user, append([]string{"initInfo"}, infoArgs...)...)
+	stub.CheckInvoke(t, user, "initInfo", "上海某贸易有限公司", "B2", "存货", "2017-12-31", "王五", "2018-02-01", "赵六", "2018-02-03", "是", "否", "是", "是", "是")
+	return stub
+}
+
+var ordinals = []string{"1st", "2nd", "3rd", "4th", "5th", "6th", "7th", "8th", "9th", "10th", "11th", "12th", "13th"}
+
+func TestAud_InitInfo(t *testing.T) {
+	stub := newStub(t)
+
+	expected := Info{"Info", "北京某科技有限公司", "A1", "货币资金", "2017-12-31", "张三", "2018-01-15", "李四", "2018-01-20", "是", "是", "是", "否", "否"}
+	if info := checkInfo(t, stub, infoArgs[0]); info != expected {
+		t.Fatalf("%s is %+v", infoArgs[0], info)
+	}
+
+	stub.CheckInvokeError(t, user, "This Info already exists: "+infoArgs[0], append([]string{"initInfo"}, infoArgs...)...)
+	stub.CheckInvokeError(t, user, "Expecting 13", append([]string{"initInfo"}, infoArgs[:12]...)...)
+	for i, ordinal := range ordinals {
+		stub.CheckInvokeError(t, user, ordinal+" argument must be a non-empty string", append([]string{"initInfo"}, withArg(i, "")...)...)
+	}
+	stub.CheckInvokeError(t, user, "Received unknown function invocation", "initStudent")
+}
+
+func TestAud_InitWithData(t *testing.T) {
+	stub := cidtest.NewStub("aud", new(SimpleChaincode))
+	stub.CheckInvoke(t, user, append([]string{"initInfo"}, infoArgs...)...)
+
+	xlsx, err := excelize.OpenFile("excel-1.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entities := map[string]bool{infoArgs[0]: true}
+	for index, row := range xlsx.GetRows("Sheet1") {
+		if index > 0 {
+			entities[row[0]] = true
+		}
+	}
+
+	stub.CheckInvoke(t, user, "InitWithData")
+	for entity := range entities {
+		checkInfo(t, stub, entity)
+	}
+	// working papers that already exist are left alone
+	if info := checkInfo(t, stub, infoArgs[0]); info.Item5 != infoArgs[1] {
+		t.Fatalf("InitWithData overwrote %s", infoArgs[0])
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "", "")); len(records) != len(entities) {
+		t.Fatalf("%d working papers after InitWithData, expected %d", len(records), len(entities))
+	}
+}
+
+func TestAud_ReadAndDelete(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting code of the student", "readInfo")
+	stub.CheckInvokeError(t, user, "Info does not exist: 某公司", "readInfo", "某公司")
+
+	stub.CheckInvoke(t, user, "delete", infoArgs[0])
+	stub.CheckInvokeError(t, user, "Info does not exist: "+infoArgs[0], "readInfo", infoArgs[0])
+	stub.CheckInvokeError(t, user, "Info does not exist: "+infoArgs[0], "delete", infoArgs[0])
+	stub.CheckInvokeError(t, user, "Expecting 1", "delete")
+	checkInfo(t, stub, "上海某贸易有限公司")
+
+	stub.MockTransactionStart("raw")
+	stub.PutState("broken", []byte("{"))
+	stub.MockTransactionEnd("raw")
+	stub.CheckInvokeError(t, user, "unexpected end of JSON input", "readInfo", "broken")
+	stub.CheckInvokeError(t, user, "Failed to decode JSON of: broken", "delete", "broken")
+}
+
+func TestAud_UpdateInfo(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, user, append([]string{"updateInfo"}, withArg(12, "是")...)...)
+	expected := Info{"Info", "北京某科技有限公司", "A1", "货币资金", "2017-12-31", "张三", "2018-01-15", "李四", "2018-01-20", "是", "是", "是", "否", "是"}
+	if info := checkInfo(t, stub, infoArgs[0]); info != expected {
+		t.Fatalf("%s is %+v", infoArgs[0], info)
+	}
+
+	stub.CheckInvokeError(t, user, "This info does not exists: 某公司", append([]string{"updateInfo"}, withArg(0, "某公司")...)...)
+	stub.CheckInvokeError(t, user, "Expecting 13", "updateInfo", infoArgs[0])
+	for i, ordinal := range ordinals {
+		stub.CheckInvokeError(t, user, ordinal+" argument must be a non-empty string", append([]string{"updateInfo"}, withArg(i, "")...)...)
+	}
+
+	stub.State["上海某贸易有限公司"] = []byte("{")
+	stub.CheckInvokeError(t, user, "unexpected end of JSON input", append([]string{"updateInfo"}, withArg(0, "上海某贸易有限公司")...)...)
+}
+
+// queryRecord is one element of the JSON arrays the query functions return
+type queryRecord struct {
+	Key    string
+	Record Info
+}
+
+func queryRecords(t *testing.T, payload []byte) []queryRecord {
+	var records []queryRecord
+	if err := json.Unmarshal(payload, &records); err != nil {
+		t.Fatalf("%s: %s", err, payload)
+	}
+	return records
+}
+
+func recordKeys(records []queryRecord) string {
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestAud_GetMarblesByRange(t *testing.T) {
+	stub := newStub(t)
+
+	records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "上", "北"))
+	if len(records) != 1 || records[0].Key != "上海某贸易有限公司" || records[0].Record.Item6 != "存货" {
+		t.Fatalf("getMarblesByRange returned %+v", records)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "getMarblesByRange", "上")
+}
+
+func TestAud_TransferMarblesBasedOnColor(t *testing.T) {
+	stub := newStub(t)
+
+	// working papers have no color~name index, so there is never anything to transfer
+	if payload := stub.CheckInvoke(t, user, "transferMarblesBasedOnColor", "blue", "Jerry"); string(payload) != "Transferred 0 blue marbles to jerry" {
+		t.Fatalf("transferMarblesBasedOnColor returned %s", payload)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "transferMarblesBasedOnColor", "blue")
+}
+
+func TestAud_GetHistoryForInfo(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting 1", "getHistoryForInfo")
+	// MockStub keeps no history
+	stub.CheckInvokeError(t, user, "not implemented", "getHistoryForInfo", infoArgs[0])
+}
+
+func TestAud_RichQueries(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Received unknown function invocation", "queryMarblesByOwner", "tom")
+	stub.CheckInvokeError(t, user, "Expecting 1", "queryMarbles")
+	stub.CheckInvokeError(t, user, "Expecting audited entity", "queryInfosByEntity")
+	stub.CheckInvokeError(t, user, "Expecting audited entity", "queryInfosByEntity", infoArgs[0], "2017-12-31", "2018-12-31")
+	stub.CheckInvokeError(t, user, "1st argument must be a non-empty string", "queryInfosByEntity", "")
+	stub.CheckInvokeError(t, user, reasonDocTypeForbidden, "queryMarbles", `{"selector":{"docType":"marble"}}`)
+
+	// queries that pass the guard reach the state database, which refuses them without rich queries
+	stub.CheckInvokeError(t, user, "not supported for leveldb", "queryMarbles", `{"selector":{"docType":"Info"}}`)
+	stub.CheckInvokeError(t, user, "not supported for leveldb", "queryInfosByEntity", infoArgs[0], "2017-12-31")
+}
+
+func TestAud_RichQueriesOnCouchDB(t *testing.T) {
+	stub := newStub(t)
+	stub.SetRichQuery(true)
+	stub.CheckInvoke(t, user, "initInfo", "北京某科技有限公司2016", "A1", "货币资金", "2016-12-31", "张三", "2017-01-16", "李四", "2017-01-21", "是", "是", "是", "是", "是")
+	// a working paper of an earlier period, of the same audited entity
+	info := checkInfo(t, stub, "北京某科技有限公司2016")
+	info.Item4 = infoArgs[0]
+	infoAsBytes, _ := json.Marshal(info)
+	stub.MockTransactionStart("raw")
+	stub.PutState("北京某科技有限公司2016", infoAsBytes)
+	stub.MockTransactionEnd("raw")
+
+	// latest period first, and without the preparer or reviewer unless the caller is an admin
+	records := queryRecords(t, stub.CheckInvoke(t, user, "queryInfosByEntity", infoArgs[0]))
+	if recordKeys(records) != "北京某科技有限公司,北京某科技有限公司2016" {
+		t.Fatalf("%s returned %s", infoArgs[0], recordKeys(records))
+	}
+	if records[0].Record.Item8 != "" || records[0].Record.Item10 != "" || records[0].Record.Item6 != "货币资金" {
+		t.Fatalf("user sees %+v", records[0].Record)
+	}
+	records = queryRecords(t, stub.CheckInvoke(t, admin, "queryInfosByEntity", infoArgs[0], "2016-12-31"))
+	if recordKeys(records) != "北京某科技有限公司2016" {
+		t.Fatalf("%s 2016-12-31 returned %s", infoArgs[0], recordKeys(records))
+	}
+	if records[0].Record.Item8 != "张三" || records[0].Record.Item10 != "李四" {
+		t.Fatalf("admin sees %+v", records[0].Record)
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryInfosByEntity", "某公司")); len(records) != 0 {
+		t.Fatalf("某公司 returned %s", recordKeys(records))
+	}
+
+	tests := []struct {
+		query string
+		keys  string
+	}{
+		{`{"selector":{"docType":"Info","财务报表截止日/期间":{"$lt":"2017-01-01"}}}`, "北京某科技有限公司2016"},
+		{`{"selector":{"docType":"Info","被审计单位":{"$regex":"^上海"}}}`, "上海某贸易有限公司"},
+		{`{"selector":{"docType":"Info","$or":[{"项目":"存货"},{"索引号":{"$in":["A1"]}}]},"limit":2}`, "上海某贸易有限公司,北京某科技有限公司"},
+		{`{"selector":{"docType":"Info"},"sort":[{"财务报表截止日/期间":"asc"}],"use_index":"indexPeriodDoc"}`, "北京某科技有限公司2016,上海某贸易有限公司,北京某科技有限公司"},
+	}
+	for _, test := range tests {
+		if keys := recordKeys(queryRecords(t, stub.CheckInvoke(t, user, "queryMarbles", test.query))); keys != test.keys {
+			t.Errorf("%s returned %s, expected %s", test.query, keys, test.keys)
+		}
+	}
+
+	// only an admin can select on the preparer or reviewer
+	stub.CheckInvokeError(t, user, "Querying field 编制 is not allowed", "queryMarbles", `{"selector":{"docType":"Info","编制":"王五"}}`)
+	if keys := recordKeys(queryRecords(t, stub.CheckInvoke(t, admin, "queryMarbles", `{"selector":{"docType":"Info","编制":"王五"}}`))); keys != "上海某贸易有限公司" {
+		t.Fatalf("admin selecting 编制 returned %s", keys)
+	}
+}
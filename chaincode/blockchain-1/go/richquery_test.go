@@ -0,0 +1,245 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// checkQueryError expects guardQuery to refuse the query with reason
+func checkQueryError(t *testing.T, guard queryGuard, queryString string, reason string) {
+	_, err := guardQuery(guard, queryString)
+	queryErr, ok := err.(*queryError)
+	if !ok {
+		t.Fatalf("%s returned %v, expected a queryError", queryString, err)
+	}
+	if queryErr.Reason != reason {
+		t.Fatalf("%s was refused with %s (%s), expected %s", queryString, queryErr.Reason, queryErr.Message, reason)
+	}
+}
+
+// checkGuardedQuery expects guardQuery to accept the query and returns what it sends on
+func checkGuardedQuery(t *testing.T, guard queryGuard, queryString string) map[string]interface{} {
+	guarded, err := guardQuery(guard, queryString)
+	if err != nil {
+		t.Fatalf("%s was refused: %s", queryString, err)
+	}
+	query := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(guarded), &query); err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func guardOf(t *testing.T, stub *cidtest.Stub, id cidtest.Identity) queryGuard {
+	if err := stub.SetIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	stub.MockTransactionStart("guard")
+	defer stub.MockTransactionEnd("guard")
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guard
+}
+
+func TestRichQuery_CallerQueryGuard(t *testing.T) {
+	stub := newStub(t)
+
+	// the preparer and the reviewer are stripped for everyone but admins
+	userGuard := guardOf(t, stub, user)
+	if len(userGuard.fields) != len(infoFields(nil))-len(restrictedInfoFields) || userGuard.maxLimit != maxQueryLimit {
+		t.Fatalf("user guard is %+v", userGuard)
+	}
+	for _, field := range restrictedInfoFields {
+		if containsString(userGuard.fields, field) {
+			t.Fatalf("user guard shows %s", field)
+		}
+	}
+	query := checkGuardedQuery(t, userGuard, `{"selector":{"docType":"Info"},"fields":["被审计单位","编制","复核"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"被审计单位"}) {
+		t.Fatalf("user fields are %v", query["fields"])
+	}
+
+	adminGuard := guardOf(t, stub, admin)
+	if adminGuard.fields != nil {
+		t.Fatalf("admin guard is %+v", adminGuard)
+	}
+	query = checkGuardedQuery(t, adminGuard, `{"selector":{"docType":"Info"},"fields":["编制"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"编制"}) {
+		t.Fatalf("admin fields are %v", query["fields"])
+	}
+
+	stub.SetCreator(nil)
+	if res := stub.MockInvoke("nocreator", [][]byte{[]byte("queryInfosByEntity"), []byte(infoArgs[0])}); res.Status == shim.OK {
+		t.Fatalf("queryInfosByEntity without a creator should have failed")
+	}
+}
+
+func TestRichQuery_InfoFields(t *testing.T) {
+	fields := infoFields(nil)
+	if len(fields) != 14 || fields[0] != "docType" || fields[1] != "被审计单位" {
+		t.Fatalf("Info fields are %v", fields)
+	}
+	if fields := infoFields([]string{"docType"}); len(fields) != 13 || containsString(fields, "docType") {
+		t.Fatalf("Info fields without docType are %v", fields)
+	}
+}
+
+func TestRichQuery_GuardQuery(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"Info"}, maxLimit: maxQueryLimit}
+
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":"Info"}}`); query["limit"] != float64(maxQueryLimit) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":{"$eq":"Info"}},"limit":1000}`); query["limit"] != float64(maxQueryLimit) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"Info"},"sort":[{"财务报表截止日/期间":"desc"}],"use_index":"_design/indexPeriodDoc"}`)
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"Info"},"sort":["被审计单位"]}`)
+
+	checkQueryError(t, guard, `{`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":[]}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"info"}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":{"$eq":"Info","$ne":"marble"}}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"limit":true}`, reasonInvalidLimit)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"sort":{"项目":"asc"}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"sort":["项目"]}`, reasonUnindexedSort)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"sort":["被审计单位"],"use_index":"indexPeriodDoc"}`, reasonUnindexedSort)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"use_index":["indexPeriodDoc","indexEntityPeriod"]}`, reasonUnknownIndex)
+}
+
+// TestRichQuery_SelectorFields checks that the preparer and the reviewer can't be tested or sorted on
+func TestRichQuery_SelectorFields(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"Info"}, fields: infoFields(restrictedInfoFields), maxLimit: maxQueryLimit}
+
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"Info","被审计单位":"北京某科技有限公司","$or":[{"项目":"存货"},{"$not":{"索引号":"A1"}}]}}`)
+
+	for _, selector := range []string{
+		`{"docType":"Info","编制":"张三"}`,
+		`{"docType":"Info","$and":[{"项目":"存货"},{"复核":"李四"}]}`,
+		`{"docType":"Info","$or":[{"索引号":"A1"},{"编制":{"$regex":"^张"}}]}`,
+		`{"docType":"Info","$nor":[{"$not":{"复核":"李四"}}]}`,
+	} {
+		checkQueryError(t, guard, `{"selector":`+selector+`}`, reasonFieldForbidden)
+	}
+	checkQueryError(t, guard, `{"selector":{"docType":"Info","$and":{"编制":"张三"}}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info","$text":"张三"}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"Info"},"sort":[{"复核":"desc"}]}`, reasonFieldForbidden)
+
+	// admins may test any field
+	guard.fields = nil
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"Info","$or":[{"编制":"张三"},{"复核":"李四"}]}}`)
+}
+
+// TestRichQuery_VisibleRecords checks that key and range reads hide what queries hide
+func TestRichQuery_VisibleRecords(t *testing.T) {
+	stub := newStub(t)
+
+	visible := map[string]interface{}{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "readInfo", infoArgs[0]), &visible); err != nil {
+		t.Fatal(err)
+	}
+	if len(visible) != len(infoFields(restrictedInfoFields)) || visible["编制"] != nil || visible["复核"] != nil || visible["索引号"] != "A1" {
+		t.Fatalf("user reads %s as %v", infoArgs[0], visible)
+	}
+	if info := checkInfo(t, stub, infoArgs[0]); info.Item8 != "张三" || info.Item10 != "李四" {
+		t.Fatalf("admin reads %s as %+v", infoArgs[0], info)
+	}
+
+	records := []struct {
+		Key    string
+		Record map[string]interface{}
+	}{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "getMarblesByRange", "", ""), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("range returned %+v", records)
+	}
+	for _, record := range records {
+		if _, present := record.Record["编制"]; present || record.Record["被审计单位"] != record.Key {
+			t.Fatalf("user range read %s as %v", record.Key, record.Record)
+		}
+	}
+	if err := json.Unmarshal(stub.CheckInvoke(t, admin, "getMarblesByRange", "", ""), &records); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if record.Record["编制"] == nil || record.Record["复核"] == nil {
+			t.Fatalf("admin range read %s as %v", record.Key, record.Record)
+		}
+	}
+}
+
+func TestRichQuery_ListIndexes(t *testing.T) {
+	stub := newStub(t)
+
+	indexes := []couchIndex{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "listIndexes"), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, packagedIndexes) {
+		t.Fatalf("listIndexes returned %+v", indexes)
+	}
+}
+
+// TestRichQuery_PackagedIndexes checks packagedIndexes is in step with META-INF
+func TestRichQuery_PackagedIndexes(t *testing.T) {
+	const indexDir = "META-INF/statedb/couchdb/indexes"
+	files, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	definitions := map[string]couchIndex{}
+	for _, file := range files {
+		definitionAsBytes, err := ioutil.ReadFile(filepath.Join(indexDir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		definition := struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			DesignDoc string `json:"ddoc"`
+			Name      string `json:"name"`
+		}{}
+		if err := json.Unmarshal(definitionAsBytes, &definition); err != nil {
+			t.Fatalf("%s: %s", file.Name(), err)
+		}
+		definitions[definition.DesignDoc] = couchIndex{definition.DesignDoc, definition.Name, definition.Index.Fields}
+	}
+	if len(definitions) != len(packagedIndexes) {
+		t.Fatalf("%s has %d indexes, packagedIndexes %d", indexDir, len(definitions), len(packagedIndexes))
+	}
+	for _, index := range packagedIndexes {
+		if !reflect.DeepEqual(definitions[index.DesignDoc], index) {
+			t.Fatalf("packaged index %+v doesn't match %s %+v", index, indexDir, definitions[index.DesignDoc])
+		}
+	}
+}
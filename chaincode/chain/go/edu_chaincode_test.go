@@ -0,0 +1,279 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Luxurioust/excelize"
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	user  = cidtest.Identity{MSPID: "Org1MSP", CommonName: "user"}
+	admin = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{adminAttribute: "true"}}
+)
+
+// checkStudent reads a student as admin, who sees every field
+func checkStudent(t *testing.T, stub *cidtest.Stub, code string) student {
+	var s student
+	if err := json.Unmarshal(stub.CheckInvoke(t, admin, "readStudent", code), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// withArg returns studentArgs with argument i replaced by value
+func withArg(i int, value string) []string {
+	args := append([]string(nil), studentArgs...)
+	args[i] = value
+	return args
+}
+
+// studentArgs are the initStudent and updateStudent arguments for 51114214 of school 28101
+var studentArgs = []string{"51114214", "女", "京籍", "首都师范大学附属密云中学", "28101", "536.5", "106.5", "100", "97", "233"}
+
+// newStub returns students 51114214 of school 28101 and 51114215 of school 28102
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("edu", new(SimpleChaincode))
+	if res := stub.InitAs(user, "init"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.CheckInvoke(t, user, append([]string{"initStudent"}, studentArgs...)...)
+	stub.CheckInvoke(t, user, "initStudent", "51114215", "男", "非京籍", "北京市第二中学", "28102", "601", "120", "130", "111", "240")
+	return stub
+}
+
+func TestEdu_InitStudent(t *testing.T) {
+	stub := newStub(t)
+
+	expected := student{"student", "51114214", "女", "京籍", "首都师范大学附属密云中学", 28101, 536.5, 106.5, 100, 97, 233}
+	if s := checkStudent(t, stub, "51114214"); s != expected {
+		t.Fatalf("51114214 is %+v", s)
+	}
+
+	stub.CheckInvokeError(t, user, "This student already exists: 51114214", append([]string{"initStudent"}, studentArgs...)...)
+	stub.CheckInvokeError(t, user, "Expecting 10", append([]string{"initStudent"}, studentArgs[:9]...)...)
+	ordinals := []string{"1st", "2nd", "3rd", "4th", "5th", "6th", "7th", "8th", "9th", "10th"}
+	for i, ordinal := range ordinals {
+		stub.CheckInvokeError(t, user, ordinal+" argument must be a non-empty string", append([]string{"initStudent"}, withArg(i, "")...)...)
+		if i >= 4 {
+			stub.CheckInvokeError(t, user, ordinal+" argument must be a numeric string", append([]string{"initStudent"}, withArg(i, "x")...)...)
+		}
+	}
+	stub.CheckInvokeError(t, user, "Received unknown function invocation", "initMarble")
+}
+
+func TestEdu_InitWithData(t *testing.T) {
+	stub := cidtest.NewStub("edu", new(SimpleChaincode))
+	stub.CheckInvoke(t, user, append([]string{"initStudent"}, withArg(5, "1")...)...)
+
+	xlsx, err := excelize.OpenFile("excel-1.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := map[string]bool{}
+	for index, row := range xlsx.GetRows("Sheet1") {
+		if index > 0 {
+			codes[row[0]] = true
+		}
+	}
+
+	stub.CheckInvoke(t, user, "InitWithData")
+	for code := range codes {
+		if code == studentArgs[0] {
+			continue
+		}
+		checkStudent(t, stub, code)
+	}
+	// students that already exist are left alone
+	if s := checkStudent(t, stub, studentArgs[0]); s.CollegeEntranceExaminationScore != 1 {
+		t.Fatalf("InitWithData overwrote %s", studentArgs[0])
+	}
+	records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "", ""))
+	codes[studentArgs[0]] = true
+	if len(records) != len(codes) {
+		t.Fatalf("%d students after InitWithData, expected %d", len(records), len(codes))
+	}
+	stub.CheckInvoke(t, user, "InitWithData")
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "", "")); len(records) != len(codes) {
+		t.Fatalf("%d students after a second InitWithData, expected %d", len(records), len(codes))
+	}
+}
+
+func TestEdu_ReadAndDelete(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting code of the student", "readStudent")
+	stub.CheckInvokeError(t, user, "Student does not exist: 1", "readStudent", "1")
+
+	stub.CheckInvoke(t, user, "delete", "51114214")
+	stub.CheckInvokeError(t, user, "Student does not exist: 51114214", "readStudent", "51114214")
+	stub.CheckInvokeError(t, user, "Student does not exist: 51114214", "delete", "51114214")
+	stub.CheckInvokeError(t, user, "Expecting 1", "delete")
+	checkStudent(t, stub, "51114215")
+
+	stub.MockTransactionStart("raw")
+	stub.PutState("broken", []byte("{"))
+	stub.MockTransactionEnd("raw")
+	stub.CheckInvokeError(t, user, "unexpected end of JSON input", "readStudent", "broken")
+	stub.CheckInvokeError(t, user, "Failed to decode JSON of: broken", "delete", "broken")
+}
+
+func TestEdu_UpdateStudent(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, user, "updateStudent", "51114214", "女", "京籍", "北京市第二中学", "28102", "540.5", "110.5", "100", "97", "233")
+	s := checkStudent(t, stub, "51114214")
+	if s.SchoolCode != 28102 || s.SeniorHighSchool != "北京市第二中学" || s.CollegeEntranceExaminationScore != 540.5 || s.Chinese != 110.5 {
+		t.Fatalf("51114214 is %+v", s)
+	}
+
+	// the total must be the sum of the four subjects
+	stub.CheckInvokeError(t, user, "Score error", append([]string{"updateStudent"}, withArg(5, "600")...)...)
+	stub.CheckInvokeError(t, user, "This student does not exists: 1", append([]string{"updateStudent"}, withArg(0, "1")...)...)
+	stub.CheckInvokeError(t, user, "Expecting 10", "updateStudent", "51114214")
+	ordinals := []string{"1st", "2nd", "3rd", "4th", "5th", "6th", "7th", "8th", "9th", "10th"}
+	for i, ordinal := range ordinals {
+		stub.CheckInvokeError(t, user, ordinal+" argument must be a non-empty string", append([]string{"updateStudent"}, withArg(i, "")...)...)
+		if i >= 4 {
+			stub.CheckInvokeError(t, user, ordinal+" argument must be a numeric string", append([]string{"updateStudent"}, withArg(i, "x")...)...)
+		}
+	}
+
+	stub.State["51114215"] = []byte("{")
+	stub.CheckInvokeError(t, user, "unexpected end of JSON input", append([]string{"updateStudent"}, withArg(0, "51114215")...)...)
+}
+
+// queryRecord is one element of the JSON arrays the query functions return
+type queryRecord struct {
+	Key    string
+	Record student
+}
+
+func queryRecords(t *testing.T, payload []byte) []queryRecord {
+	var records []queryRecord
+	if err := json.Unmarshal(payload, &records); err != nil {
+		t.Fatalf("%s: %s", err, payload)
+	}
+	return records
+}
+
+func recordKeys(records []queryRecord) string {
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestEdu_GetMarblesByRange(t *testing.T) {
+	stub := newStub(t)
+
+	records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "51114215", "51114216"))
+	if len(records) != 1 || records[0].Key != "51114215" || records[0].Record.SchoolCode != 28102 {
+		t.Fatalf("getMarblesByRange returned %+v", records)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "getMarblesByRange", "51114215")
+}
+
+func TestEdu_TransferMarblesBasedOnColor(t *testing.T) {
+	stub := newStub(t)
+
+	// students have no color~name index, so there is never anything to transfer
+	if payload := stub.CheckInvoke(t, user, "transferMarblesBasedOnColor", "blue", "Jerry"); string(payload) != "Transferred 0 blue marbles to jerry" {
+		t.Fatalf("transferMarblesBasedOnColor returned %s", payload)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "transferMarblesBasedOnColor", "blue")
+}
+
+func TestEdu_GetHistoryForStudent(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting 1", "getHistoryForStudent")
+	// MockStub keeps no history
+	stub.CheckInvokeError(t, user, "not implemented", "getHistoryForStudent", "51114214")
+}
+
+func TestEdu_RichQueries(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Received unknown function invocation", "queryMarblesByOwner", "tom")
+	stub.CheckInvokeError(t, user, "Expecting 1", "queryMarbles")
+	stub.CheckInvokeError(t, user, "Expecting school code", "queryStudentsBySchool")
+	stub.CheckInvokeError(t, user, "Expecting school code", "queryStudentsBySchool", "28101", "500", "600")
+	stub.CheckInvokeError(t, user, "1st argument must be a numeric string", "queryStudentsBySchool", "school")
+	stub.CheckInvokeError(t, user, "2nd argument must be a numeric string", "queryStudentsBySchool", "28101", "high")
+	stub.CheckInvokeError(t, user, reasonDocTypeForbidden, "queryMarbles", `{"selector":{"docType":"marble"}}`)
+
+	// queries that pass the guard reach the state database, which refuses them without rich queries
+	stub.CheckInvokeError(t, user, "not supported for leveldb", "queryMarbles", `{"selector":{"docType":"student"}}`)
+	stub.CheckInvokeError(t, user, "not supported for leveldb", "queryStudentsBySchool", "28101", "500")
+}
+
+func TestEdu_RichQueriesOnCouchDB(t *testing.T) {
+	stub := newStub(t)
+	stub.SetRichQuery(true)
+	stub.CheckInvoke(t, user, "initStudent", "51114216", "男", "京籍", "首都师范大学附属密云中学", "28101", "480", "100", "90", "90", "200")
+	stub.CheckInvoke(t, user, "initStudent", "51114217", "女", "非京籍", "首都师范大学附属密云中学", "28101", "590", "120", "140", "100", "230")
+
+	// best score first, and without gender or census register unless the caller is an admin
+	records := queryRecords(t, stub.CheckInvoke(t, user, "queryStudentsBySchool", "28101"))
+	if recordKeys(records) != "51114217,51114214,51114216" {
+		t.Fatalf("school 28101 returned %s", recordKeys(records))
+	}
+	if records[0].Record.Gender != "" || records[0].Record.CensusRegister != "" || records[0].Record.CollegeEntranceExaminationScore != 590 {
+		t.Fatalf("user sees %+v", records[0].Record)
+	}
+	records = queryRecords(t, stub.CheckInvoke(t, admin, "queryStudentsBySchool", "28101", "500"))
+	if recordKeys(records) != "51114217,51114214" {
+		t.Fatalf("school 28101 from 500 returned %s", recordKeys(records))
+	}
+	if records[0].Record.Gender != "女" || records[0].Record.CensusRegister != "非京籍" {
+		t.Fatalf("admin sees %+v", records[0].Record)
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryStudentsBySchool", "28102", "700")); len(records) != 0 {
+		t.Fatalf("school 28102 from 700 returned %s", recordKeys(records))
+	}
+
+	tests := []struct {
+		query string
+		keys  string
+	}{
+		{`{"selector":{"docType":"student","collegeEntranceExaminationScore":{"$gt":550}},"sort":[{"docType":"desc"},{"collegeEntranceExaminationScore":"desc"}],"use_index":["_design/indexScoreDoc","indexScore"]}`, "51114215,51114217"},
+		{`{"selector":{"docType":"student","$or":[{"maths":{"$lt":95}},{"english":{"$gte":111}}]}}`, "51114215,51114216"},
+		{`{"selector":{"docType":"student","seniorHighSchool":{"$regex":"密云"}},"limit":2}`, "51114214,51114216"},
+		{`{"selector":{"docType":"student","schoolCode":{"$in":[28102]}}}`, "51114215"},
+	}
+	for _, test := range tests {
+		if keys := recordKeys(queryRecords(t, stub.CheckInvoke(t, user, "queryMarbles", test.query))); keys != test.keys {
+			t.Errorf("%s returned %s, expected %s", test.query, keys, test.keys)
+		}
+	}
+
+	// only an admin can select on gender or census register
+	stub.CheckInvokeError(t, user, "Querying field gender is not allowed", "queryMarbles", `{"selector":{"docType":"student","gender":"女"}}`)
+	if keys := recordKeys(queryRecords(t, stub.CheckInvoke(t, admin, "queryMarbles", `{"selector":{"docType":"student","gender":"女"}}`))); keys != "51114214,51114217" {
+		t.Fatalf("admin selecting gender returned %s", keys)
+	}
+}
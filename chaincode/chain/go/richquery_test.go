@@ -0,0 +1,237 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// checkQueryError expects guardQuery to refuse the query with reason
+func checkQueryError(t *testing.T, guard queryGuard, queryString string, reason string) {
+	_, err := guardQuery(guard, queryString)
+	queryErr, ok := err.(*queryError)
+	if !ok {
+		t.Fatalf("%s returned %v, expected a queryError", queryString, err)
+	}
+	if queryErr.Reason != reason {
+		t.Fatalf("%s was refused with %s (%s), expected %s", queryString, queryErr.Reason, queryErr.Message, reason)
+	}
+}
+
+// checkGuardedQuery expects guardQuery to accept the query and returns what it sends on
+func checkGuardedQuery(t *testing.T, guard queryGuard, queryString string) map[string]interface{} {
+	guarded, err := guardQuery(guard, queryString)
+	if err != nil {
+		t.Fatalf("%s was refused: %s", queryString, err)
+	}
+	query := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(guarded), &query); err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func guardOf(t *testing.T, stub *cidtest.Stub, id cidtest.Identity) queryGuard {
+	if err := stub.SetIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	stub.MockTransactionStart("guard")
+	defer stub.MockTransactionEnd("guard")
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guard
+}
+
+func TestRichQuery_CallerQueryGuard(t *testing.T) {
+	stub := newStub(t)
+
+	userGuard := guardOf(t, stub, user)
+	if !reflect.DeepEqual(userGuard.fields, publicStudentFields) || userGuard.maxLimit != maxQueryLimit {
+		t.Fatalf("user guard is %+v", userGuard)
+	}
+	// gender and census register are stripped for everyone but admins
+	query := checkGuardedQuery(t, userGuard, `{"selector":{"docType":"student"},"fields":["studentCode","gender","censusRegister"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"studentCode"}) {
+		t.Fatalf("user fields are %v", query["fields"])
+	}
+	query = checkGuardedQuery(t, userGuard, `{"selector":{"docType":"student"},"fields":["gender"]}`)
+	if len(query["fields"].([]interface{})) != len(publicStudentFields) {
+		t.Fatalf("user fields are %v", query["fields"])
+	}
+
+	adminGuard := guardOf(t, stub, admin)
+	if adminGuard.fields != nil {
+		t.Fatalf("admin guard is %+v", adminGuard)
+	}
+	query = checkGuardedQuery(t, adminGuard, `{"selector":{"docType":"student"},"fields":["gender"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"gender"}) {
+		t.Fatalf("admin fields are %v", query["fields"])
+	}
+
+	stub.SetCreator(nil)
+	if res := stub.MockInvoke("nocreator", [][]byte{[]byte("queryStudentsBySchool"), []byte("28101")}); res.Status == shim.OK {
+		t.Fatalf("queryStudentsBySchool without a creator should have failed")
+	}
+}
+
+func TestRichQuery_GuardQuery(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"student"}, maxLimit: maxQueryLimit}
+
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":"student"}}`); query["limit"] != float64(maxQueryLimit) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":{"$in":["student"]}},"limit":7}`); query["limit"] != float64(7) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"student"},"sort":[{"docType":"desc"},{"collegeEntranceExaminationScore":"desc"}],"use_index":["_design/indexScoreDoc","indexScore"]}`)
+	checkGuardedQuery(t, guard, `{"selector":{"docType":{"$eq":"student"}},"sort":["schoolCode"]}`)
+
+	checkQueryError(t, guard, `[]`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":"student"}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":{"$ne":"student"}}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":{"$in":["student",1]}}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"limit":-1}`, reasonInvalidLimit)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"sort":[1]}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"sort":["gender"]}`, reasonUnindexedSort)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"sort":["schoolCode"],"use_index":"indexScoreDoc"}`, reasonUnindexedSort)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"use_index":"indexOwnerDoc"}`, reasonUnknownIndex)
+}
+
+// TestRichQuery_SelectorFields checks that hidden fields can't be tested or sorted on
+func TestRichQuery_SelectorFields(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"student"}, fields: publicStudentFields, maxLimit: maxQueryLimit}
+
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"student","schoolCode":28101,"maths":{"$gt":90}}}`)
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"student","$or":[{"chinese":{"$gt":100}},{"$not":{"english":100}}]}}`)
+
+	for _, selector := range []string{
+		`{"docType":"student","gender":"女"}`,
+		`{"docType":"student","censusRegister.province":"京"}`,
+		`{"docType":"student","$and":[{"schoolCode":28101},{"gender":"女"}]}`,
+		`{"docType":"student","$or":[{"maths":100},{"censusRegister":{"$regex":"^京"}}]}`,
+		`{"docType":"student","$nor":[{"$and":[{"gender":"男"}]}]}`,
+		`{"docType":"student","$not":{"gender":"男"}}`,
+	} {
+		checkQueryError(t, guard, `{"selector":`+selector+`}`, reasonFieldForbidden)
+	}
+	checkQueryError(t, guard, `{"selector":{"docType":"student","$or":{"gender":"女"}}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"student","$not":[{"gender":"女"}]}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"student","$where":"gender"}}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"sort":["gender"]}`, reasonFieldForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"student"},"sort":[{"censusRegister":"asc"}]}`, reasonFieldForbidden)
+
+	// admins may test any field
+	guard.fields = nil
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"student","$or":[{"gender":"女"},{"$not":{"censusRegister":"京籍"}}]}}`)
+}
+
+// TestRichQuery_VisibleRecords checks that key and range reads hide what queries hide
+func TestRichQuery_VisibleRecords(t *testing.T) {
+	stub := newStub(t)
+
+	visible := map[string]interface{}{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "readStudent", "51114214"), &visible); err != nil {
+		t.Fatal(err)
+	}
+	if len(visible) != len(publicStudentFields) || visible["gender"] != nil || visible["censusRegister"] != nil || visible["maths"] != 100.0 {
+		t.Fatalf("user reads 51114214 as %v", visible)
+	}
+	if s := checkStudent(t, stub, "51114214"); s.Gender != "女" || s.CensusRegister != "京籍" {
+		t.Fatalf("admin reads 51114214 as %+v", s)
+	}
+
+	records := []struct {
+		Key    string
+		Record map[string]interface{}
+	}{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "getMarblesByRange", "51114214", "51114216"), &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("range returned %+v", records)
+	}
+	for _, record := range records {
+		if _, present := record.Record["gender"]; present || record.Record["studentCode"] != record.Key {
+			t.Fatalf("user range read %s as %v", record.Key, record.Record)
+		}
+	}
+	if err := json.Unmarshal(stub.CheckInvoke(t, admin, "getMarblesByRange", "51114214", "51114216"), &records); err != nil {
+		t.Fatal(err)
+	}
+	if records[1].Record["gender"] != "男" {
+		t.Fatalf("admin range read %s as %v", records[1].Key, records[1].Record)
+	}
+}
+
+func TestRichQuery_ListIndexes(t *testing.T) {
+	stub := newStub(t)
+
+	indexes := []couchIndex{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "listIndexes"), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, packagedIndexes) {
+		t.Fatalf("listIndexes returned %+v", indexes)
+	}
+}
+
+// TestRichQuery_PackagedIndexes checks packagedIndexes is in step with META-INF
+func TestRichQuery_PackagedIndexes(t *testing.T) {
+	const indexDir = "META-INF/statedb/couchdb/indexes"
+	files, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	definitions := map[string]couchIndex{}
+	for _, file := range files {
+		definitionAsBytes, err := ioutil.ReadFile(filepath.Join(indexDir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		definition := struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			DesignDoc string `json:"ddoc"`
+			Name      string `json:"name"`
+		}{}
+		if err := json.Unmarshal(definitionAsBytes, &definition); err != nil {
+			t.Fatalf("%s: %s", file.Name(), err)
+		}
+		definitions[definition.DesignDoc] = couchIndex{definition.DesignDoc, definition.Name, definition.Index.Fields}
+	}
+	if len(definitions) != len(packagedIndexes) {
+		t.Fatalf("%s has %d indexes, packagedIndexes %d", indexDir, len(definitions), len(packagedIndexes))
+	}
+	for _, index := range packagedIndexes {
+		if !reflect.DeepEqual(definitions[index.DesignDoc], index) {
+			t.Fatalf("packaged index %+v doesn't match %s %+v", index, indexDir, definitions[index.DesignDoc])
+		}
+	}
+}
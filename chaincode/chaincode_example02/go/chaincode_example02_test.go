@@ -0,0 +1,157 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"testing/quick"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInit("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+}
+
+func checkState(t *testing.T, stub *shim.MockStub, name string, value string) {
+	bytes := stub.State[name]
+	if bytes == nil {
+		t.Fatalf("State %s failed to get value", name)
+	}
+	if string(bytes) != value {
+		t.Fatalf("State value %s was %s, expected %s", name, bytes, value)
+	}
+}
+
+func checkQuery(t *testing.T, stub *shim.MockStub, name string, value string) {
+	res := stub.MockInvoke("1", [][]byte{[]byte("query"), []byte(name)})
+	if res.Status != shim.OK {
+		t.Fatalf("Query %s failed: %s", name, res.Message)
+	}
+	if string(res.Payload) != value {
+		t.Fatalf("Query value %s was %s, expected %s", name, res.Payload, value)
+	}
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Invoke %s failed: %s", args, res.Message)
+	}
+}
+
+func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte, message string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status == shim.OK {
+		t.Fatalf("Invoke %s should have failed", args)
+	}
+	if res.Message != message {
+		t.Fatalf("Invoke %s failed with %q, expected %q", args, res.Message, message)
+	}
+}
+
+func TestExample02_Init(t *testing.T) {
+	stub := shim.NewMockStub("ex02", new(SimpleChaincode))
+
+	for _, args := range [][][]byte{
+		{[]byte("init"), []byte("A"), []byte("123"), []byte("B")},
+		{[]byte("init"), []byte("A"), []byte("x"), []byte("B"), []byte("234")},
+		{[]byte("init"), []byte("A"), []byte("123"), []byte("B"), []byte("y")},
+	} {
+		if res := stub.MockInit("1", args); res.Status == shim.OK {
+			t.Fatalf("Init %s should have failed", args)
+		}
+	}
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("123"), []byte("B"), []byte("234")})
+	checkState(t, stub, "A", "123")
+	checkState(t, stub, "B", "234")
+}
+
+func TestExample02_Query(t *testing.T) {
+	stub := shim.NewMockStub("ex02", new(SimpleChaincode))
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("345"), []byte("B"), []byte("456")})
+
+	checkQuery(t, stub, "A", "345")
+	checkQuery(t, stub, "B", "456")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("query"), []byte("C")}, "{\"Error\":\"Nil amount for C\"}")
+	checkInvokeError(t, stub, [][]byte{[]byte("query")}, "Incorrect number of arguments. Expecting name of the person to query")
+}
+
+func TestExample02_Invoke(t *testing.T) {
+	stub := shim.NewMockStub("ex02", new(SimpleChaincode))
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("567"), []byte("B"), []byte("678")})
+
+	// Invoke A->B for 123
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("123")})
+	checkQuery(t, stub, "A", "444")
+	checkQuery(t, stub, "B", "801")
+
+	// Invoke B->A for 234
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("A"), []byte("234")})
+	checkQuery(t, stub, "A", "678")
+	checkQuery(t, stub, "B", "567")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B")}, "Incorrect number of arguments. Expecting 3")
+	checkInvokeError(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("C"), []byte("1")}, "Entity not found")
+	checkInvokeError(t, stub, [][]byte{[]byte("invoke"), []byte("C"), []byte("A"), []byte("1")}, "Entity not found")
+	checkInvokeError(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("x")}, "Invalid transaction amount, expecting a integer value")
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer")}, "Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
+}
+
+func TestExample02_Delete(t *testing.T) {
+	stub := shim.NewMockStub("ex02", new(SimpleChaincode))
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("1"), []byte("B"), []byte("2")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("delete"), []byte("A")})
+	if stub.State["A"] != nil {
+		t.Fatalf("A was not deleted")
+	}
+	checkInvokeError(t, stub, [][]byte{[]byte("query"), []byte("A")}, "{\"Error\":\"Nil amount for A\"}")
+	checkInvokeError(t, stub, [][]byte{[]byte("delete")}, "Incorrect number of arguments. Expecting 1")
+}
+
+// Property: transfers between the two entities conserve their total holdings
+func TestExample02_TransfersConserveTotal(t *testing.T) {
+	property := func(aval, bval int32, amounts []int16, directions []bool) bool {
+		stub := shim.NewMockStub("ex02", new(SimpleChaincode))
+		stub.MockInit("1", [][]byte{[]byte("init"), []byte("A"), []byte(strconv.Itoa(int(aval))), []byte("B"), []byte(strconv.Itoa(int(bval)))})
+
+		for i, amount := range amounts {
+			from, to := "A", "B"
+			if i < len(directions) && directions[i] {
+				from, to = to, from
+			}
+			res := stub.MockInvoke("1", [][]byte{[]byte("invoke"), []byte(from), []byte(to), []byte(strconv.Itoa(int(amount)))})
+			if res.Status != shim.OK {
+				return false
+			}
+		}
+
+		a, _ := strconv.Atoi(string(stub.State["A"]))
+		b, _ := strconv.Atoi(string(stub.State["B"]))
+		return a+b == int(aval)+int(bval)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cidtest builds client identities for chaincode unit tests. It
+// generates certificates at runtime with any MSP ID, organizational units and
+// attributes, wraps them in an msp.SerializedIdentity, and provides a MockStub
+// whose GetCreator returns them, so code using the client identity library
+// (cid) can be tested offline:
+//
+//	stub := cidtest.NewStub("marbles", new(SimpleChaincode))
+//	admin := cidtest.Identity{
+//		MSPID:      "Org1MSP",
+//		CommonName: "admin",
+//		Attributes: map[string]interface{}{"marbles.admin": "true"},
+//	}
+//	stub.CheckInvoke(t, admin, "admin_write", "abc", "test")
+//	stub.CheckInvokeError(t, user, "Caller is not a marbles admin", "admin_write", "abc", "test")
+//
+// Like a peer using LevelDB, the Stub has no rich queries until SetRichQuery
+// turns on the couchtest query evaluator.
+package cidtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-samples/chaincode/couchtest"
+	"github.com/hyperledger/fabric/common/attrmgr"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+)
+
+// Identity describes the client to build a certificate for. Zero values get
+// defaults: the certificate is valid from an hour ago for a year, has a random
+// serial number and is self-signed, so its issuer DN is its subject DN.
+type Identity struct {
+	MSPID      string
+	CommonName string
+	OUs        []string
+
+	// Attributes are added in the attrmgr certificate extension. Values are
+	// usually strings, integers, booleans and lists are stored with their JSON
+	// type.
+	Attributes map[string]interface{}
+
+	NotBefore    time.Time
+	NotAfter     time.Time
+	SerialNumber *big.Int
+
+	// Issuer is the common name of the issuer, when it shouldn't be the
+	// identity itself. The certificate is still signed with its own key.
+	Issuer string
+}
+
+// Certificate returns the PEM encoded certificate of the identity
+func (id Identity) Certificate() ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate a key")
+	}
+
+	serialNumber := id.SerialNumber
+	if serialNumber == nil {
+		serialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to generate a serial number")
+		}
+	}
+	notBefore := id.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now().Add(-time.Hour)
+	}
+	notAfter := id.NotAfter
+	if notAfter.IsZero() {
+		notAfter = notBefore.AddDate(1, 0, 0)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:         id.CommonName,
+			OrganizationalUnit: id.OUs,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if len(id.Attributes) > 0 {
+		buf, err := json.Marshal(map[string]interface{}{"attrs": id.Attributes})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal attributes")
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: attrmgr.AttrOID, Value: buf})
+	}
+
+	parent := template
+	if id.Issuer != "" {
+		issuer := *template
+		issuer.Subject = pkix.Name{CommonName: id.Issuer}
+		parent = &issuer
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create the certificate")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Creator returns the identity as GetCreator returns it, a serialized
+// msp.SerializedIdentity holding the PEM certificate
+func (id Identity) Creator() ([]byte, error) {
+	cert, err := id.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: id.MSPID, IdBytes: cert})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal the serialized identity")
+	}
+	return creator, nil
+}
+
+// Stub is a MockStub whose GetCreator returns the creator set with SetCreator
+// or SetIdentity. Init and Invoke of the chaincode it was made for receive the
+// Stub, not the MockStub inside it.
+type Stub struct {
+	*shim.MockStub
+	creator   []byte
+	txCount   int
+	richQuery bool
+	bookmark  string
+}
+
+// NewStub returns a Stub for cc, with no creator set
+func NewStub(name string, cc shim.Chaincode) *Stub {
+	stub := &Stub{}
+	stub.MockStub = shim.NewMockStub(name, &creatorChaincode{cc: cc, stub: stub})
+	return stub
+}
+
+// GetCreator returns the creator set with SetCreator or SetIdentity
+func (stub *Stub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+// SetCreator sets what GetCreator returns, nil for no creator
+func (stub *Stub) SetCreator(creator []byte) {
+	stub.creator = creator
+}
+
+// SetIdentity makes id the creator of the following transactions
+func (stub *Stub) SetIdentity(id Identity) error {
+	creator, err := id.Creator()
+	if err != nil {
+		return err
+	}
+	stub.creator = creator
+	return nil
+}
+
+// SetRichQuery makes GetQueryResult evaluate queries over the state, as a peer
+// using CouchDB does, or fail, as a peer using LevelDB does
+func (stub *Stub) SetRichQuery(enabled bool) {
+	stub.richQuery = enabled
+}
+
+// GetQueryResult runs the query over every key and JSON value in state when
+// rich queries are on, and remembers the bookmark of the page it returns.
+// When they are off it fails with the error a LevelDB peer returns.
+func (stub *Stub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	if !stub.richQuery {
+		return nil, errors.New("ExecuteQuery not supported for leveldb")
+	}
+	q, err := couchtest.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]couchtest.Record, 0, len(stub.State))
+	for key, value := range stub.State {
+		records = append(records, couchtest.Record{Key: key, Value: value})
+	}
+	results, bookmark, err := q.Execute(records)
+	if err != nil {
+		return nil, err
+	}
+	stub.bookmark = bookmark
+	return couchtest.NewResultsIterator(results), nil
+}
+
+// Bookmark returns the bookmark of the last rich query, to put in the query
+// for the next page
+func (stub *Stub) Bookmark() string {
+	return stub.bookmark
+}
+
+// InitAs calls Init with args as id, in a transaction of its own
+func (stub *Stub) InitAs(id Identity, args ...string) pb.Response {
+	if err := stub.SetIdentity(id); err != nil {
+		return shim.Error(err.Error())
+	}
+	return stub.MockInit(stub.nextTxID(), byteArgs(args))
+}
+
+// InvokeAs calls Invoke with args as id, in a transaction of its own
+func (stub *Stub) InvokeAs(id Identity, args ...string) pb.Response {
+	if err := stub.SetIdentity(id); err != nil {
+		return shim.Error(err.Error())
+	}
+	return stub.MockInvoke(stub.nextTxID(), byteArgs(args))
+}
+
+// CheckInvoke calls Invoke with args as id, fails the test unless it
+// succeeds, and returns the payload
+func (stub *Stub) CheckInvoke(t testing.TB, id Identity, args ...string) []byte {
+	t.Helper()
+	res := stub.InvokeAs(id, args...)
+	if res.Status != shim.OK {
+		t.Fatalf("%s %v failed: %s", id.CommonName, args, res.Message)
+	}
+	return res.Payload
+}
+
+// CheckInvokeError calls Invoke with args as id, and fails the test unless
+// it fails with a message containing message
+func (stub *Stub) CheckInvokeError(t testing.TB, id Identity, message string, args ...string) {
+	t.Helper()
+	res := stub.InvokeAs(id, args...)
+	if res.Status == shim.OK {
+		t.Fatalf("%s %v should have failed", id.CommonName, args)
+	}
+	if !strings.Contains(res.Message, message) {
+		t.Fatalf("%s %v failed with %q, expected %q", id.CommonName, args, res.Message, message)
+	}
+}
+
+// nextTxID returns a transaction ID not used before by the Stub, grants,
+// audit entries and the like are often keyed by transaction ID
+func (stub *Stub) nextTxID() string {
+	stub.txCount++
+	return fmt.Sprintf("tx%d", stub.txCount)
+}
+
+func byteArgs(args []string) [][]byte {
+	byteArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		byteArgs[i] = []byte(arg)
+	}
+	return byteArgs
+}
+
+// creatorChaincode hands the Stub to the chaincode instead of the MockStub
+// MockInit and MockInvoke call it with
+type creatorChaincode struct {
+	cc   shim.Chaincode
+	stub *Stub
+}
+
+func (c *creatorChaincode) Init(shim.ChaincodeStubInterface) pb.Response {
+	return c.cc.Init(c.stub)
+}
+
+func (c *creatorChaincode) Invoke(shim.ChaincodeStubInterface) pb.Response {
+	return c.cc.Invoke(c.stub)
+}
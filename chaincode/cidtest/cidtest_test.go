@@ -0,0 +1,139 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cidtest
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mspChaincode returns the MSP ID of the caller, or an error when cid can't read it
+type mspChaincode struct{}
+
+func (mspChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (mspChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(mspID + " " + stub.GetTxID()))
+}
+
+func TestIdentity_Certificate(t *testing.T) {
+	stub := NewStub("cidtest", mspChaincode{})
+	notBefore := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := Identity{
+		MSPID:        "Org1MSP",
+		CommonName:   "alice",
+		OUs:          []string{"client", "audit"},
+		Attributes:   map[string]interface{}{"role": "auditor"},
+		NotBefore:    notBefore,
+		SerialNumber: big.NewInt(42),
+		Issuer:       "ca.org1",
+	}
+	if err := stub.SetIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := cid.New(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mspID, _ := client.GetMSPID(); mspID != "Org1MSP" {
+		t.Fatalf("MSP ID is %q", mspID)
+	}
+	if role, found, _ := client.GetAttributeValue("role"); !found || role != "auditor" {
+		t.Fatalf("role is %q, found %v", role, found)
+	}
+	if _, found, _ := client.GetAttributeValue("missing"); found {
+		t.Fatalf("missing attribute was found")
+	}
+	cert, err := client.GetX509Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "alice" || len(cert.Subject.OrganizationalUnit) != 2 {
+		t.Fatalf("Subject is %+v", cert.Subject)
+	}
+	if cert.Issuer.CommonName != "ca.org1" || cert.SerialNumber.Int64() != 42 {
+		t.Fatalf("Issuer is %+v, serial number %s", cert.Issuer, cert.SerialNumber)
+	}
+	if !cert.NotBefore.Equal(notBefore) || !cert.NotAfter.Equal(notBefore.AddDate(1, 0, 0)) {
+		t.Fatalf("Certificate is valid from %s to %s", cert.NotBefore, cert.NotAfter)
+	}
+}
+
+func TestIdentity_Defaults(t *testing.T) {
+	stub := NewStub("cidtest", mspChaincode{})
+	if err := stub.SetIdentity(Identity{MSPID: "Org1MSP", CommonName: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Issuer.CommonName != "alice" {
+		t.Fatalf("Certificate is not self-signed, issuer is %+v", cert.Issuer)
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		t.Fatalf("Certificate is valid from %s to %s", cert.NotBefore, cert.NotAfter)
+	}
+
+	// a second certificate of the same identity has another serial number
+	other := NewStub("cidtest", mspChaincode{})
+	other.SetIdentity(Identity{MSPID: "Org1MSP", CommonName: "alice"})
+	otherCert, err := cid.GetX509Certificate(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherCert.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Fatalf("Both certificates have serial number %s", cert.SerialNumber)
+	}
+}
+
+func TestStub_Invoke(t *testing.T) {
+	stub := NewStub("cidtest", mspChaincode{})
+	org1 := Identity{MSPID: "Org1MSP", CommonName: "alice"}
+	org2 := Identity{MSPID: "Org2MSP", CommonName: "bob"}
+
+	if payload := string(stub.CheckInvoke(t, org1)); payload != "Org1MSP tx1" {
+		t.Fatalf("Invoke as alice returned %q", payload)
+	}
+	if payload := string(stub.CheckInvoke(t, org2)); payload != "Org2MSP tx2" {
+		t.Fatalf("Invoke as bob returned %q", payload)
+	}
+	if res := stub.InitAs(org1); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+
+	stub.SetCreator(nil)
+	if res := stub.MockInvoke("nocreator", nil); res.Status == shim.OK {
+		t.Fatalf("Invoke without a creator returned %q", res.Payload)
+	}
+	stub.SetCreator([]byte("not a serialized identity"))
+	if res := stub.MockInvoke("garbage", nil); res.Status == shim.OK {
+		t.Fatalf("Invoke with a malformed creator returned %q", res.Payload)
+	}
+}
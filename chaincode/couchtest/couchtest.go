@@ -0,0 +1,633 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package couchtest evaluates CouchDB Mango queries in process, so chaincode
+// rich queries can be tested without CouchDB. A Query runs over key and JSON
+// value records, such as the State of a MockStub, and returns the records a
+// peer using CouchDB would return to GetQueryResult:
+//
+//	query, err := couchtest.ParseQuery(`{"selector":{"docType":"marble","size":{"$gt":10}},"sort":["size"],"limit":5}`)
+//	...
+//	results, bookmark, err := query.Execute(records)
+//
+// Supported are the $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $regex and
+// $exists conditions, the $and, $or, $nor and $not combinations, implicit
+// equality and nested fields, and the fields, sort, limit, skip and bookmark
+// parameters. use_index is accepted and ignored. Values are ordered with
+// CouchDB's collation (null, false, true, numbers, strings, arrays, objects),
+// except that strings compare by their UTF-8 bytes rather than by ICU rules.
+package couchtest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/pkg/errors"
+)
+
+// DefaultLimit is the number of records a query without a limit returns, the
+// default queryLimit of a Fabric 1.1 peer
+const DefaultLimit = 10000
+
+// Record is a key and its value, as stored in state
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// Query is a parsed Mango query
+type Query struct {
+	match    matcher
+	fields   [][]string
+	sort     []sortField
+	limit    int
+	skip     int
+	bookmark string
+}
+
+// sortField is one field of a sort, all of which sort in the same direction
+type sortField struct {
+	path []string
+	desc bool
+}
+
+// matcher reports whether a document matches a selector or a condition
+type matcher func(doc interface{}) bool
+
+// queryKeys are the query parameters ParseQuery accepts
+var queryKeys = []string{"selector", "fields", "sort", "limit", "skip", "bookmark", "use_index", "r", "conflicts", "update", "stable", "execution_stats"}
+
+// ParseQuery parses a query string as passed to GetQueryResult
+func ParseQuery(queryString string) (*Query, error) {
+	var query map[string]interface{}
+	if err := json.Unmarshal([]byte(queryString), &query); err != nil {
+		return nil, errors.Wrap(err, "Query is not a JSON object")
+	}
+	for key := range query {
+		if !containsString(queryKeys, key) {
+			return nil, errors.Errorf("Invalid query parameter %s", key)
+		}
+	}
+
+	q := &Query{limit: DefaultLimit}
+	selector, ok := query["selector"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Query must have a selector object")
+	}
+	var err error
+	if q.match, err = compileSelector(selector, nil); err != nil {
+		return nil, err
+	}
+
+	if fieldsSpec, present := query["fields"]; present {
+		fields, ok := fieldsSpec.([]interface{})
+		if !ok {
+			return nil, errors.New("fields must be an array of field names")
+		}
+		for _, field := range fields {
+			name, ok := field.(string)
+			if !ok || name == "" {
+				return nil, errors.New("fields must be an array of field names")
+			}
+			q.fields = append(q.fields, fieldPath(name))
+		}
+	}
+
+	if sortSpec, present := query["sort"]; present {
+		if q.sort, err = parseSort(sortSpec); err != nil {
+			return nil, err
+		}
+	}
+
+	if q.limit, err = parseCount(query, "limit", DefaultLimit); err != nil {
+		return nil, err
+	}
+	if q.skip, err = parseCount(query, "skip", 0); err != nil {
+		return nil, err
+	}
+
+	if bookmarkSpec, present := query["bookmark"]; present {
+		if q.bookmark, ok = bookmarkSpec.(string); !ok {
+			return nil, errors.New("bookmark must be a string")
+		}
+	}
+	return q, nil
+}
+
+// parseSort parses an array of field names or of single entry {"field": "asc|desc"} objects
+func parseSort(sortSpec interface{}) ([]sortField, error) {
+	invalid := errors.New("sort must be an array of field names or {\"field\":\"asc|desc\"} objects")
+
+	entries, ok := sortSpec.([]interface{})
+	if !ok {
+		return nil, invalid
+	}
+	var fields []sortField
+	for _, entry := range entries {
+		switch value := entry.(type) {
+		case string:
+			fields = append(fields, sortField{path: fieldPath(value)})
+		case map[string]interface{}:
+			if len(value) != 1 {
+				return nil, invalid
+			}
+			for name, direction := range value {
+				if direction != "asc" && direction != "desc" {
+					return nil, invalid
+				}
+				fields = append(fields, sortField{path: fieldPath(name), desc: direction == "desc"})
+			}
+		default:
+			return nil, invalid
+		}
+	}
+	for _, field := range fields {
+		if field.desc != fields[0].desc {
+			return nil, errors.New("Sorts currently only support a single direction for all fields")
+		}
+	}
+	return fields, nil
+}
+
+// parseCount returns the non-negative integer query parameter name, or value when it is missing
+func parseCount(query map[string]interface{}, name string, value int) (int, error) {
+	countSpec, present := query[name]
+	if !present {
+		return value, nil
+	}
+	count, ok := countSpec.(float64)
+	if !ok || count < 0 || count != float64(int(count)) {
+		return 0, errors.Errorf("%s must be a non-negative integer", name)
+	}
+	return int(count), nil
+}
+
+// ===========================================================================================
+// Selectors
+// ===========================================================================================
+
+// compileSelector compiles the selector object found at path in the document.
+// Every entry must match: operators apply to the value at path, and field
+// names select a nested value to match against an implicit $eq or an object.
+func compileSelector(selector map[string]interface{}, path []string) (matcher, error) {
+	var matchers []matcher
+	for key, value := range selector {
+		var m matcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileOperator(key, value, path)
+		} else if object, ok := value.(map[string]interface{}); ok && len(object) > 0 {
+			m, err = compileSelector(object, appendPath(path, fieldPath(key)))
+		} else {
+			m, err = compileOperator("$eq", value, appendPath(path, fieldPath(key)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return func(doc interface{}) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileOperator compiles one operator and its argument, applied to the value at path
+func compileOperator(operator string, argument interface{}, path []string) (matcher, error) {
+	switch operator {
+	case "$and", "$or", "$nor":
+		selectors, ok := argument.([]interface{})
+		if !ok || len(selectors) == 0 {
+			return nil, errors.Errorf("%s must be a non-empty array of selectors", operator)
+		}
+		var matchers []matcher
+		for _, selector := range selectors {
+			object, ok := selector.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s must be a non-empty array of selectors", operator)
+			}
+			m, err := compileSelector(object, path)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, m)
+		}
+		return func(doc interface{}) bool {
+			matched := 0
+			for _, m := range matchers {
+				if m(doc) {
+					matched++
+				}
+			}
+			switch operator {
+			case "$and":
+				return matched == len(matchers)
+			case "$or":
+				return matched > 0
+			}
+			return matched == 0
+		}, nil
+
+	case "$not":
+		object, ok := argument.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("$not must be a selector")
+		}
+		m, err := compileSelector(object, path)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc interface{}) bool { return !m(doc) }, nil
+	}
+
+	if len(path) == 0 {
+		return nil, errors.Errorf("%s must be applied to a field", operator)
+	}
+	var condition func(value interface{}) bool
+	switch operator {
+	case "$eq":
+		condition = func(value interface{}) bool { return collate(value, argument) == 0 }
+	case "$ne":
+		condition = func(value interface{}) bool { return collate(value, argument) != 0 }
+	case "$gt":
+		condition = func(value interface{}) bool { return collate(value, argument) > 0 }
+	case "$gte":
+		condition = func(value interface{}) bool { return collate(value, argument) >= 0 }
+	case "$lt":
+		condition = func(value interface{}) bool { return collate(value, argument) < 0 }
+	case "$lte":
+		condition = func(value interface{}) bool { return collate(value, argument) <= 0 }
+	case "$in", "$nin":
+		list, ok := argument.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s must be an array", operator)
+		}
+		condition = func(value interface{}) bool { return inList(value, list) == (operator == "$in") }
+	case "$regex":
+		pattern, ok := argument.(string)
+		if !ok {
+			return nil, errors.New("$regex must be a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid $regex")
+		}
+		condition = func(value interface{}) bool {
+			s, ok := value.(string)
+			return ok && re.MatchString(s)
+		}
+	case "$exists":
+		exists, ok := argument.(bool)
+		if !ok {
+			return nil, errors.New("$exists must be true or false")
+		}
+		return func(doc interface{}) bool {
+			_, present := lookup(doc, path)
+			return present == exists
+		}, nil
+	default:
+		return nil, errors.Errorf("Unsupported operator %s", operator)
+	}
+
+	// a condition never matches a field the document doesn't have
+	return func(doc interface{}) bool {
+		value, present := lookup(doc, path)
+		return present && condition(value)
+	}, nil
+}
+
+// inList reports whether value, or for an array any of its elements, equals an element of list
+func inList(value interface{}, list []interface{}) bool {
+	candidates := []interface{}{value}
+	if array, ok := value.([]interface{}); ok {
+		candidates = array
+	}
+	for _, candidate := range candidates {
+		for _, element := range list {
+			if collate(candidate, element) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fieldPath splits a dotted field name into its path
+func fieldPath(name string) []string {
+	return strings.Split(name, ".")
+}
+
+// appendPath returns a new path of path followed by more
+func appendPath(path []string, more []string) []string {
+	return append(append([]string(nil), path...), more...)
+}
+
+// lookup returns the value at path in the document
+func lookup(doc interface{}, path []string) (interface{}, bool) {
+	value := doc
+	for _, name := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// ===========================================================================================
+// Collation
+// ===========================================================================================
+
+// typeRank orders JSON types the way CouchDB collates them
+func typeRank(value interface{}) int {
+	switch value := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if value {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+// collate compares two JSON values, returning -1, 0 or 1
+func collate(a, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := collate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(a), len(b))
+	case map[string]interface{}:
+		// Go doesn't keep the order of object members, so compare them by key
+		b := b.(map[string]interface{})
+		keysA, keysB := sortedKeys(a), sortedKeys(b)
+		for i := 0; i < len(keysA) && i < len(keysB); i++ {
+			if c := strings.Compare(keysA[i], keysB[i]); c != 0 {
+				return c
+			}
+			if c := collate(a[keysA[i]], b[keysB[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(keysA), len(keysB))
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ===========================================================================================
+// Execution
+// ===========================================================================================
+
+// result is a matching document and its position in the result order
+type result struct {
+	key      string
+	doc      map[string]interface{}
+	position []interface{} // the sort field values
+}
+
+// Execute runs the query over records, given in any order, and returns the
+// page of matching records and the bookmark to put in the query for the next
+// page. Values that aren't JSON objects, such as composite key index entries,
+// never match. A document's key can be selected and sorted on as _id, but
+// like a peer Execute leaves _id out of the values it returns.
+func (q *Query) Execute(records []Record) ([]Record, string, error) {
+	var results []result
+	for _, record := range records {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(record.Value, &doc); err != nil || doc == nil {
+			continue
+		}
+		doc["_id"] = record.Key
+		if !q.match(doc) {
+			continue
+		}
+		r := result{key: record.Key, doc: doc}
+		// like an index, a sort only returns documents that have every sort field
+		sortable := true
+		for _, field := range q.sort {
+			value, present := lookup(doc, field.path)
+			if !present {
+				sortable = false
+				break
+			}
+			r.position = append(r.position, value)
+		}
+		if sortable {
+			results = append(results, r)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return q.compare(results[i], results[j]) < 0 })
+
+	if q.bookmark != "" {
+		after, err := q.decodeBookmark()
+		if err != nil {
+			return nil, "", err
+		}
+		start := sort.Search(len(results), func(i int) bool { return q.compare(results[i], after) > 0 })
+		results = results[start:]
+	}
+	if q.skip < len(results) {
+		results = results[q.skip:]
+	} else {
+		results = nil
+	}
+	if q.limit < len(results) {
+		results = results[:q.limit]
+	}
+
+	bookmark := q.bookmark
+	page := make([]Record, 0, len(results))
+	for _, r := range results {
+		value, err := json.Marshal(q.project(r.doc))
+		if err != nil {
+			return nil, "", err
+		}
+		page = append(page, Record{Key: r.key, Value: value})
+	}
+	if len(results) > 0 {
+		bookmark = encodeBookmark(results[len(results)-1])
+	}
+	return page, bookmark, nil
+}
+
+// compare orders results by their sort field values and then by key
+func (q *Query) compare(a, b result) int {
+	c := 0
+	for i := range q.sort {
+		if c = collate(a.position[i], b.position[i]); c != 0 {
+			break
+		}
+	}
+	if c == 0 {
+		c = strings.Compare(a.key, b.key)
+	}
+	if len(q.sort) > 0 && q.sort[0].desc {
+		return -c
+	}
+	return c
+}
+
+// project returns the fields of the document the query asks for
+func (q *Query) project(doc map[string]interface{}) map[string]interface{} {
+	delete(doc, "_id")
+	if q.fields == nil {
+		return doc
+	}
+	projected := map[string]interface{}{}
+	for _, path := range q.fields {
+		value, present := lookup(doc, path)
+		if !present {
+			continue
+		}
+		object := projected
+		for _, name := range path[:len(path)-1] {
+			next, ok := object[name].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				object[name] = next
+			}
+			object = next
+		}
+		object[path[len(path)-1]] = value
+	}
+	return projected
+}
+
+// encodeBookmark returns the bookmark of the results following r: its sort
+// field values and its key
+func encodeBookmark(r result) string {
+	position, _ := json.Marshal(append(append([]interface{}(nil), r.position...), r.key))
+	return base64.RawURLEncoding.EncodeToString(position)
+}
+
+// decodeBookmark returns the position the query's bookmark points after
+func (q *Query) decodeBookmark() (result, error) {
+	invalid := errors.Errorf("Invalid bookmark %q", q.bookmark)
+
+	positionAsBytes, err := base64.RawURLEncoding.DecodeString(q.bookmark)
+	if err != nil {
+		return result{}, invalid
+	}
+	var position []interface{}
+	if err = json.Unmarshal(positionAsBytes, &position); err != nil || len(position) != len(q.sort)+1 {
+		return result{}, invalid
+	}
+	key, ok := position[len(q.sort)].(string)
+	if !ok {
+		return result{}, invalid
+	}
+	return result{key: key, position: position[:len(q.sort)]}, nil
+}
+
+// ===========================================================================================
+// ResultsIterator
+// ===========================================================================================
+
+// ResultsIterator returns records as the shim.StateQueryIteratorInterface
+// GetQueryResult returns
+type ResultsIterator struct {
+	records []Record
+	next    int
+}
+
+// NewResultsIterator returns an iterator over records
+func NewResultsIterator(records []Record) *ResultsIterator {
+	return &ResultsIterator{records: records}
+}
+
+// HasNext returns true if there are records left
+func (iter *ResultsIterator) HasNext() bool {
+	return iter.next < len(iter.records)
+}
+
+// Next returns the next record
+func (iter *ResultsIterator) Next() (*queryresult.KV, error) {
+	if !iter.HasNext() {
+		return nil, errors.New("No more results")
+	}
+	record := iter.records[iter.next]
+	iter.next++
+	return &queryresult.KV{Key: record.Key, Value: record.Value}, nil
+}
+
+// Close closes the iterator
+func (iter *ResultsIterator) Close() error {
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package couchtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// marbles are the records the tests query; m0 is a composite key index entry
+var marbles = []Record{
+	{"marble1", []byte(`{"docType":"marble","name":"marble1","color":"blue","size":35,"owner":"tom","tags":["shiny","old"]}`)},
+	{"marble2", []byte(`{"docType":"marble","name":"marble2","color":"red","size":50,"owner":"tom"}`)},
+	{"marble3", []byte(`{"docType":"marble","name":"marble3","color":"blue","size":70,"owner":"jerry","tags":["new"]}`)},
+	{"marble4", []byte(`{"docType":"marble","name":"marble4","color":"Green","size":10,"owner":"jerry","maker":{"name":"acme","country":"nl"}}`)},
+	{"marble5", []byte(`{"docType":"marble","name":"marble5","color":"blue","size":null,"owner":"ann"}`)},
+	{"owner1", []byte(`{"docType":"owner","name":"tom","size":"large"}`)},
+	{"\x00color~name\x00blue\x00marble1\x00", []byte{0x00}},
+	{"text", []byte("not json")},
+}
+
+// keys runs the query over marbles and returns the keys of the results
+func keys(t *testing.T, queryString string) string {
+	results, _ := execute(t, queryString)
+	k := make([]string, len(results))
+	for i, result := range results {
+		k[i] = result.Key
+	}
+	return strings.Join(k, ",")
+}
+
+func execute(t *testing.T, queryString string) ([]Record, string) {
+	query, err := ParseQuery(queryString)
+	if err != nil {
+		t.Fatalf("%s: %s", queryString, err)
+	}
+	results, bookmark, err := query.Execute(marbles)
+	if err != nil {
+		t.Fatalf("%s: %s", queryString, err)
+	}
+	return results, bookmark
+}
+
+func TestCouchtest_Selectors(t *testing.T) {
+	tests := []struct {
+		selector string
+		keys     string
+	}{
+		{`{}`, "marble1,marble2,marble3,marble4,marble5,owner1"},
+		{`{"docType":"marble","owner":"tom"}`, "marble1,marble2"},
+		{`{"docType":{"$eq":"owner"}}`, "owner1"},
+		{`{"color":{"$ne":"blue"}}`, "marble2,marble4"},
+		{`{"size":{"$gt":35}}`, "marble2,marble3,owner1"},
+		{`{"size":{"$gte":35,"$lt":70}}`, "marble1,marble2"},
+		{`{"size":{"$lte":10}}`, "marble4,marble5"},
+		{`{"size":{"$gt":null}}`, "marble1,marble2,marble3,marble4,owner1"},
+		{`{"owner":{"$in":["ann","jerry"]}}`, "marble3,marble4,marble5"},
+		{`{"docType":"marble","owner":{"$nin":["ann","jerry"]}}`, "marble1,marble2"},
+		{`{"tags":{"$in":["new","old"]}}`, "marble1,marble3"},
+		{`{"color":{"$regex":"^(?i)g"}}`, "marble4"},
+		{`{"size":{"$regex":"^l"}}`, "owner1"},
+		{`{"tags":{"$exists":true}}`, "marble1,marble3"},
+		{`{"docType":"marble","tags":{"$exists":false}}`, "marble2,marble4,marble5"},
+		{`{"$and":[{"color":"blue"},{"size":{"$gt":40}}]}`, "marble3"},
+		{`{"$or":[{"owner":"ann"},{"size":{"$lt":20}}]}`, "marble4,marble5"},
+		{`{"docType":"marble","$nor":[{"owner":"tom"},{"owner":"jerry"}]}`, "marble5"},
+		{`{"docType":"marble","$not":{"color":"blue"}}`, "marble2,marble4"},
+		// null collates below every number
+		{`{"size":{"$or":[{"$lt":20},{"$gt":60}]}}`, "marble3,marble4,marble5,owner1"},
+		{`{"maker":{"country":"nl"}}`, "marble4"},
+		{`{"maker.name":"acme"}`, "marble4"},
+		{`{"maker":{"name":{"$regex":"^a"},"country":"nl"}}`, "marble4"},
+		{`{"_id":{"$gt":"marble4"}}`, "marble5,owner1"},
+		{`{"tags":["new"]}`, "marble3"},
+		{`{"owner":"nobody"}`, ""},
+	}
+	for _, test := range tests {
+		if k := keys(t, `{"selector":`+test.selector+`}`); k != test.keys {
+			t.Errorf("%s selected %s, expected %s", test.selector, k, test.keys)
+		}
+	}
+}
+
+func TestCouchtest_ParseErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{`not json`, "Query is not a JSON object"},
+		{`{"selector":[]}`, "Query must have a selector object"},
+		{`{"fields":["name"]}`, "Query must have a selector object"},
+		{`{"selector":{},"sort_by":["name"]}`, "Invalid query parameter sort_by"},
+		{`{"selector":{"size":{"$near":1}}}`, "Unsupported operator $near"},
+		{`{"selector":{"$eq":1}}`, "$eq must be applied to a field"},
+		{`{"selector":{"$or":[]}}`, "$or must be a non-empty array of selectors"},
+		{`{"selector":{"$and":[1]}}`, "$and must be a non-empty array of selectors"},
+		{`{"selector":{"$not":[]}}`, "$not must be a selector"},
+		{`{"selector":{"owner":{"$in":"tom"}}}`, "$in must be an array"},
+		{`{"selector":{"owner":{"$regex":"("}}}`, "Invalid $regex"},
+		{`{"selector":{"owner":{"$regex":1}}}`, "$regex must be a string"},
+		{`{"selector":{"owner":{"$exists":"yes"}}}`, "$exists must be true or false"},
+		{`{"selector":{},"fields":"name"}`, "fields must be an array of field names"},
+		{`{"selector":{},"fields":[""]}`, "fields must be an array of field names"},
+		{`{"selector":{},"sort":"size"}`, "sort must be an array"},
+		{`{"selector":{},"sort":[{"size":"up"}]}`, "sort must be an array"},
+		{`{"selector":{},"sort":[{"size":"asc"},{"name":"desc"}]}`, "single direction"},
+		{`{"selector":{},"limit":-1}`, "limit must be a non-negative integer"},
+		{`{"selector":{},"limit":2.5}`, "limit must be a non-negative integer"},
+		{`{"selector":{},"skip":"1"}`, "skip must be a non-negative integer"},
+		{`{"selector":{},"bookmark":1}`, "bookmark must be a string"},
+	}
+	for _, test := range tests {
+		_, err := ParseQuery(test.query)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s returned %v, expected %q", test.query, err, test.message)
+		}
+	}
+
+	query, err := ParseQuery(`{"selector":{},"bookmark":"not a bookmark"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = query.Execute(marbles); err == nil || !strings.Contains(err.Error(), "Invalid bookmark") {
+		t.Fatalf("Execute with an invalid bookmark returned %v", err)
+	}
+}
+
+func TestCouchtest_Sort(t *testing.T) {
+	tests := []struct {
+		sort string
+		keys string
+	}{
+		// documents without a sort field are left out, as with an index
+		{`["size"]`, "marble5,marble4,marble1,marble2,marble3,owner1"},
+		{`[{"size":"desc"}]`, "owner1,marble3,marble2,marble1,marble4,marble5"},
+		{`["owner","size"]`, "marble5,marble4,marble3,marble1,marble2"},
+		{`[{"owner":"desc"},{"size":"desc"}]`, "marble2,marble1,marble3,marble4,marble5"},
+		{`["maker.name"]`, "marble4"},
+		// ties are broken by key, in the direction of the sort
+		{`["docType"]`, "marble1,marble2,marble3,marble4,marble5,owner1"},
+		{`[{"docType":"desc"}]`, "owner1,marble5,marble4,marble3,marble2,marble1"},
+	}
+	for _, test := range tests {
+		if k := keys(t, `{"selector":{},"sort":`+test.sort+`}`); k != test.keys {
+			t.Errorf("sort %s returned %s, expected %s", test.sort, k, test.keys)
+		}
+	}
+}
+
+func TestCouchtest_FieldsLimitSkip(t *testing.T) {
+	results, _ := execute(t, `{"selector":{"name":"marble4"},"fields":["name","maker.country","missing"]}`)
+	if len(results) != 1 || string(results[0].Value) != `{"maker":{"country":"nl"},"name":"marble4"}` {
+		t.Fatalf("fields returned %s", results)
+	}
+	// _id can be selected on but is never returned
+	results, _ = execute(t, `{"selector":{"_id":"marble2"}}`)
+	if len(results) != 1 || strings.Contains(string(results[0].Value), "_id") {
+		t.Fatalf("_id selector returned %s", results)
+	}
+	results, _ = execute(t, `{"selector":{"_id":"marble2"},"fields":["_id","size"]}`)
+	if len(results) != 1 || string(results[0].Value) != `{"size":50}` {
+		t.Fatalf("_id field returned %s", results)
+	}
+
+	if k := keys(t, `{"selector":{"docType":"marble"},"limit":2}`); k != "marble1,marble2" {
+		t.Fatalf("limit 2 returned %s", k)
+	}
+	if k := keys(t, `{"selector":{"docType":"marble"},"skip":3,"limit":1}`); k != "marble4" {
+		t.Fatalf("skip 3 limit 1 returned %s", k)
+	}
+	if k := keys(t, `{"selector":{"docType":"marble"},"skip":9}`); k != "" {
+		t.Fatalf("skip 9 returned %s", k)
+	}
+	if k := keys(t, `{"selector":{"docType":"marble"},"limit":0}`); k != "" {
+		t.Fatalf("limit 0 returned %s", k)
+	}
+}
+
+func TestCouchtest_Bookmarks(t *testing.T) {
+	var pages []string
+	bookmark := ""
+	for {
+		query := `{"selector":{"docType":"marble"},"sort":[{"size":"desc"}],"limit":2,"bookmark":"` + bookmark + `"}`
+		results, next := execute(t, query)
+		if len(results) == 0 {
+			if next != bookmark {
+				t.Fatalf("empty page returned bookmark %q, expected %q", next, bookmark)
+			}
+			break
+		}
+		k := make([]string, len(results))
+		for i, result := range results {
+			k[i] = result.Key
+		}
+		pages = append(pages, strings.Join(k, ","))
+		bookmark = next
+	}
+	if strings.Join(pages, "|") != "marble3,marble2|marble1,marble4|marble5" {
+		t.Fatalf("pages are %v", pages)
+	}
+}
+
+func TestCouchtest_ResultsIterator(t *testing.T) {
+	iter := NewResultsIterator(marbles[:2])
+	for _, record := range marbles[:2] {
+		if !iter.HasNext() {
+			t.Fatalf("no %s", record.Key)
+		}
+		kv, err := iter.Next()
+		if err != nil || kv.Key != record.Key || string(kv.Value) != string(record.Value) {
+			t.Fatalf("Next returned %v, %v", kv, err)
+		}
+	}
+	if iter.HasNext() {
+		t.Fatalf("HasNext after the last record")
+	}
+	if _, err := iter.Next(); err == nil {
+		t.Fatalf("Next after the last record should have failed")
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCouchtest_PagesCoverResults checks that following the bookmarks returns
+// every result of the unlimited query exactly once, in the same order
+func TestCouchtest_PagesCoverResults(t *testing.T) {
+	property := func(sizes []int8, limit uint8, desc bool) bool {
+		var records []Record
+		for i, size := range sizes {
+			value, _ := json.Marshal(map[string]interface{}{"docType": "marble", "size": size % 5})
+			records = append(records, Record{fmt.Sprintf("m%03d", i), value})
+		}
+		direction := "asc"
+		if desc {
+			direction = "desc"
+		}
+		run := func(query string) ([]Record, string) {
+			q, err := ParseQuery(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, bookmark, err := q.Execute(records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return results, bookmark
+		}
+
+		all, _ := run(`{"selector":{"size":{"$gte":0}},"sort":[{"size":"` + direction + `"}]}`)
+		var paged []Record
+		bookmark := ""
+		for {
+			page, next := run(fmt.Sprintf(`{"selector":{"size":{"$gte":0}},"sort":[{"size":"%s"}],"limit":%d,"bookmark":"%s"}`, direction, int(limit)%4+1, bookmark))
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, page...)
+			bookmark = next
+		}
+		if len(paged) != len(all) {
+			return false
+		}
+		for i := range all {
+			if paged[i].Key != all[i].Key {
+				return false
+			}
+			if i > 0 {
+				previous, current := map[string]float64{}, map[string]float64{}
+				json.Unmarshal(all[i-1].Value, &previous)
+				json.Unmarshal(all[i].Value, &current)
+				if (previous["size"] > current["size"]) != desc && previous["size"] != current["size"] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SHA-256 of the sample files next to the chaincode
+const (
+	diplomaHash  = "3bfb9566649177660a4da5e3dd3275d0affcfe74130fd34d91b0611b9c49fa95"
+	diploma1Hash = "f48ae1073100a69df62db81b8ff996841f0a7df2cef209acd0e2f358009397fb"
+)
+
+func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInit("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+}
+
+func checkState(t *testing.T, stub *shim.MockStub, name string, value string) {
+	if string(stub.State[name]) != value {
+		t.Fatalf("State value %s was %q, expected %q", name, stub.State[name], value)
+	}
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Invoke %s failed: %s", args, res.Message)
+	}
+}
+
+func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte, message string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status == shim.OK {
+		t.Fatalf("Invoke %s should have failed", args)
+	}
+	if res.Message != message {
+		t.Fatalf("Invoke %s failed with %q, expected %q", args, res.Message, message)
+	}
+}
+
+func newStub(t *testing.T) *shim.MockStub {
+	stub := shim.NewMockStub("exp", new(SimpleChaincode))
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("alice"), []byte("bob")})
+	return stub
+}
+
+func TestExp_Init(t *testing.T) {
+	stub := shim.NewMockStub("exp", new(SimpleChaincode))
+	if res := stub.MockInit("1", [][]byte{[]byte("init"), []byte("alice")}); res.Status == shim.OK {
+		t.Fatalf("Init with one entity should have failed")
+	}
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("alice"), []byte("bob")})
+	checkState(t, stub, "alice", "0")
+	checkState(t, stub, "bob", "0")
+}
+
+func TestExp_Upload(t *testing.T) {
+	stub := newStub(t)
+
+	checkInvoke(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("diploma.txt")})
+	checkState(t, stub, "alice", diplomaHash)
+
+	checkInvokeError(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("diploma.txt")}, "File have already existed in the system. Refuse to upload it again.")
+	checkInvokeError(t, stub, [][]byte{[]byte("upload"), []byte("carol"), []byte("diploma.txt")}, "Entity not found")
+	checkInvokeError(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("missing.txt")}, "Invalid File Path, Please Check it.")
+	checkInvokeError(t, stub, [][]byte{[]byte("upload"), []byte("alice")}, "Incorrect number of arguments. Expecting 2")
+
+	// uploading another file replaces the hash
+	checkInvoke(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("diploma1.txt")})
+	checkState(t, stub, "alice", diploma1Hash)
+}
+
+func TestExp_Transfer(t *testing.T) {
+	stub := newStub(t)
+
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("bob"), []byte("diploma.txt")}, "File has not been uploaded to the system. Please Upload it first!")
+
+	checkInvoke(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("diploma.txt")})
+	checkInvoke(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("bob"), []byte("diploma.txt")})
+	checkState(t, stub, "alice", diplomaHash)
+	checkState(t, stub, "bob", diplomaHash)
+
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("bob"), []byte("diploma1.txt")}, "File has not been uploaded to the system. Please Upload it first!")
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("carol"), []byte("diploma.txt")}, "Entity not found")
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("carol"), []byte("bob"), []byte("diploma.txt")}, "Entity not found")
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("bob"), []byte("missing.txt")}, "Invalid File Path, Please Check it.")
+	checkInvokeError(t, stub, [][]byte{[]byte("transfer"), []byte("alice"), []byte("bob")}, "Incorrect number of arguments. Expecting 3")
+}
+
+func TestExp_QueryAndDelete(t *testing.T) {
+	stub := newStub(t)
+	checkInvoke(t, stub, [][]byte{[]byte("upload"), []byte("alice"), []byte("diploma.txt")})
+
+	res := stub.MockInvoke("1", [][]byte{[]byte("query"), []byte("alice")})
+	if res.Status != shim.OK || string(res.Payload) != diplomaHash {
+		t.Fatalf("Query alice returned %d %q", res.Status, res.Payload)
+	}
+	checkInvokeError(t, stub, [][]byte{[]byte("query"), []byte("carol")}, "{\"Error\":\"Nil amount for carol\"}")
+	checkInvokeError(t, stub, [][]byte{[]byte("query")}, "Incorrect number of arguments. Expecting name of the person to query")
+
+	checkInvoke(t, stub, [][]byte{[]byte("delete"), []byte("alice")})
+	checkInvokeError(t, stub, [][]byte{[]byte("query"), []byte("alice")}, "{\"Error\":\"Nil amount for alice\"}")
+	checkInvokeError(t, stub, [][]byte{[]byte("delete")}, "Incorrect number of arguments. Expecting 1")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("invoke")}, "Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\" \"upload\"")
+}
@@ -29,11 +29,14 @@ package main
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -42,19 +45,53 @@ import (
 type SmartContract struct {
 }
 
-// Define the car structure, with 4 properties.  Structure tags are used by encoding/json library
+// Define the car structure, with 12 properties.  Structure tags are used by encoding/json library
+// Cars are stored under their VIN, see vin.go, and indexed as described in index.go
+// OwnerId is the identity of the owner (see callerIdentity), Owner is only a display name
 type Car struct {
-	Make   string `json:"make"`
-	Model  string `json:"model"`
-	Colour string `json:"colour"`
-	Owner  string `json:"owner"`
+	DocType string `json:"docType"`
+	Make    string `json:"make"`
+	Model   string `json:"model"`
+	Colour  string `json:"colour"`
+	Owner   string `json:"owner"`
+	OwnerId string `json:"ownerId"`
+	Year    int    `json:"year"`
+	Plate   string `json:"plate"`
+	Status  string `json:"status"`
+	Lien    *Lien  `json:"lien,omitempty"`
+
+	Odometer     int `json:"odometer"`     // last mileage recorded, see service.go
+	ServiceCount int `json:"serviceCount"` // number of service records
 }
 
+// Status of a car in the registry
+const (
+	carStatusActive   = "active"
+	carStatusStolen   = "stolen"
+	carStatusScrapped = "scrapped"
+)
+
+// firstCarYear is the earliest model year accepted for a car
+const firstCarYear = 1886
+
+var plateRegexp = regexp.MustCompile(`^[A-Z0-9][A-Z0-9 -]{0,9}$`)
+
+// inspectorAttribute is the certificate attribute (with a value of "true") of authorized inspectors
+const inspectorAttribute = "fabcar.inspector"
+
+// adminAttribute is the certificate attribute (with a value of "true") of fabcar admins
+const adminAttribute = "fabcar.admin"
+
 /*
  * The Init method is called when the Smart Contract "fabcar" is instantiated by the blockchain network
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
+ * Fixtures can be loaded at instantiate time with the arguments ["initLedger", "<fixtures JSON>"]
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	function, args := APIstub.GetFunctionAndParameters()
+	if function == "initLedger" {
+		return s.initLedger(APIstub, args)
+	}
 	return shim.Success(nil)
 }
 
@@ -70,13 +107,33 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	if function == "queryCar" {
 		return s.queryCar(APIstub, args)
 	} else if function == "initLedger" {
-		return s.initLedger(APIstub)
+		return s.initLedger(APIstub, args)
 	} else if function == "createCar" {
 		return s.createCar(APIstub, args)
+	} else if function == "queryCarByPlate" {
+		return s.queryCarByPlate(APIstub, args)
 	} else if function == "queryAllCars" {
-		return s.queryAllCars(APIstub)
+		return s.queryAllCars(APIstub, args)
 	} else if function == "changeCarOwner" {
 		return s.changeCarOwner(APIstub, args)
+	} else if function == "migrateCars" {
+		return s.migrateCars(APIstub, args)
+	} else if function == "setCarStatus" {
+		return s.setCarStatus(APIstub, args)
+	} else if function == "placeLien" {
+		return s.placeLien(APIstub, args)
+	} else if function == "releaseLien" {
+		return s.releaseLien(APIstub, args)
+	} else if function == "recordService" {
+		return s.recordService(APIstub, args)
+	} else if function == "getServiceTimeline" {
+		return s.getServiceTimeline(APIstub, args)
+	} else if function == "getCarTitleHistory" {
+		return s.getCarTitleHistory(APIstub, args)
+	} else if function == "assignCarOwner" {
+		return s.assignCarOwner(APIstub, args)
+	} else if function == "whoAmI" {
+		return s.whoAmI(APIstub)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
@@ -88,107 +145,216 @@ func (s *SmartContract) queryCar(APIstub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	carAsBytes, _ := APIstub.GetState(args[0])
+	carAsBytes, err := APIstub.GetState(normalizeVIN(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if carAsBytes == nil {
+		return shim.Error("Car " + args[0] + " does not exist")
+	}
 	return shim.Success(carAsBytes)
 }
 
-func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
-	cars := []Car{
-		Car{Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko"},
-		Car{Make: "Ford", Model: "Mustang", Colour: "red", Owner: "Brad"},
-		Car{Make: "Hyundai", Model: "Tucson", Colour: "green", Owner: "Jin Soo"},
-		Car{Make: "Volkswagen", Model: "Passat", Colour: "yellow", Owner: "Max"},
-		Car{Make: "Tesla", Model: "S", Colour: "black", Owner: "Adriana"},
-		Car{Make: "Peugeot", Model: "205", Colour: "purple", Owner: "Michel"},
-		Car{Make: "Chery", Model: "S22L", Colour: "white", Owner: "Aarav"},
-		Car{Make: "Fiat", Model: "Punto", Colour: "violet", Owner: "Pari"},
-		Car{Make: "Tata", Model: "Nano", Colour: "indigo", Owner: "Valeria"},
-		Car{Make: "Holden", Model: "Barina", Colour: "brown", Owner: "Shotaro"},
-	}
-
-	i := 0
-	for i < len(cars) {
-		fmt.Println("i is ", i)
-		carAsBytes, _ := json.Marshal(cars[i])
-		APIstub.PutState("CAR"+strconv.Itoa(i), carAsBytes)
-		fmt.Println("Added", cars[i])
-		i = i + 1
+/*
+ * queryCarByPlate looks the VIN of a car up in the plate~vin index and returns the car
+ */
+func (s *SmartContract) queryCarByPlate(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	return shim.Success(nil)
+	vin, err := findVINByPlate(APIstub, normalizePlate(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if vin == "" {
+		return shim.Error("No car is registered with plate " + args[0])
+	}
+	return s.queryCar(APIstub, []string{vin})
 }
 
 func (s *SmartContract) createCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+	//   0                    1         2         3       4         5       6
+	// "1FA6P8TH2J5000002", "Ford", "Mustang", "red", "Brad", "2018", "FAB 002"
+	if len(args) != 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 7")
+	}
+	for i := 1; i < 5; i++ {
+		if len(strings.TrimSpace(args[i])) == 0 {
+			return shim.Error("Argument " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
 	}
 
-	var car = Car{Make: args[1], Model: args[2], Colour: args[3], Owner: args[4]}
+	vin := normalizeVIN(args[0])
+	if err := validateVIN(vin); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	carAsBytes, _ := json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
+	year, err := strconv.Atoi(args[5])
+	if err != nil {
+		return shim.Error("6th argument must be a numeric string")
+	}
+
+	// the caller registers the car as its own
+	ownerId, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var car = Car{Make: args[1], Model: args[2], Colour: args[3], Owner: args[4], OwnerId: ownerId, Year: year, Plate: args[6], Status: carStatusActive}
+	if err := registerCar(APIstub, vin, car); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Response {
+/*
+ * registerCar validates a new car, stores it under its VIN and indexes it.
+ * It refuses a VIN or a plate that is already registered.
+ */
+func registerCar(APIstub shim.ChaincodeStubInterface, vin string, car Car) error {
 
-	startKey := "CAR0"
-	endKey := "CAR999"
+	if err := validateVIN(vin); err != nil {
+		return err
+	}
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	// a model year can be one ahead of the calendar year
+	latestYear := time.Unix(txTimestamp.Seconds, 0).UTC().Year() + 1
+	if car.Year < firstCarYear || car.Year > latestYear {
+		return fmt.Errorf("Invalid year %d: expecting %d to %d", car.Year, firstCarYear, latestYear)
+	}
+	car.Plate = normalizePlate(car.Plate)
+	if !plateRegexp.MatchString(car.Plate) {
+		return fmt.Errorf("Invalid plate %s: expecting up to 10 letters, digits, spaces and dashes", car.Plate)
+	}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	existing, err := APIstub.GetState(vin)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("Car %s already exists", vin)
+	}
+	registered, err := findVINByPlate(APIstub, car.Plate)
+	if err != nil {
+		return err
+	} else if registered != "" {
+		return fmt.Errorf("Plate %s is already registered to car %s", car.Plate, registered)
 	}
-	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return err
+	}
+	return updateCarIndexes(APIstub, vin, nil, &car)
+}
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
+// getCar reads a car from the ledger
+func getCar(APIstub shim.ChaincodeStubInterface, vin string) (Car, error) {
+	car := Car{}
+	carAsBytes, err := APIstub.GetState(vin)
+	if err != nil {
+		return car, err
+	} else if carAsBytes == nil {
+		return car, fmt.Errorf("Car %s does not exist", vin)
+	}
+	if err := json.Unmarshal(carAsBytes, &car); err != nil {
+		return car, fmt.Errorf("Failed to decode car %s: %s", vin, err.Error())
+	}
+	return car, nil
+}
 
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+// putCar writes a car to the ledger under its VIN
+func putCar(APIstub shim.ChaincodeStubInterface, vin string, car *Car) error {
+	car.DocType = carDocType
+	carAsBytes, err := json.Marshal(car)
+	if err != nil {
+		return err
 	}
-	buffer.WriteString("]")
+	return APIstub.PutState(vin, carAsBytes)
+}
 
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
+// hasAttribute reports whether the caller's certificate has the attribute set to true
+func hasAttribute(APIstub shim.ChaincodeStubInterface, attribute string) bool {
+	return cid.AssertAttributeValue(APIstub, attribute, "true") == nil
+}
 
-	return shim.Success(buffer.Bytes())
+// normalizePlate returns the canonical (trimmed, upper case) form of a registration plate
+func normalizePlate(plate string) string {
+	return strings.ToUpper(strings.TrimSpace(plate))
 }
 
-func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+/*
+ * findVINByPlate returns the VIN of the car registered with a plate, or "" if there is none
+ */
+func findVINByPlate(APIstub shim.ChaincodeStubInterface, plate string) (string, error) {
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(plateIndex.name, []string{plate})
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	if !resultsIterator.HasNext() {
+		return "", nil
+	}
+	indexEntry, err := resultsIterator.Next()
+	if err != nil {
+		return "", err
+	}
+	_, keyParts, err := APIstub.SplitCompositeKey(indexEntry.Key)
+	if err != nil {
+		return "", err
+	}
+	return keyParts[1], nil
+}
+
+/*
+ * setCarStatus changes the status of a car, e.g. when it is reported stolen or scrapped.
+ * The owner can report the car stolen and mark it active again once it is recovered. An
+ * inspector or an admin, an identity whose certificate has the fabcar.inspector or the
+ * fabcar.admin attribute set to true, can set any status.
+ *
+ *   0                    1
+ * "1FA6P8TH2J5000002", "stolen"
+ */
+func (s *SmartContract) setCarStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
+	status := args[1]
+	if status != carStatusActive && status != carStatusStolen && status != carStatusScrapped {
+		return shim.Error("Status must be one of " + carStatusActive + ", " + carStatusStolen + " or " + carStatusScrapped + ", got " + status)
+	}
 
-	carAsBytes, _ := APIstub.GetState(args[0])
-	car := Car{}
-
-	json.Unmarshal(carAsBytes, &car)
-	car.Owner = args[1]
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Status == status {
+		return shim.Error("Car " + vin + " is already " + status)
+	}
+	if !hasAttribute(APIstub, inspectorAttribute) && !hasAttribute(APIstub, adminAttribute) {
+		caller, err := callerIdentity(APIstub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if car.OwnerId == "" || car.OwnerId != caller {
+			return shim.Error("Only the owner of car " + vin + ", an inspector or an admin can change its status")
+		}
+		if status == carStatusScrapped || car.Status == carStatusScrapped {
+			return shim.Error("Only an inspector or an admin can scrap car " + vin + " or restore it")
+		}
+	}
 
-	carAsBytes, _ = json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
+	car.Status = status
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
@@ -0,0 +1,185 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	dealer    = cidtest.Identity{MSPID: "Org1MSP", CommonName: "dealer"}
+	buyer     = cidtest.Identity{MSPID: "Org2MSP", CommonName: "buyer"}
+	lender    = cidtest.Identity{MSPID: "Org2MSP", CommonName: "lender", Attributes: map[string]interface{}{"fabcar.lender": "true"}}
+	inspector = cidtest.Identity{MSPID: "Org1MSP", CommonName: "inspector", Attributes: map[string]interface{}{"fabcar.inspector": "true"}}
+	garage    = cidtest.Identity{MSPID: "Org2MSP", CommonName: "garage", Attributes: map[string]interface{}{"fabcar.garage": "true"}}
+	admin     = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{"fabcar.admin": "true"}}
+)
+
+const mustangVIN = "1FA6P8TH2J5000002"
+
+func checkCar(t *testing.T, stub *cidtest.Stub, vin string) Car {
+	var car Car
+	if err := json.Unmarshal(stub.CheckInvoke(t, dealer, "queryCar", vin), &car); err != nil {
+		t.Fatal(err)
+	}
+	return car
+}
+
+// identityOf returns the identity of id as whoAmI returns it
+func identityOf(t *testing.T, stub *cidtest.Stub, id cidtest.Identity) string {
+	return string(stub.CheckInvoke(t, id, "whoAmI"))
+}
+
+// newStub returns a ledger with the Mustang of the fixtures, registered by the dealer
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.CheckInvoke(t, dealer, "createCar", mustangVIN, "Ford", "Mustang", "red", "Brad", "2018", "FAB 002")
+	return stub
+}
+
+func readFixtures(t *testing.T) string {
+	fixtures, err := ioutil.ReadFile("fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(fixtures)
+}
+
+func TestFabcar_Init(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	if res := stub.InitAs(dealer, "init"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	if res := stub.InitAs(dealer, "initLedger", readFixtures(t)); res.Status != shim.OK {
+		t.Fatalf("Init with fixtures failed: %s", res.Message)
+	}
+	checkCar(t, stub, "JTDKB20U493000001")
+}
+
+func TestFabcar_CreateAndQuery(t *testing.T) {
+	stub := newStub(t)
+
+	car := checkCar(t, stub, strings.ToLower(mustangVIN))
+	if car.OwnerId != identityOf(t, stub, dealer) {
+		t.Fatalf("Car is owned by %s, not the dealer that registered it", car.OwnerId)
+	}
+	if car.Make != "Ford" || car.Plate != "FAB 002" || car.Year != 2018 || car.Status != carStatusActive {
+		t.Fatalf("queryCar returned %+v", car)
+	}
+
+	var byPlate Car
+	json.Unmarshal(stub.CheckInvoke(t, buyer, "queryCarByPlate", " fab 002 "), &byPlate)
+	if byPlate != car {
+		t.Fatalf("queryCarByPlate returned %+v", byPlate)
+	}
+
+	stub.CheckInvokeError(t, dealer, "Car JTDKB20U493000001 does not exist", "queryCar", "JTDKB20U493000001")
+	stub.CheckInvokeError(t, dealer, "No car is registered with plate FAB 999", "queryCarByPlate", "FAB 999")
+	stub.CheckInvokeError(t, dealer, "Expecting 1", "queryCar")
+	stub.CheckInvokeError(t, dealer, "Expecting 1", "queryCarByPlate")
+	stub.CheckInvokeError(t, dealer, "Invalid Smart Contract function name", "deleteCar", mustangVIN)
+}
+
+func TestFabcar_CreateErrors(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, dealer, "Expecting 7", "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Tomoko", "2009")
+	stub.CheckInvokeError(t, dealer, "Argument 3 must be a non-empty string", "createCar", "JTDKB20U493000001", "Toyota", " ", "blue", "Tomoko", "2009", "FAB 001")
+	stub.CheckInvokeError(t, dealer, "Invalid VIN CAR0: expecting 17", "createCar", "CAR0", "Toyota", "Prius", "blue", "Tomoko", "2009", "FAB 001")
+	stub.CheckInvokeError(t, dealer, "check digit is 4, expecting 3", "createCar", "JTDKB20U443000001", "Toyota", "Prius", "blue", "Tomoko", "2009", "FAB 001")
+	stub.CheckInvokeError(t, dealer, "6th argument must be a numeric string", "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Tomoko", "new", "FAB 001")
+	stub.CheckInvokeError(t, dealer, "Invalid year 1800", "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Tomoko", "1800", "FAB 001")
+	stub.CheckInvokeError(t, dealer, "Invalid plate FAB_001", "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Tomoko", "2009", "FAB_001")
+	stub.CheckInvokeError(t, dealer, "Car "+mustangVIN+" already exists", "createCar", mustangVIN, "Ford", "Mustang", "red", "Brad", "2018", "FAB 102")
+	stub.CheckInvokeError(t, dealer, "Plate FAB 002 is already registered to car "+mustangVIN, "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Tomoko", "2009", "fab 002")
+
+	// the examples of invoke.js
+	stub.CheckInvoke(t, dealer, "createCar", "1HGCR2F39JA000012", "Honda", "Accord", "Black", "Tom", "2018", "FAB 012")
+}
+
+func TestFabcar_InitLedger(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	fixtures := readFixtures(t)
+
+	stub.CheckInvokeError(t, dealer, "Expecting the fixtures JSON", "initLedger")
+	stub.CheckInvokeError(t, dealer, "Failed to decode the fixtures", "initLedger", "{")
+	stub.CheckInvokeError(t, dealer, "The fixtures have no cars", "initLedger", "[]")
+	stub.CheckInvokeError(t, dealer, "Fixture 0: make, model, colour and owner are required", "initLedger", `[{"vin":"JTDKB20U493000001"}]`)
+
+	var report FixtureReport
+	if err := json.Unmarshal(stub.CheckInvoke(t, dealer, "initLedger", fixtures), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Count != 10 || len(report.Created) != 10 || report.Created[0] != "JTDKB20U493000001" {
+		t.Fatalf("initLedger returned %+v", report)
+	}
+	if car := checkCar(t, stub, "6G1ZZZZZ3JL000010"); car.Owner != "Shotaro" || car.OwnerId != identityOf(t, stub, dealer) {
+		t.Fatalf("Fixture car is %+v", car)
+	}
+
+	// the example of query.js
+	checkCar(t, stub, "WVWZZZ3C1JE000004")
+
+	// once there are cars only admins can load more, and never over existing cars
+	more := `[{"vin":"2HGFC2F55JH000011","make":"Honda","model":"Civic","colour":"grey","owner":"Ana","ownerId":"Org2MSP/ana","year":2018,"plate":"FAB 011"}]`
+	stub.CheckInvokeError(t, dealer, "only an admin can load fixtures", "initLedger", more)
+	stub.CheckInvokeError(t, admin, "Fixture 0: Car JTDKB20U493000001 already exists", "initLedger", fixtures)
+	stub.CheckInvoke(t, admin, "initLedger", more)
+	if car := checkCar(t, stub, "2HGFC2F55JH000011"); car.OwnerId != "Org2MSP/ana" {
+		t.Fatalf("Fixture car is owned by %s", car.OwnerId)
+	}
+	invalid := `[{"vin":"3VWFE21C04M000001","make":"VW","model":"Beetle","colour":"yellow","owner":"Ana","ownerId":"ana"}]`
+	stub.CheckInvokeError(t, admin, "Fixture 0: invalid owner identity ana, expecting MSP ID/ID", "initLedger", invalid)
+}
+
+func TestFabcar_SetCarStatus(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, buyer, "Only the owner of car "+mustangVIN+", an inspector or an admin can change its status", "setCarStatus", mustangVIN, "stolen")
+	stub.CheckInvoke(t, inspector, "setCarStatus", mustangVIN, "stolen")
+	if car := checkCar(t, stub, mustangVIN); car.Status != carStatusStolen {
+		t.Fatalf("Car is %s", car.Status)
+	}
+	stub.CheckInvokeError(t, inspector, "is already stolen", "setCarStatus", mustangVIN, "stolen")
+	stub.CheckInvoke(t, inspector, "setCarStatus", strings.ToLower(mustangVIN), "scrapped")
+	stub.CheckInvoke(t, admin, "setCarStatus", mustangVIN, "active")
+	if car := checkCar(t, stub, mustangVIN); car.Status != carStatusActive || car.Plate != "FAB 002" {
+		t.Fatalf("Car is %+v", car)
+	}
+
+	stub.CheckInvokeError(t, inspector, "Status must be one of active, stolen or scrapped, got lost", "setCarStatus", mustangVIN, "lost")
+	stub.CheckInvokeError(t, inspector, "Expecting 2", "setCarStatus", mustangVIN)
+	stub.CheckInvokeError(t, inspector, "Car JTDKB20U493000001 does not exist", "setCarStatus", "JTDKB20U493000001", "stolen")
+}
+
+func TestFabcar_NoCreator(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.SetCreator(nil)
+	res := stub.MockInvoke("nocreator", [][]byte{[]byte("createCar"), []byte(mustangVIN), []byte("Ford"), []byte("Mustang"), []byte("red"), []byte("Brad"), []byte("2018"), []byte("FAB 002")})
+	if res.Status == shim.OK || !strings.Contains(res.Message, "Failed to get the caller's MSP ID") {
+		t.Fatalf("createCar without a creator returned %d %q", res.Status, res.Message)
+	}
+}
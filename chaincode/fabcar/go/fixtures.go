@@ -0,0 +1,141 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Fixtures
+ *
+ * initLedger seeds the ledger with cars from a JSON payload, see fixtures.json for the format.
+ * It runs on a ledger without any car, usually at instantiate time, or for an admin (an identity
+ * whose certificate has the fabcar.admin attribute set to true). It never overwrites a car: if
+ * a VIN or a plate of the fixtures is already registered nothing is loaded.
+ */
+
+// CarFixture is one car of the fixtures payload. Without an ownerId the car belongs to the
+// identity loading the fixtures.
+type CarFixture struct {
+	Vin     string `json:"vin"`
+	Make    string `json:"make"`
+	Model   string `json:"model"`
+	Colour  string `json:"colour"`
+	Owner   string `json:"owner"`
+	OwnerId string `json:"ownerId"`
+	Year    int    `json:"year"`
+	Plate   string `json:"plate"`
+}
+
+// FixtureReport is returned by initLedger
+type FixtureReport struct {
+	Created []string `json:"created"`
+	Count   int      `json:"count"`
+}
+
+/*
+ * initLedger loads the fixtures passed as its only argument
+ *
+ *   0
+ * "[{\"vin\":\"JTDKB20U493000001\",\"make\":\"Toyota\",...}, ...]"
+ */
+func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 || len(args[0]) == 0 {
+		return shim.Error("Incorrect number of arguments. Expecting the fixtures JSON")
+	}
+
+	initialized, err := ledgerInitialized(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if initialized {
+		if err := cid.AssertAttributeValue(APIstub, adminAttribute, "true"); err != nil {
+			return shim.Error("The ledger already has cars, only an admin can load fixtures: " + err.Error())
+		}
+	}
+
+	var fixtures []CarFixture
+	if err := json.Unmarshal([]byte(args[0]), &fixtures); err != nil {
+		return shim.Error("Failed to decode the fixtures: " + err.Error())
+	}
+	if len(fixtures) == 0 {
+		return shim.Error("The fixtures have no cars")
+	}
+
+	loader, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report := FixtureReport{Created: []string{}}
+	for i, fixture := range fixtures {
+		if fixture.Make == "" || fixture.Model == "" || fixture.Colour == "" || fixture.Owner == "" {
+			return shim.Error(fmt.Sprintf("Fixture %d: make, model, colour and owner are required", i))
+		}
+		ownerId := fixture.OwnerId
+		if ownerId == "" {
+			ownerId = loader
+		} else if !validIdentity(ownerId) {
+			return shim.Error(fmt.Sprintf("Fixture %d: invalid owner identity %s, expecting MSP ID/ID", i, ownerId))
+		}
+		vin := normalizeVIN(fixture.Vin)
+		car := Car{
+			Make:    fixture.Make,
+			Model:   fixture.Model,
+			Colour:  fixture.Colour,
+			Owner:   fixture.Owner,
+			OwnerId: ownerId,
+			Year:    fixture.Year,
+			Plate:   fixture.Plate,
+			Status:  carStatusActive,
+		}
+		// registerCar refuses existing VINs and plates, including the ones of earlier fixtures
+		if err := registerCar(APIstub, vin, car); err != nil {
+			return shim.Error(fmt.Sprintf("Fixture %d: %s", i, err.Error()))
+		}
+		fmt.Println("Added", vin, car)
+		report.Created = append(report.Created, vin)
+		report.Count++
+	}
+
+	reportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(reportAsBytes)
+}
+
+// ledgerInitialized reports whether any car is registered
+func ledgerInitialized(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(docTypeIndex.name, []string{carDocType})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+
+	return resultsIterator.HasNext(), nil
+}
@@ -0,0 +1,359 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// carDocType is stored in every car and namespaces the docType~vin index of all cars
+const carDocType = "car"
+
+// Page sizes of queryAllCars
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+/*
+ * A carIndex is an 'index' kept in state as composite keys of the form name~value~vin,
+ * so cars can be listed and filtered with range queries, without CouchDB.
+ * Every write goes through updateCarIndexes, so adding an index here is enough to maintain it.
+ */
+type carIndex struct {
+	name      string
+	attribute func(car *Car) string
+}
+
+var (
+	docTypeIndex = carIndex{"docType~vin", func(car *Car) string { return carDocType }}
+	plateIndex   = carIndex{"plate~vin", func(car *Car) string { return car.Plate }}
+	ownerIndex   = carIndex{"owner~vin", func(car *Car) string { return filterValue(car.Owner) }}
+	makeIndex    = carIndex{"make~vin", func(car *Car) string { return filterValue(car.Make) }}
+	modelIndex   = carIndex{"model~vin", func(car *Car) string { return filterValue(car.Model) }}
+	colourIndex  = carIndex{"colour~vin", func(car *Car) string { return filterValue(car.Colour) }}
+)
+
+var carIndexes = []carIndex{docTypeIndex, plateIndex, ownerIndex, makeIndex, modelIndex, colourIndex}
+
+// filterIndexes maps the filters of queryAllCars to their index, the first filter given
+// in this order picks the index that is scanned, the others are checked on each car
+var filterIndexes = []struct {
+	field string
+	index carIndex
+}{
+	{"owner", ownerIndex},
+	{"model", modelIndex},
+	{"make", makeIndex},
+	{"colour", colourIndex},
+}
+
+// MigrationPage is one batch of migrateCars. Pass Bookmark back to continue, it is
+// empty once every key has been scanned.
+type MigrationPage struct {
+	Migrated []string `json:"migrated"`
+	Bookmark string   `json:"bookmark"`
+}
+
+// CarRecord is a car together with its key (the VIN)
+type CarRecord struct {
+	Key    string `json:"Key"`
+	Record Car    `json:"Record"`
+}
+
+// CarPage is one page of queryAllCars. Pass Bookmark back to get the next page, it is
+// empty on the last page.
+type CarPage struct {
+	Records  []CarRecord `json:"records"`
+	Count    int         `json:"count"`
+	Bookmark string      `json:"bookmark"`
+}
+
+// filterValue is the form of make, model, colour and owner kept in the indexes, so filters ignore case
+func filterValue(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+/*
+ * updateCarIndexes moves the index entries of a car from its old state to its new state.
+ * Pass a nil before for a new car. Entries that don't change are left alone.
+ */
+func updateCarIndexes(APIstub shim.ChaincodeStubInterface, vin string, before, after *Car) error {
+
+	for _, index := range carIndexes {
+		var oldKey, newKey string
+		var err error
+		// An empty value, such as the plate of a migrated car, is not indexed
+		if before != nil && index.attribute(before) != "" {
+			if oldKey, err = APIstub.CreateCompositeKey(index.name, []string{index.attribute(before), vin}); err != nil {
+				return err
+			}
+		}
+		if after != nil && index.attribute(after) != "" {
+			if newKey, err = APIstub.CreateCompositeKey(index.name, []string{index.attribute(after), vin}); err != nil {
+				return err
+			}
+		}
+		if oldKey == newKey {
+			continue
+		}
+		if oldKey != "" {
+			if err := APIstub.DelState(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != "" {
+			// Only the key is needed, a nil value would delete the key, so store the null character
+			if err := APIstub.PutState(newKey, []byte{0x00}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * queryAllCars lists the cars a page at a time, in VIN order, optionally filtered.
+ *
+ *   0            1            2...
+ * "pageSize", "bookmark", "make=Toyota", "owner=Tomoko", ...
+ *
+ * All arguments are optional, filters are make, model, colour and owner and ignore case.
+ */
+func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	pageSize := defaultPageSize
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize < 1 || pageSize > maxPageSize {
+			return shim.Error(fmt.Sprintf("Page size must be a number from 1 to %d", maxPageSize))
+		}
+	}
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	filters := map[string]string{}
+	var filterArgs []string
+	if len(args) > 2 {
+		filterArgs = args[2:]
+	}
+	for _, arg := range filterArgs {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return shim.Error("Invalid filter " + arg + ", expecting field=value")
+		}
+		field := strings.ToLower(parts[0])
+		if field != "make" && field != "model" && field != "colour" && field != "owner" {
+			return shim.Error("Invalid filter " + arg + ", can filter on make, model, colour and owner")
+		}
+		filters[field] = filterValue(parts[1])
+	}
+
+	index, prefix := docTypeIndex, carDocType
+	for _, filter := range filterIndexes {
+		if value, ok := filters[filter.field]; ok {
+			index, prefix = filter.index, value
+			delete(filters, filter.field)
+			break
+		}
+	}
+
+	page, err := queryCarIndex(APIstub, index, prefix, filters, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageAsBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- queryAllCars:\n%s\n", pageAsBytes)
+
+	return shim.Success(pageAsBytes)
+}
+
+/*
+ * queryCarIndex returns a page of the cars under one value of an index that match the
+ * remaining filters. The bookmark is the last index key returned, the composite key API
+ * can't start a range in the middle, so entries up to the bookmark are skipped.
+ */
+func queryCarIndex(APIstub shim.ChaincodeStubInterface, index carIndex, value string, filters map[string]string, pageSize int, bookmark string) (CarPage, error) {
+
+	page := CarPage{Records: []CarRecord{}}
+
+	prefix, err := APIstub.CreateCompositeKey(index.name, []string{value})
+	if err != nil {
+		return page, err
+	}
+	after := ""
+	if bookmark != "" {
+		decoded, err := base64.StdEncoding.DecodeString(bookmark)
+		if err != nil || !strings.HasPrefix(string(decoded), prefix) {
+			return page, fmt.Errorf("Invalid bookmark %s for these filters", bookmark)
+		}
+		after = string(decoded)
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(index.name, []string{value})
+	if err != nil {
+		return page, err
+	}
+	defer resultsIterator.Close()
+
+	lastKey := ""
+	for resultsIterator.HasNext() {
+		indexEntry, err := resultsIterator.Next()
+		if err != nil {
+			return page, err
+		}
+		if indexEntry.Key <= after { //already returned on an earlier page
+			continue
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return page, err
+		}
+		vin := keyParts[1]
+
+		car, err := getCar(APIstub, vin)
+		if err != nil {
+			return page, fmt.Errorf("Index %s points at a missing car: %s", index.name, err.Error())
+		}
+		if !matchesFilters(&car, filters) {
+			continue
+		}
+		if page.Count == pageSize { //there is at least one more, leave a bookmark
+			page.Bookmark = base64.StdEncoding.EncodeToString([]byte(lastKey))
+			break
+		}
+		page.Records = append(page.Records, CarRecord{Key: vin, Record: car})
+		page.Count++
+		lastKey = indexEntry.Key
+	}
+	return page, nil
+}
+
+func matchesFilters(car *Car, filters map[string]string) bool {
+	for field, value := range filters {
+		var actual string
+		switch field {
+		case "make":
+			actual = car.Make
+		case "model":
+			actual = car.Model
+		case "colour":
+			actual = car.Colour
+		case "owner":
+			actual = car.Owner
+		}
+		if filterValue(actual) != value {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * migrateCars brings cars written before cars had a docType, such as the CAR0..CAR9 of the
+ * original initLedger, into the indexes. They keep their key, as their VIN is unknown, are
+ * marked active and get no plate, and have no owner identity until an admin assigns one
+ * with assignCarOwner. Only an admin can migrate cars. The keys are scanned a
+ * batch at a time so a large ledger can be migrated over several transactions.
+ *
+ *   0            1
+ * "batchSize", "bookmark"
+ *
+ * Both arguments are optional, pass the returned bookmark back until it is empty.
+ */
+func (s *SmartContract) migrateCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if !hasAttribute(APIstub, adminAttribute) {
+		return shim.Error("Only an admin can migrate cars")
+	}
+	batchSize := maxPageSize
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		batchSize, err = strconv.Atoi(args[0])
+		if err != nil || batchSize < 1 || batchSize > maxPageSize {
+			return shim.Error(fmt.Sprintf("Batch size must be a number from 1 to %d", maxPageSize))
+		}
+	}
+	startKey := ""
+	if len(args) > 1 && args[1] != "" {
+		decoded, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return shim.Error("Invalid bookmark " + args[1])
+		}
+		startKey = string(decoded)
+	}
+
+	resultsIterator, err := APIstub.GetStateByRange(startKey, string(utf8.MaxRune))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	page := MigrationPage{Migrated: []string{}}
+	scanned := 0
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if kv.Key == startKey || strings.HasPrefix(kv.Key, "\x00") { //the bookmark itself, or an index entry
+			continue
+		}
+		if scanned == batchSize { //there are more keys, leave a bookmark
+			page.Bookmark = base64.StdEncoding.EncodeToString([]byte(startKey))
+			break
+		}
+		scanned++
+		startKey = kv.Key
+
+		car := Car{}
+		if err := json.Unmarshal(kv.Value, &car); err != nil || car.DocType != "" || car.Make == "" {
+			continue //not a car, or already migrated
+		}
+		car.Status = carStatusActive
+		if err := putCar(APIstub, kv.Key, &car); err != nil {
+			return shim.Error(err.Error())
+		}
+		if err := updateCarIndexes(APIstub, kv.Key, nil, &car); err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Migrated = append(page.Migrated, kv.Key)
+	}
+
+	pageAsBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageAsBytes)
+}
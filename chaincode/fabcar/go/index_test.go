@@ -0,0 +1,180 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func queryAllCars(t *testing.T, stub *cidtest.Stub, args ...string) CarPage {
+	var page CarPage
+	if err := json.Unmarshal(stub.CheckInvoke(t, dealer, append([]string{"queryAllCars"}, args...)...), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != len(page.Records) {
+		t.Fatalf("Page counts %d cars but has %d", page.Count, len(page.Records))
+	}
+	return page
+}
+
+func TestIndex_QueryAllCars(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.CheckInvoke(t, dealer, "initLedger", readFixtures(t))
+
+	page := queryAllCars(t, stub)
+	if page.Count != 10 || page.Bookmark != "" {
+		t.Fatalf("queryAllCars returned %d cars, bookmark %q", page.Count, page.Bookmark)
+	}
+	for i := 1; i < len(page.Records); i++ {
+		if page.Records[i-1].Key >= page.Records[i].Key {
+			t.Fatalf("Cars are not in VIN order: %s before %s", page.Records[i-1].Key, page.Records[i].Key)
+		}
+	}
+
+	// pages of 4 chained by bookmark return every car once
+	seen := map[string]bool{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		page = queryAllCars(t, stub, "4", bookmark)
+		for _, record := range page.Records {
+			if seen[record.Key] {
+				t.Fatalf("%s returned twice", record.Key)
+			}
+			seen[record.Key] = true
+		}
+		if bookmark = page.Bookmark; bookmark == "" {
+			if pages != 3 || len(seen) != 10 {
+				t.Fatalf("Paging returned %d cars in %d pages", len(seen), pages)
+			}
+			break
+		}
+	}
+}
+
+func TestIndex_Filters(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.CheckInvoke(t, dealer, "initLedger", readFixtures(t))
+	stub.CheckInvoke(t, dealer, "createCar", "2HGFC2F55JH000011", "Ford", "Focus", "Red", "brad", "2018", "FAB 011")
+
+	if page := queryAllCars(t, stub, "", "", "make=ford"); page.Count != 2 {
+		t.Fatalf("make=ford returned %d cars", page.Count)
+	}
+	if page := queryAllCars(t, stub, "", "", "Make=FORD", "model=focus"); page.Count != 1 || page.Records[0].Key != "2HGFC2F55JH000011" {
+		t.Fatalf("make=FORD model=focus returned %+v", page.Records)
+	}
+	if page := queryAllCars(t, stub, "", "", "owner=Brad", "colour=red"); page.Count != 2 {
+		t.Fatalf("owner=Brad colour=red returned %d cars", page.Count)
+	}
+	if page := queryAllCars(t, stub, "", "", "colour=orange"); page.Count != 0 {
+		t.Fatalf("colour=orange returned %d cars", page.Count)
+	}
+
+	// a bookmark only continues the query it came from
+	page := queryAllCars(t, stub, "1", "", "make=ford")
+	if page.Bookmark == "" {
+		t.Fatalf("First page of make=ford has no bookmark")
+	}
+	if next := queryAllCars(t, stub, "1", page.Bookmark, "make=ford"); next.Count != 1 || next.Bookmark != "" || next.Records[0].Key == page.Records[0].Key {
+		t.Fatalf("Second page of make=ford is %+v", next)
+	}
+	stub.CheckInvokeError(t, dealer, "Invalid bookmark", "queryAllCars", "1", page.Bookmark, "make=toyota")
+	stub.CheckInvokeError(t, dealer, "Invalid bookmark", "queryAllCars", "1", "not base64!")
+
+	stub.CheckInvokeError(t, dealer, "Page size must be a number from 1 to 100", "queryAllCars", "0")
+	stub.CheckInvokeError(t, dealer, "Page size must be a number from 1 to 100", "queryAllCars", "101")
+	stub.CheckInvokeError(t, dealer, "Page size must be a number from 1 to 100", "queryAllCars", "ten")
+	stub.CheckInvokeError(t, dealer, "expecting field=value", "queryAllCars", "", "", "ford")
+	stub.CheckInvokeError(t, dealer, "can filter on make, model, colour and owner", "queryAllCars", "", "", "year=2018")
+}
+
+func TestIndex_FollowsOwner(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, dealer, "changeCarOwner", mustangVIN, "Dave", identityOf(t, stub, buyer))
+
+	if page := queryAllCars(t, stub, "", "", "owner=brad"); page.Count != 0 {
+		t.Fatalf("owner=brad still returns %d cars", page.Count)
+	}
+	if page := queryAllCars(t, stub, "", "", "owner=dave"); page.Count != 1 {
+		t.Fatalf("owner=dave returned %d cars", page.Count)
+	}
+}
+
+func TestIndex_MigrateCars(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.CheckInvoke(t, dealer, "createCar", mustangVIN, "Ford", "Mustang", "red", "Brad", "2018", "FAB 002")
+
+	// cars as the original createCar wrote them, and a key that isn't a car
+	stub.MockTransactionStart("legacy")
+	for i := 0; i < 12; i++ {
+		car := fmt.Sprintf(`{"make":"Toyota","model":"Prius","colour":"blue","owner":"Owner%d"}`, i)
+		stub.PutState(fmt.Sprintf("CAR%d", i), []byte(car))
+	}
+	stub.PutState("settings", []byte(`{"theme":"dark"}`))
+	stub.MockTransactionEnd("legacy")
+
+	if page := queryAllCars(t, stub); page.Count != 1 {
+		t.Fatalf("queryAllCars returned %d cars before the migration", page.Count)
+	}
+	stub.CheckInvokeError(t, dealer, "Only an admin can migrate cars", "migrateCars")
+	stub.CheckInvokeError(t, admin, "Batch size must be a number from 1 to 100", "migrateCars", "0")
+	stub.CheckInvokeError(t, admin, "Invalid bookmark", "migrateCars", "5", "not base64!")
+
+	migrated := map[string]bool{}
+	bookmark := ""
+	for batches := 1; ; batches++ {
+		var page MigrationPage
+		if err := json.Unmarshal(stub.CheckInvoke(t, admin, "migrateCars", "5", bookmark), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range page.Migrated {
+			if migrated[key] {
+				t.Fatalf("%s migrated twice", key)
+			}
+			migrated[key] = true
+		}
+		if bookmark = page.Bookmark; bookmark == "" {
+			// 12 legacy cars, the Mustang and the settings
+			if batches != 3 || len(migrated) != 12 {
+				t.Fatalf("Migrated %d cars in %d batches", len(migrated), batches)
+			}
+			break
+		}
+	}
+
+	if page := queryAllCars(t, stub); page.Count != 13 {
+		t.Fatalf("queryAllCars returned %d cars after the migration", page.Count)
+	}
+	if page := queryAllCars(t, stub, "", "", "owner=owner10"); page.Count != 1 || page.Records[0].Key != "CAR10" {
+		t.Fatalf("owner=owner10 returned %+v", page.Records)
+	}
+	if car := checkCar(t, stub, "car10"); car.Status != carStatusActive || car.Plate != "" {
+		t.Fatalf("Migrated car is %+v", car)
+	}
+	stub.CheckInvokeError(t, dealer, "No car is registered with plate", "queryCarByPlate", "")
+
+	// migrating again finds nothing to do
+	if page := stub.CheckInvoke(t, admin, "migrateCars"); string(page) != `{"migrated":[],"bookmark":""}` {
+		t.Fatalf("Second migration returned %s", page)
+	}
+}
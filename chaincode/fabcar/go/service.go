@@ -0,0 +1,238 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Odometer and service records
+ *
+ * Every service event of a car is kept under its own key, service~vin~sequence, so the car
+ * record doesn't grow. Services are recorded by the owner of the car, by a garage (an identity
+ * whose certificate has the fabcar.garage attribute set to true) or by an inspector (the same
+ * with the fabcar.inspector attribute), in date order. The car keeps the last mileage, a lower
+ * reading is an odometer rollback and is refused, unless an inspector records that the
+ * instrument was replaced.
+ */
+
+// garageAttribute is the certificate attribute (with a value of "true") of registered garages
+const garageAttribute = "fabcar.garage"
+
+const serviceIndex = "service~vin~sequence"
+
+const serviceDateLayout = "2006-01-02"
+
+// ServiceRecord is one odometer reading and service event of a car
+type ServiceRecord struct {
+	DocType            string `json:"docType"`
+	Vin                string `json:"vin"`
+	Sequence           int    `json:"sequence"`
+	Date               string `json:"date"`
+	Garage             string `json:"garage"`
+	Mileage            int    `json:"mileage"`
+	Description        string `json:"description"`
+	InstrumentReplaced bool   `json:"instrumentReplaced"`
+	RecordedBy         string `json:"recordedBy"`
+	TxId               string `json:"txId"`
+}
+
+/*
+ * recordService appends a service record to the log of a car.
+ *
+ *   0                    1             2              3        4                  5 (optional)
+ * "1FA6P8TH2J5000002", "2018-03-01", "Joe's Garage", "12500", "Oil change", "instrumentReplaced"
+ *
+ * The date can't be earlier than the one of the previous record. The optional last argument
+ * is only accepted from an inspector, it allows a reading lower than the previous one because
+ * the odometer was replaced.
+ */
+func (s *SmartContract) recordService(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 5 && len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 5 or 6")
+	}
+	for i := 1; i < 5; i++ {
+		if len(strings.TrimSpace(args[i])) == 0 {
+			return shim.Error("Argument " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	recordedBy, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.OwnerId == "" || car.OwnerId != recordedBy {
+		if !hasAttribute(APIstub, garageAttribute) && !hasAttribute(APIstub, inspectorAttribute) {
+			return shim.Error("Only the owner of car " + vin + ", a garage or an inspector can record a service")
+		}
+	}
+
+	date, err := time.Parse(serviceDateLayout, args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a date formatted as YYYY-MM-DD")
+	}
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if date.After(time.Unix(txTimestamp.Seconds, 0).UTC()) {
+		return shim.Error("Service date " + args[1] + " is in the future")
+	}
+	if car.ServiceCount > 0 {
+		previous, err := getServiceRecord(APIstub, vin, car.ServiceCount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// the layout sorts as a string
+		if args[1] < previous.Date {
+			return shim.Error("Service date " + args[1] + " is earlier than the previous service on " + previous.Date)
+		}
+	}
+	mileage, err := strconv.Atoi(args[3])
+	if err != nil || mileage < 0 {
+		return shim.Error("4th argument must be a non-negative number")
+	}
+
+	instrumentReplaced := false
+	if len(args) == 6 {
+		if args[5] != "instrumentReplaced" {
+			return shim.Error("6th argument must be instrumentReplaced")
+		}
+		if err := cid.AssertAttributeValue(APIstub, inspectorAttribute, "true"); err != nil {
+			return shim.Error("Only an inspector can record an instrument replacement: " + err.Error())
+		}
+		instrumentReplaced = true
+	}
+	if mileage < car.Odometer && !instrumentReplaced {
+		return shim.Error(fmt.Sprintf("Odometer rollback: %d is lower than the last reading of %d for car %s", mileage, car.Odometer, vin))
+	}
+
+	record := ServiceRecord{
+		DocType:            "service",
+		Vin:                vin,
+		Sequence:           car.ServiceCount + 1,
+		Date:               args[1],
+		Garage:             args[2],
+		Mileage:            mileage,
+		Description:        args[4],
+		InstrumentReplaced: instrumentReplaced,
+		RecordedBy:         recordedBy,
+		TxId:               APIstub.GetTxID(),
+	}
+	recordKey, err := serviceRecordKey(APIstub, vin, record.Sequence)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := APIstub.PutState(recordKey, recordAsBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	car.Odometer = mileage
+	car.ServiceCount = record.Sequence
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+// serviceRecordKey returns the key of a service record, zero padded so the records sort in sequence
+func serviceRecordKey(APIstub shim.ChaincodeStubInterface, vin string, sequence int) (string, error) {
+	return APIstub.CreateCompositeKey(serviceIndex, []string{vin, fmt.Sprintf("%010d", sequence)})
+}
+
+// getServiceRecord reads the service record of a car with the given sequence number
+func getServiceRecord(APIstub shim.ChaincodeStubInterface, vin string, sequence int) (ServiceRecord, error) {
+	var record ServiceRecord
+	recordKey, err := serviceRecordKey(APIstub, vin, sequence)
+	if err != nil {
+		return record, err
+	}
+	recordAsBytes, err := APIstub.GetState(recordKey)
+	if err != nil {
+		return record, err
+	}
+	if recordAsBytes == nil {
+		return record, fmt.Errorf("Service record %d of car %s does not exist", sequence, vin)
+	}
+	if err := json.Unmarshal(recordAsBytes, &record); err != nil {
+		return record, fmt.Errorf("Failed to decode service record %d of car %s: %s", sequence, vin, err.Error())
+	}
+	return record, nil
+}
+
+/*
+ * getServiceTimeline returns every service record of a car, in the order they were recorded
+ */
+func (s *SmartContract) getServiceTimeline(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	vin := normalizeVIN(args[0])
+	if _, err := getCar(APIstub, vin); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(serviceIndex, []string{vin})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	timeline := []ServiceRecord{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var record ServiceRecord
+		if err := json.Unmarshal(queryResponse.Value, &record); err != nil {
+			return shim.Error("Failed to decode service record " + queryResponse.Key + ": " + err.Error())
+		}
+		timeline = append(timeline, record)
+	}
+
+	timelineAsBytes, err := json.Marshal(timeline)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(timelineAsBytes)
+}
@@ -0,0 +1,117 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func recordService(t *testing.T, stub *cidtest.Stub, id cidtest.Identity, args ...string) ServiceRecord {
+	var record ServiceRecord
+	if err := json.Unmarshal(stub.CheckInvoke(t, id, append([]string{"recordService", mustangVIN}, args...)...), &record); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestService_Timeline(t *testing.T) {
+	stub := newStub(t)
+
+	first := recordService(t, stub, dealer, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	if first.Sequence != 1 || first.Mileage != 12500 || first.Vin != mustangVIN || first.InstrumentReplaced || first.TxId == "" {
+		t.Fatalf("recordService returned %+v", first)
+	}
+	recordService(t, stub, garage, "2018-09-01", "Quick Fit", "12500", "Tyres")
+	stub.CheckInvokeError(t, dealer, "Odometer rollback: 9000 is lower than the last reading of 12500", "recordService", mustangVIN, "2018-10-01", "Joe's Garage", "9000", "Brakes")
+
+	// an inspector can record a lower reading after the odometer was replaced
+	stub.CheckInvokeError(t, dealer, "Only an inspector can record an instrument replacement", "recordService", mustangVIN, "2018-10-01", "Joe's Garage", "0", "New odometer", "instrumentReplaced")
+	replaced := recordService(t, stub, inspector, "2018-10-01", "Joe's Garage", "0", "New odometer", "instrumentReplaced")
+	if !replaced.InstrumentReplaced || replaced.RecordedBy != identityOf(t, stub, inspector) {
+		t.Fatalf("recordService returned %+v", replaced)
+	}
+
+	if car := checkCar(t, stub, mustangVIN); car.Odometer != 0 || car.ServiceCount != 3 {
+		t.Fatalf("Car has odometer %d and %d services", car.Odometer, car.ServiceCount)
+	}
+	var timeline []ServiceRecord
+	if err := json.Unmarshal(stub.CheckInvoke(t, buyer, "getServiceTimeline", mustangVIN), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	if len(timeline) != 3 || timeline[0].Description != "Oil change" || timeline[1].Garage != "Quick Fit" || timeline[2].Sequence != 3 {
+		t.Fatalf("getServiceTimeline returned %+v", timeline)
+	}
+}
+
+func TestService_Authorization(t *testing.T) {
+	stub := newStub(t)
+
+	// only the owner, a garage or an inspector can record a service
+	stub.CheckInvokeError(t, buyer, "Only the owner of car "+mustangVIN+", a garage or an inspector can record a service", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	notGarage := cidtest.Identity{MSPID: "Org2MSP", CommonName: "notgarage", Attributes: map[string]interface{}{"fabcar.garage": "false"}}
+	stub.CheckInvokeError(t, notGarage, "a garage or an inspector can record a service", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	stub.CheckInvokeError(t, lender, "a garage or an inspector can record a service", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	recordService(t, stub, dealer, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	recordService(t, stub, inspector, "2018-03-02", "Joe's Garage", "12600", "Inspection")
+	if car := checkCar(t, stub, mustangVIN); car.ServiceCount != 2 {
+		t.Fatalf("Car has %d services", car.ServiceCount)
+	}
+
+	// once sold, the previous owner can't record services anymore
+	stub.CheckInvoke(t, dealer, "changeCarOwner", mustangVIN, "Dave", identityOf(t, stub, buyer))
+	stub.CheckInvokeError(t, dealer, "a garage or an inspector can record a service", "recordService", mustangVIN, "2018-04-01", "Joe's Garage", "13000", "Oil change")
+	recordService(t, stub, buyer, "2018-04-01", "Quick Fit", "13000", "Tyres")
+}
+
+func TestService_DateOrder(t *testing.T) {
+	stub := newStub(t)
+
+	recordService(t, stub, dealer, "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	stub.CheckInvokeError(t, garage, "Service date 2018-02-28 is earlier than the previous service on 2018-03-01", "recordService", mustangVIN, "2018-02-28", "Quick Fit", "12600", "Tyres")
+	stub.CheckInvokeError(t, inspector, "is earlier than the previous service", "recordService", mustangVIN, "2017-12-31", "Joe's Garage", "0", "New odometer", "instrumentReplaced")
+	// several services on the same day are fine
+	recordService(t, stub, garage, "2018-03-01", "Quick Fit", "12500", "Tyres")
+	if car := checkCar(t, stub, mustangVIN); car.Odometer != 12500 || car.ServiceCount != 2 {
+		t.Fatalf("Car has odometer %d and %d services", car.Odometer, car.ServiceCount)
+	}
+}
+
+func TestService_Errors(t *testing.T) {
+	stub := newStub(t)
+	tomorrow := time.Now().UTC().Add(48 * time.Hour).Format(serviceDateLayout)
+
+	stub.CheckInvokeError(t, dealer, "Expecting 5 or 6", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "12500")
+	stub.CheckInvokeError(t, dealer, "Argument 3 must be a non-empty string", "recordService", mustangVIN, "2018-03-01", "", "12500", "Oil change")
+	stub.CheckInvokeError(t, dealer, "Car JTDKB20U493000001 does not exist", "recordService", "JTDKB20U493000001", "2018-03-01", "Joe's Garage", "12500", "Oil change")
+	stub.CheckInvokeError(t, dealer, "2nd argument must be a date formatted as YYYY-MM-DD", "recordService", mustangVIN, "01/03/2018", "Joe's Garage", "12500", "Oil change")
+	stub.CheckInvokeError(t, dealer, "is in the future", "recordService", mustangVIN, tomorrow, "Joe's Garage", "12500", "Oil change")
+	stub.CheckInvokeError(t, dealer, "4th argument must be a non-negative number", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "-1", "Oil change")
+	stub.CheckInvokeError(t, dealer, "6th argument must be instrumentReplaced", "recordService", mustangVIN, "2018-03-01", "Joe's Garage", "12500", "Oil change", "yes")
+
+	stub.CheckInvokeError(t, dealer, "Car JTDKB20U493000001 does not exist", "getServiceTimeline", "JTDKB20U493000001")
+	stub.CheckInvokeError(t, dealer, "Expecting 1", "getServiceTimeline")
+	if timeline := stub.CheckInvoke(t, dealer, "getServiceTimeline", mustangVIN); string(timeline) != "[]" {
+		t.Fatalf("getServiceTimeline returned %s for a car without services", timeline)
+	}
+}
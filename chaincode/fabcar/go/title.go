@@ -0,0 +1,331 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/*
+ * Vehicle title
+ *
+ * The owner of a car is the identity that registered it, or that it was transferred to.
+ * Only that identity can transfer the car. A lender, an identity whose certificate has
+ * the fabcar.lender attribute set to true, can place a lien on a car, which blocks
+ * transfers until the same lender releases it. A car that is reported stolen or
+ * scrapped can't be transferred either, see setCarStatus.
+ *
+ * An admin can assign a car to a new owner with assignCarOwner, when the owner lost
+ * their identity or the car has none, such as a car brought in by migrateCars.
+ */
+
+// lenderAttribute is the certificate attribute (with a value of "true") of registered lenders
+const lenderAttribute = "fabcar.lender"
+
+// Lien is a claim of a lender on a car
+type Lien struct {
+	Lender    string `json:"lender"`    // identity of the lender
+	Reference string `json:"reference"` // the lender's reference, e.g. the loan number
+	PlacedAt  string `json:"placedAt"`
+	TxId      string `json:"txId"`
+}
+
+// TitleEntry is one owner in the title history of a car
+type TitleEntry struct {
+	Owner     string `json:"owner"`
+	OwnerId   string `json:"ownerId"`
+	TxId      string `json:"txId"`
+	Timestamp string `json:"timestamp"`
+}
+
+/*
+ * callerIdentity returns the identity of the caller as MSP ID and certificate ID,
+ * the form stored in Car.OwnerId and Lien.Lender
+ */
+func callerIdentity(APIstub shim.ChaincodeStubInterface) (string, error) {
+	mspId, err := cid.GetMSPID(APIstub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the caller's MSP ID: %s", err.Error())
+	}
+	id, err := cid.GetID(APIstub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the caller's ID: %s", err.Error())
+	}
+	return mspId + "/" + id, nil
+}
+
+// txTime returns the transaction timestamp formatted as RFC3339
+func txTime(APIstub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return "", err
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339), nil
+}
+
+// validIdentity reports whether identity has the form callerIdentity returns, MSP ID/ID
+func validIdentity(identity string) bool {
+	parts := strings.SplitN(identity, "/", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+/*
+ * whoAmI returns the caller's identity, which is what the current owner passes to changeCarOwner
+ */
+func (s *SmartContract) whoAmI(APIstub shim.ChaincodeStubInterface) sc.Response {
+	identity, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(identity))
+}
+
+/*
+ * changeCarOwner transfers a car to a new owner. Only the current owner can transfer it,
+ * and not while it has a lien or isn't active.
+ *
+ *   0                    1         2
+ * "1FA6P8TH2J5000002", "Dave", "Org2MSP/eDUwOTo6Q049..."
+ */
+func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[1]) == 0 || len(args[2]) == 0 {
+		return shim.Error("New owner name and identity must be non-empty strings")
+	}
+	if !validIdentity(args[2]) {
+		return shim.Error("Invalid owner identity " + args[2] + ": expecting MSP ID/ID, as returned by whoAmI")
+	}
+
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	caller, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.OwnerId == "" || car.OwnerId != caller {
+		return shim.Error("Only the current owner of car " + vin + " can transfer it")
+	}
+	if args[2] == caller {
+		return shim.Error("Car " + vin + " is already owned by " + caller)
+	}
+	if car.Lien != nil {
+		return shim.Error("Car " + vin + " has a lien from " + car.Lien.Lender + ", it can't be transferred until the lien is released")
+	}
+	if car.Status != carStatusActive {
+		return shim.Error("Car " + vin + " is " + car.Status + ", it can't be transferred")
+	}
+
+	before := car
+	car.Owner = args[1]
+	car.OwnerId = args[2]
+
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := updateCarIndexes(APIstub, vin, &before, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * assignCarOwner makes an identity the owner of a car without the current owner, e.g.
+ * when the owner lost their certificate or the car was migrated without one. Only an
+ * admin can assign an owner, a lien stays on the car.
+ *
+ *   0                    1         2
+ * "1FA6P8TH2J5000002", "Dave", "Org2MSP/eDUwOTo6Q049..."
+ */
+func (s *SmartContract) assignCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if !hasAttribute(APIstub, adminAttribute) {
+		return shim.Error("Only an admin can assign the owner of a car")
+	}
+	if len(args[1]) == 0 || len(args[2]) == 0 {
+		return shim.Error("New owner name and identity must be non-empty strings")
+	}
+	if !validIdentity(args[2]) {
+		return shim.Error("Invalid owner identity " + args[2] + ": expecting MSP ID/ID, as returned by whoAmI")
+	}
+
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Owner == args[1] && car.OwnerId == args[2] {
+		return shim.Error("Car " + vin + " is already owned by " + args[2])
+	}
+
+	before := car
+	car.Owner = args[1]
+	car.OwnerId = args[2]
+
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := updateCarIndexes(APIstub, vin, &before, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * placeLien records a lien of the calling lender on a car. A car has at most one lien.
+ *
+ *   0                    1
+ * "1FA6P8TH2J5000002", "LOAN-2018-0042"
+ */
+func (s *SmartContract) placeLien(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if err := cid.AssertAttributeValue(APIstub, lenderAttribute, "true"); err != nil {
+		return shim.Error("Only registered lenders can place a lien: " + err.Error())
+	}
+	lender, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Lien != nil {
+		return shim.Error("Car " + vin + " already has a lien from " + car.Lien.Lender)
+	}
+
+	placedAt, err := txTime(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	car.Lien = &Lien{Lender: lender, Reference: args[1], PlacedAt: placedAt, TxId: APIstub.GetTxID()}
+
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+ * releaseLien removes the lien from a car, only the lender that placed it can release it
+ */
+func (s *SmartContract) releaseLien(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	lender, err := callerIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	vin := normalizeVIN(args[0])
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Lien == nil {
+		return shim.Error("Car " + vin + " has no lien")
+	}
+	if car.Lien.Lender != lender {
+		return shim.Error("Only the lender that placed the lien on car " + vin + " can release it")
+	}
+
+	car.Lien = nil
+	if err := putCar(APIstub, vin, &car); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+/*
+ * getCarTitleHistory returns the chain of owners of a car, oldest first, with the
+ * transaction that made each of them the owner
+ */
+func (s *SmartContract) getCarTitleHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	vin := normalizeVIN(args[0])
+
+	resultsIterator, err := APIstub.GetHistoryForKey(vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	title := []TitleEntry{}
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if modification.IsDelete {
+			continue
+		}
+		var car Car
+		if err := json.Unmarshal(modification.Value, &car); err != nil {
+			return shim.Error(fmt.Sprintf("Failed to decode car %s in transaction %s: %s", vin, modification.TxId, err.Error()))
+		}
+
+		// only the versions that changed the owner are part of the title
+		if len(title) > 0 {
+			last := title[len(title)-1]
+			if last.Owner == car.Owner && last.OwnerId == car.OwnerId {
+				continue
+			}
+		}
+		timestamp := ""
+		if modification.Timestamp != nil {
+			timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339)
+		}
+		title = append(title, TitleEntry{Owner: car.Owner, OwnerId: car.OwnerId, TxId: modification.TxId, Timestamp: timestamp})
+	}
+
+	titleAsBytes, err := json.Marshal(title)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(titleAsBytes)
+}
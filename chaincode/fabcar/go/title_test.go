@@ -0,0 +1,149 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func TestTitle_ChangeOwner(t *testing.T) {
+	stub := newStub(t)
+	buyerId := identityOf(t, stub, buyer)
+
+	stub.CheckInvokeError(t, buyer, "Only the current owner of car "+mustangVIN+" can transfer it", "changeCarOwner", mustangVIN, "Dave", buyerId)
+	stub.CheckInvoke(t, dealer, "changeCarOwner", mustangVIN, "Dave", buyerId)
+	if car := checkCar(t, stub, mustangVIN); car.Owner != "Dave" || car.OwnerId != buyerId {
+		t.Fatalf("Car is owned by %s (%s)", car.Owner, car.OwnerId)
+	}
+	stub.CheckInvokeError(t, dealer, "Only the current owner", "changeCarOwner", mustangVIN, "Brad", identityOf(t, stub, dealer))
+
+	stub.CheckInvokeError(t, buyer, "Expecting 3", "changeCarOwner", mustangVIN, "Dave")
+	stub.CheckInvokeError(t, buyer, "must be non-empty strings", "changeCarOwner", mustangVIN, "", buyerId)
+	stub.CheckInvokeError(t, buyer, "Car JTDKB20U493000001 does not exist", "changeCarOwner", "JTDKB20U493000001", "Dave", buyerId)
+	for _, identity := range []string{"Dave", "Org2MSP/", "/eDUwOTo6Q049", "Org2MSP"} {
+		stub.CheckInvokeError(t, buyer, "Invalid owner identity "+identity+": expecting MSP ID/ID", "changeCarOwner", mustangVIN, "Brad", identity)
+	}
+	stub.CheckInvokeError(t, buyer, "Car "+mustangVIN+" is already owned by "+buyerId, "changeCarOwner", mustangVIN, "Dave", buyerId)
+}
+
+func TestTitle_AssignOwner(t *testing.T) {
+	stub := newStub(t)
+	buyerId := identityOf(t, stub, buyer)
+
+	stub.CheckInvokeError(t, dealer, "Only an admin can assign the owner of a car", "assignCarOwner", mustangVIN, "Dave", buyerId)
+	stub.CheckInvokeError(t, buyer, "Only an admin", "assignCarOwner", mustangVIN, "Dave", buyerId)
+	stub.CheckInvoke(t, lender, "placeLien", mustangVIN, "LOAN-1")
+
+	// the dealer lost its certificate, the admin gives the car to the buyer, the lien stays
+	stub.CheckInvoke(t, admin, "assignCarOwner", mustangVIN, "Dave", buyerId)
+	if car := checkCar(t, stub, mustangVIN); car.Owner != "Dave" || car.OwnerId != buyerId || car.Lien == nil {
+		t.Fatalf("Car is %+v", car)
+	}
+	if page := queryAllCars(t, stub, "", "", "owner=dave"); page.Count != 1 {
+		t.Fatalf("owner=dave returned %d cars", page.Count)
+	}
+	stub.CheckInvokeError(t, admin, "Car "+mustangVIN+" is already owned by "+buyerId, "assignCarOwner", mustangVIN, "Dave", buyerId)
+
+	stub.CheckInvokeError(t, admin, "Expecting 3", "assignCarOwner", mustangVIN, "Dave")
+	stub.CheckInvokeError(t, admin, "must be non-empty strings", "assignCarOwner", mustangVIN, "Dave", "")
+	stub.CheckInvokeError(t, admin, "Invalid owner identity Dave", "assignCarOwner", mustangVIN, "Dave", "Dave")
+	stub.CheckInvokeError(t, admin, "Car JTDKB20U493000001 does not exist", "assignCarOwner", "JTDKB20U493000001", "Dave", buyerId)
+}
+
+func TestTitle_AssignMigratedCar(t *testing.T) {
+	stub := cidtest.NewStub("fabcar", new(SmartContract))
+	stub.MockTransactionStart("legacy")
+	stub.PutState("CAR0", []byte(`{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`))
+	stub.MockTransactionEnd("legacy")
+	stub.CheckInvoke(t, admin, "migrateCars")
+
+	// nobody can transfer a migrated car until the admin assigns it
+	stub.CheckInvokeError(t, dealer, "Only the current owner of car CAR0", "changeCarOwner", "CAR0", "Dave", identityOf(t, stub, buyer))
+	stub.CheckInvoke(t, admin, "assignCarOwner", "CAR0", "Tomoko", identityOf(t, stub, dealer))
+	stub.CheckInvoke(t, dealer, "changeCarOwner", "CAR0", "Dave", identityOf(t, stub, buyer))
+	if car := checkCar(t, stub, "CAR0"); car.Owner != "Dave" || car.OwnerId != identityOf(t, stub, buyer) {
+		t.Fatalf("Car is %+v", car)
+	}
+}
+
+func TestTitle_Status(t *testing.T) {
+	stub := newStub(t)
+	buyerId := identityOf(t, stub, buyer)
+
+	stub.CheckInvokeError(t, buyer, "Only the owner of car "+mustangVIN+", an inspector or an admin", "setCarStatus", mustangVIN, "stolen")
+	stub.CheckInvoke(t, dealer, "setCarStatus", mustangVIN, "stolen")
+	if car := checkCar(t, stub, mustangVIN); car.Status != carStatusStolen {
+		t.Fatalf("Car is %s", car.Status)
+	}
+	stub.CheckInvokeError(t, dealer, "Car "+mustangVIN+" is stolen, it can't be transferred", "changeCarOwner", mustangVIN, "Dave", buyerId)
+	stub.CheckInvokeError(t, dealer, "is already stolen", "setCarStatus", mustangVIN, "stolen")
+	stub.CheckInvoke(t, dealer, "setCarStatus", mustangVIN, "active")
+
+	// Only an inspector or an admin can scrap a car or restore a scrapped one
+	stub.CheckInvokeError(t, dealer, "Only an inspector or an admin can scrap car "+mustangVIN, "setCarStatus", mustangVIN, "scrapped")
+	stub.CheckInvoke(t, inspector, "setCarStatus", mustangVIN, "scrapped")
+	stub.CheckInvokeError(t, dealer, "is scrapped, it can't be transferred", "changeCarOwner", mustangVIN, "Dave", buyerId)
+	stub.CheckInvokeError(t, dealer, "Only an inspector or an admin can scrap car "+mustangVIN+" or restore it", "setCarStatus", mustangVIN, "active")
+	stub.CheckInvoke(t, admin, "setCarStatus", mustangVIN, "active")
+	stub.CheckInvoke(t, dealer, "changeCarOwner", mustangVIN, "Dave", buyerId)
+
+	stub.CheckInvokeError(t, buyer, "Status must be one of active, stolen or scrapped, got lost", "setCarStatus", mustangVIN, "lost")
+	stub.CheckInvokeError(t, buyer, "Expecting 2", "setCarStatus", mustangVIN)
+	stub.CheckInvokeError(t, buyer, "Car JTDKB20U493000001 does not exist", "setCarStatus", "JTDKB20U493000001", "stolen")
+}
+
+func TestTitle_Lien(t *testing.T) {
+	stub := newStub(t)
+	lenderId := identityOf(t, stub, lender)
+
+	stub.CheckInvokeError(t, dealer, "Only registered lenders can place a lien", "placeLien", mustangVIN, "LOAN-1")
+	stub.CheckInvoke(t, lender, "placeLien", mustangVIN, "LOAN-1")
+	car := checkCar(t, stub, mustangVIN)
+	if car.Lien == nil || car.Lien.Lender != lenderId || car.Lien.Reference != "LOAN-1" || car.Lien.TxId == "" {
+		t.Fatalf("Car has lien %+v", car.Lien)
+	}
+
+	otherLender := inspector
+	otherLender.Attributes = map[string]interface{}{"fabcar.lender": "true"}
+	stub.CheckInvokeError(t, otherLender, "already has a lien from "+lenderId, "placeLien", mustangVIN, "LOAN-2")
+	stub.CheckInvokeError(t, dealer, "it can't be transferred until the lien is released", "changeCarOwner", mustangVIN, "Dave", identityOf(t, stub, buyer))
+	stub.CheckInvokeError(t, otherLender, "Only the lender that placed the lien", "releaseLien", mustangVIN)
+
+	stub.CheckInvoke(t, lender, "releaseLien", mustangVIN)
+	if car := checkCar(t, stub, mustangVIN); car.Lien != nil {
+		t.Fatalf("Car still has lien %+v", car.Lien)
+	}
+	stub.CheckInvokeError(t, lender, "Car "+mustangVIN+" has no lien", "releaseLien", mustangVIN)
+	stub.CheckInvoke(t, dealer, "changeCarOwner", mustangVIN, "Dave", identityOf(t, stub, buyer))
+
+	stub.CheckInvokeError(t, lender, "Expecting 2", "placeLien", mustangVIN)
+	stub.CheckInvokeError(t, lender, "Car JTDKB20U493000001 does not exist", "placeLien", "JTDKB20U493000001", "LOAN-3")
+	stub.CheckInvokeError(t, lender, "Expecting 1", "releaseLien")
+	stub.CheckInvokeError(t, lender, "Car JTDKB20U493000001 does not exist", "releaseLien", "JTDKB20U493000001")
+}
+
+// MockStub has no history database, only the argument check of getCarTitleHistory can be tested
+func TestTitle_History(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvokeError(t, dealer, "Expecting 1", "getCarTitleHistory")
+	stub.CheckInvokeError(t, dealer, "not implemented", "getCarTitleHistory", mustangVIN)
+}
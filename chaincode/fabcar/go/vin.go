@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+ * A VIN (ISO 3779) is 17 characters, letters and digits except I, O and Q.
+ * The 9th character is a check digit computed from the other 16 (as used in North America):
+ * every character is transliterated to a number, weighted by its position and summed,
+ * the remainder of the sum divided by 11 is the check digit, with 10 written as X.
+ */
+var vinRegexp = regexp.MustCompile(`^[A-HJ-NPR-Z0-9]{17}$`)
+
+var vinTransliteration = map[rune]int{
+	'A': 1, 'B': 2, 'C': 3, 'D': 4, 'E': 5, 'F': 6, 'G': 7, 'H': 8,
+	'J': 1, 'K': 2, 'L': 3, 'M': 4, 'N': 5, 'P': 7, 'R': 9,
+	'S': 2, 'T': 3, 'U': 4, 'V': 5, 'W': 6, 'X': 7, 'Y': 8, 'Z': 9,
+}
+
+var vinWeights = []int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// normalizeVIN returns the canonical (trimmed, upper case) form of a VIN, which is also the key of the car
+func normalizeVIN(vin string) string {
+	return strings.ToUpper(strings.TrimSpace(vin))
+}
+
+// vinCheckDigit returns the check digit of a VIN that already matches vinRegexp
+func vinCheckDigit(vin string) byte {
+	sum := 0
+	for i, c := range vin {
+		value, isLetter := vinTransliteration[c]
+		if !isLetter {
+			value = int(c - '0')
+		}
+		sum += value * vinWeights[i]
+	}
+	if sum%11 == 10 {
+		return 'X'
+	}
+	return byte('0' + sum%11)
+}
+
+// validateVIN checks the format and the check digit of a normalized VIN
+func validateVIN(vin string) error {
+	if !vinRegexp.MatchString(vin) {
+		return fmt.Errorf("Invalid VIN %s: expecting 17 letters and digits, without I, O or Q", vin)
+	}
+	if expected := vinCheckDigit(vin); vin[8] != expected {
+		return fmt.Errorf("Invalid VIN %s: check digit is %c, expecting %c", vin, vin[8], expected)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestVIN_Validate(t *testing.T) {
+	for vin, valid := range map[string]bool{
+		"JTDKB20U493000001":  true,
+		"1FA6P8TH2J5000002":  true,
+		"VF3CA5FVXBW000006":  true, // check digit X
+		"JTDKB20U443000001":  false,
+		"JTDKB20U49300000":   false,
+		"JTDKB20U4930000011": false,
+		"JTDKB2OU493000001":  false, // O is not used
+		"jtdkb20u493000001":  false, // normalizeVIN upper cases first
+	} {
+		err := validateVIN(vin)
+		if valid && err != nil {
+			t.Errorf("%s: %s", vin, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s should be invalid", vin)
+		}
+	}
+	if vin := normalizeVIN(" jtdkb20u493000001 "); vin != "JTDKB20U493000001" {
+		t.Fatalf("normalizeVIN returned %q", vin)
+	}
+}
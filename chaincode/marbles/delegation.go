@@ -0,0 +1,358 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ============================================================================================================================
+// Grants - an admin can let another identity call an admin only function on its behalf
+//
+// A grant names the grantee by msp id + cid id, the function, the resource it may be used on (the admin key for
+// admin_write, the marble id for repairMarble, "*" for any) and the time it expires. It can also be limited to a
+// number of uses. Grants are stored under a composite key and indexed by grantee and by grantor, they are
+// checked by assert_admin_or_grant() whenever the caller is not an admin itself.
+// ============================================================================================================================
+const grant_prefix = "grant"                     //composite key namespace for grants, keyed by grant id (tx id)
+const grantee_index = "grant_grantee"            //grantee msp id + grantee id + grant id
+const grantor_index = "grant_grantor"            //grantor msp id + grantor id + grant id
+const any_resource = "*"
+
+var delegable_functions = map[string]bool{"admin_write": true, "repairMarble": true, "reindex_marbles": true}
+
+type Grant struct {
+	ObjectType   string `json:"docType"`        //field for couchdb
+	Id           string `json:"id"`             //tx id of the grant
+	GrantorMspId string `json:"grantorMspId"`
+	GrantorId    string `json:"grantorId"`      //cid id of the admin that gave the grant
+	GranteeMspId string `json:"granteeMspId"`
+	GranteeId    string `json:"granteeId"`      //cid id of the identity that may use it
+	Function     string `json:"function"`
+	Resource     string `json:"resource"`
+	MaxUses      int    `json:"maxUses"`        //0 for no limit
+	Uses         int    `json:"uses"`
+	NotAfter     string `json:"notAfter"`       //RFC 3339, the grant can't be used after this
+	GrantedAt    string `json:"grantedAt"`
+	RevokedAt    string `json:"revokedAt,omitempty"`
+}
+
+func get_grant(stub shim.ChaincodeStubInterface, grant_id string) (Grant, error) {
+	var grant Grant
+	key, err := stub.CreateCompositeKey(grant_prefix, []string{grant_id})
+	if err != nil {
+		return grant, err
+	}
+	grantAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return grant, errors.New("Failed to get grant " + grant_id + " - " + err.Error())
+	}
+	if grantAsBytes == nil {
+		return grant, errors.New("Grant does not exist - " + grant_id)
+	}
+	err = json.Unmarshal(grantAsBytes, &grant)
+	if err != nil {
+		return grant, errors.New("Grant " + grant_id + " is malformed - " + err.Error())
+	}
+	return grant, nil
+}
+
+func put_grant(stub shim.ChaincodeStubInterface, grant Grant) error {
+	key, err := stub.CreateCompositeKey(grant_prefix, []string{grant.Id})
+	if err != nil {
+		return err
+	}
+	grantAsBytes, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, grantAsBytes)
+}
+
+// ========================================================
+// Assert Admin Or Grant - the caller is an admin, or has a grant for this function on this resource
+//
+// Returns the id of the grant that was used, "" for admins. A grant with a use limit is used up here.
+// ========================================================
+func assert_admin_or_grant(stub shim.ChaincodeStubInterface, function string, resource string) (string, error) {
+	admin_err := assert_admin(stub)
+	if admin_err == nil {
+		return "", nil
+	}
+
+	mspId, id, err := get_creator(stub)
+	if err != nil {
+		return "", err
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return "", err
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(grantee_index, []string{mspId, id})
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return "", err
+		}
+		grant, err := get_grant(stub, keyParts[2])
+		if err != nil {
+			return "", err
+		}
+		if grant.Function != function || (grant.Resource != any_resource && grant.Resource != resource) {
+			continue
+		}
+		notAfter, err := time.Parse(time.RFC3339, grant.NotAfter)
+		if err != nil || txTime.After(notAfter) || grant.RevokedAt != "" {
+			continue                                             //expired or revoked
+		}
+		if grant.MaxUses > 0 && grant.Uses >= grant.MaxUses {
+			continue                                             //used up
+		}
+		grant.Uses++
+		err = put_grant(stub, grant)
+		if err != nil {
+			return "", err
+		}
+		fmt.Println("- " + function + " on " + resource + " allowed by grant " + grant.Id)
+		return grant.Id, nil
+	}
+	return "", errors.New(admin_err.Error() + ", and has no grant for " + function + " on " + resource)
+}
+
+// ============================================================================================================================
+// grant_authority() - let another identity call an admin only function on a resource (admin only)
+//
+// Inputs - Array of strings
+//       0      ,       1       ,      2       ,     3     ,    4    ,         5
+//  grantee msp , grantee cid id,   function   ,  resource , max uses,     not after
+//  "Org2MSP"   , "eDUwOTo6Q049..", "admin_write", "delete_retention_days", "3", "2018-12-31T00:00:00Z"
+// ============================================================================================================================
+func grant_authority(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting grant_authority")
+
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments. Expecting 6")
+	}
+
+	// only admins may delegate, and a grant can't be used to give out more grants
+	err := assert_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// input sanitation, the cid id is longer than a normal argument
+	for i, val := range args {
+		if len(val) <= 0 {
+			return shim.Error("Argument " + strconv.Itoa(i) + " must be a non-empty string")
+		}
+	}
+
+	var grant Grant
+	grant.ObjectType = "grant"
+	grant.Id = stub.GetTxID()
+	grant.GranteeMspId = args[0]
+	grant.GranteeId = args[1]
+	grant.Function = args[2]
+	grant.Resource = args[3]
+	if !delegable_functions[grant.Function] {
+		return shim.Error("Function " + grant.Function + " can't be delegated")
+	}
+	grant.MaxUses, err = strconv.Atoi(args[4])
+	if err != nil || grant.MaxUses < 0 {
+		return shim.Error("Max uses must be a non-negative number, 0 for no limit")
+	}
+	grant.GrantorMspId, grant.GrantorId, err = get_creator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if grant.GrantorMspId == grant.GranteeMspId && grant.GrantorId == grant.GranteeId {
+		return shim.Error("An admin can't grant to itself")
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	notAfter, err := time.Parse(time.RFC3339, args[5])
+	if err != nil {
+		return shim.Error("Not after must be an RFC 3339 time - " + err.Error())
+	}
+	if !notAfter.After(txTime) {
+		return shim.Error("Not after must be in the future")
+	}
+	grant.NotAfter = notAfter.UTC().Format(time.RFC3339)
+	grant.GrantedAt = txTime.Format(time.RFC3339)
+
+	// store the grant and its index entries
+	err = put_grant(stub, grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	granteeKey, err := stub.CreateCompositeKey(grantee_index, []string{grant.GranteeMspId, grant.GranteeId, grant.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grantorKey, err := stub.CreateCompositeKey(grantor_index, []string{grant.GrantorMspId, grant.GrantorId, grant.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(granteeKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(grantorKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end grant_authority")
+	return shim.Success([]byte(grant.Id))
+}
+
+// ============================================================================================================================
+// revoke_grant() - end a grant early, by its grantor, its grantee or any admin
+//
+// The grant stays in state with its revocation time so the grantor can still see it, it leaves the grantee index.
+//
+// Inputs - Array of strings
+//      0
+//   grant id
+// ============================================================================================================================
+func revoke_grant(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting revoke_grant")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	grant, err := get_grant(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if grant.RevokedAt != "" {
+		return shim.Error("Grant " + grant.Id + " was already revoked")
+	}
+
+	// check who is revoking
+	mspId, id, err := get_creator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	isGrantor := mspId == grant.GrantorMspId && id == grant.GrantorId
+	isGrantee := mspId == grant.GranteeMspId && id == grant.GranteeId
+	if !isGrantor && !isGrantee {
+		err = assert_admin(stub)
+		if err != nil {
+			return shim.Error("Only the grantor, the grantee or an admin can revoke grant " + grant.Id)
+		}
+	}
+
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	grant.RevokedAt = txTime.Format(time.RFC3339)
+	err = put_grant(stub, grant)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	granteeKey, err := stub.CreateCompositeKey(grantee_index, []string{grant.GranteeMspId, grant.GranteeId, grant.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(granteeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end revoke_grant")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// list_grants() - grants the caller received (default) or gave
+//
+// Inputs - Array of strings
+//         0
+//  "grantee" or "grantor" (optional)
+// ============================================================================================================================
+func list_grants(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting list_grants")
+
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 or 1")
+	}
+	index := grantee_index
+	if len(args) == 1 {
+		if args[0] == "grantor" {
+			index = grantor_index
+		} else if args[0] != "grantee" {
+			return shim.Error("Expecting \"grantee\" or \"grantor\" - " + args[0])
+		}
+	}
+
+	mspId, id, err := get_creator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, []string{mspId, id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	grants := []Grant{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		grant, err := get_grant(stub, keyParts[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		grants = append(grants, grant)
+	}
+
+	grantsAsBytes, _ := json.Marshal(grants)
+	fmt.Println("- end list_grants")
+	return shim.Success(grantsAsBytes)
+}
@@ -0,0 +1,141 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+var operator = cidtest.Identity{MSPID: "Org2MSP", CommonName: "operator"}
+
+func creatorOf(t *testing.T, stub *cidtest.Stub, id cidtest.Identity) (string, string) {
+	if err := stub.SetIdentity(id); err != nil {
+		t.Fatal(err)
+	}
+	mspId, cidId, err := get_creator(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mspId, cidId
+}
+
+// grantTo gives operator a grant from admin and returns its id
+func grantTo(t *testing.T, stub *cidtest.Stub, function, resource, maxUses string) string {
+	mspId, cidId := creatorOf(t, stub, operator)
+	notAfter := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	return string(stub.CheckInvoke(t, admin, "grant_authority", mspId, cidId, function, resource, maxUses, notAfter))
+}
+
+func listGrants(t *testing.T, stub *cidtest.Stub, id cidtest.Identity, role string) []Grant {
+	var grants []Grant
+	if err := json.Unmarshal(stub.CheckInvoke(t, id, "list_grants", role), &grants); err != nil {
+		t.Fatal(err)
+	}
+	return grants
+}
+
+func TestDelegation_AdminWrite(t *testing.T) {
+	stub := newStub(t)
+	grantId := grantTo(t, stub, "admin_write", retention_days_key, "2")
+
+	stub.CheckInvokeError(t, operator, "has no grant for admin_write on abc", "admin_write", "abc", "1")
+	stub.CheckInvoke(t, operator, "admin_write", retention_days_key, "10")
+	stub.CheckInvoke(t, operator, "admin_write", retention_days_key, "20")
+	stub.CheckInvokeError(t, operator, "has no grant for admin_write on "+retention_days_key, "admin_write", retention_days_key, "30")
+
+	var audits []AdminAudit
+	json.Unmarshal(stub.CheckInvoke(t, user, "getAdminAudit", retention_days_key), &audits)
+	if len(audits) != 2 || audits[0].GrantId != grantId || audits[0].MspId != "Org2MSP" {
+		t.Fatalf("getAdminAudit returned %+v", audits)
+	}
+	if grants := listGrants(t, stub, operator, "grantee"); len(grants) != 1 || grants[0].Uses != 2 || grants[0].MaxUses != 2 {
+		t.Fatalf("list_grants returned %+v", grants)
+	}
+}
+
+func TestDelegation_AnyResource(t *testing.T) {
+	stub := newStub(t)
+	putRaw(t, stub, "m009", legacyMarble)
+
+	grantTo(t, stub, "repairMarble", any_resource, "0")
+	grantTo(t, stub, "reindex_marbles", any_resource, "0")
+	stub.CheckInvoke(t, operator, "repairMarble", "m009")
+	stub.CheckInvoke(t, operator, "reindex_marbles")
+	stub.CheckInvoke(t, operator, "reindex_marbles")
+	stub.CheckInvokeError(t, operator, "has no grant for admin_write", "admin_write", "abc", "1")
+}
+
+func TestDelegation_RevokeAndExpire(t *testing.T) {
+	stub := newStub(t)
+
+	grantId := grantTo(t, stub, "admin_write", "abc", "0")
+	stub.CheckInvokeError(t, user, "Only the grantor, the grantee or an admin can revoke grant "+grantId, "revoke_grant", grantId)
+	stub.CheckInvoke(t, operator, "revoke_grant", grantId)
+	stub.CheckInvokeError(t, operator, "was already revoked", "revoke_grant", grantId)
+	stub.CheckInvokeError(t, operator, "has no grant", "admin_write", "abc", "1")
+	if grants := listGrants(t, stub, operator, "grantee"); len(grants) != 0 {
+		t.Fatalf("Revoked grant is still listed for the grantee: %+v", grants)
+	}
+	if grants := listGrants(t, stub, admin, "grantor"); len(grants) != 1 || grants[0].RevokedAt == "" {
+		t.Fatalf("list_grants for the grantor returned %+v", grants)
+	}
+
+	// expired grants can't be used
+	grantId = grantTo(t, stub, "admin_write", "abc", "0")
+	grant, _ := get_grant(stub, grantId)
+	grant.NotAfter = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	grantAsBytes, _ := json.Marshal(grant)
+	key, _ := stub.CreateCompositeKey(grant_prefix, []string{grantId})
+	putRaw(t, stub, key, string(grantAsBytes))
+	stub.CheckInvokeError(t, operator, "has no grant", "admin_write", "abc", "1")
+
+	stub.CheckInvokeError(t, admin, "Grant does not exist - nope", "revoke_grant", "nope")
+	stub.CheckInvokeError(t, admin, "Expecting 1", "revoke_grant")
+}
+
+func TestDelegation_GrantErrors(t *testing.T) {
+	stub := newStub(t)
+	mspId, cidId := creatorOf(t, stub, operator)
+	adminMsp, adminId := creatorOf(t, stub, admin)
+	notAfter := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// grantees can't pass their authority on
+	grantTo(t, stub, "admin_write", "abc", "0")
+	stub.CheckInvokeError(t, operator, "Caller is not a marbles admin", "grant_authority", "Org1MSP", "someone", "admin_write", "abc", "0", notAfter)
+
+	stub.CheckInvokeError(t, admin, "Expecting 6", "grant_authority", mspId, cidId, "admin_write", "abc", "0")
+	stub.CheckInvokeError(t, admin, "Argument 3 must be a non-empty string", "grant_authority", mspId, cidId, "admin_write", "", "0", notAfter)
+	stub.CheckInvokeError(t, admin, "Function init_marble can't be delegated", "grant_authority", mspId, cidId, "init_marble", "abc", "0", notAfter)
+	stub.CheckInvokeError(t, admin, "Max uses must be a non-negative number", "grant_authority", mspId, cidId, "admin_write", "abc", "-1", notAfter)
+	stub.CheckInvokeError(t, admin, "An admin can't grant to itself", "grant_authority", adminMsp, adminId, "admin_write", "abc", "0", notAfter)
+	stub.CheckInvokeError(t, admin, "Not after must be an RFC 3339 time", "grant_authority", mspId, cidId, "admin_write", "abc", "0", "soon")
+	stub.CheckInvokeError(t, admin, "Not after must be in the future", "grant_authority", mspId, cidId, "admin_write", "abc", "0", "2000-01-01T00:00:00Z")
+
+	stub.CheckInvokeError(t, admin, `Expecting "grantee" or "grantor" - owner`, "list_grants", "owner")
+	stub.CheckInvokeError(t, admin, "Expecting 0 or 1", "list_grants", "grantee", "grantor")
+	if grants := stub.CheckInvoke(t, user, "list_grants"); !strings.HasPrefix(string(grants), "[]") {
+		t.Fatalf("list_grants returned %s", grants)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const max_reported_failures = 25 //per check, so a badly broken ledger still gives a readable report
+
+// ----- Health Report ----- //
+type HealthCheck struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Passed      bool     `json:"passed"`
+	Failures    []string `json:"failures,omitempty"`
+	failed      int      //total failures, only the first max_reported_failures are listed
+}
+
+type HealthReport struct {
+	Version   string         `json:"version"`   //semantic version of the chaincode
+	UiVersion string         `json:"uiVersion"` //compatible marbles application version recorded by Init()
+	SelfTest  string         `json:"selftest"`  //value written by Init() on instantiate
+	Marbles   int            `json:"marbles"`   //maintained count of live marbles
+	Owners    int            `json:"owners"`    //maintained count of owners
+	Healthy   bool           `json:"healthy"`   //true if every check passed
+	Checks    []*HealthCheck `json:"checks"`
+}
+
+func (c *HealthCheck) fail(reason string) {
+	c.Passed = false
+	c.failed++
+	if c.failed <= max_reported_failures {
+		c.Failures = append(c.Failures, reason)
+	} else if c.failed == max_reported_failures+1 {
+		c.Failures = append(c.Failures, "... more failures not listed")
+	}
+}
+
+// ============================================================================================================================
+// Health - report versions, counts and the result of the invariant checks
+//
+// The versions and counts are single reads. The invariant checks walk every marble and owner, so this is a
+// query to run now and then (or when something looks off), not on every page load.
+//
+// Inputs - none
+//
+// Returns:
+// {
+//	"version": "4.1.0",
+//	"uiVersion": "4.0.1",
+//	"selftest": "314",
+//	"marbles": 2,
+//	"owners": 1,
+//	"healthy": false,
+//	"checks": [{
+//		"name": "marble_owner_enabled",
+//		"description": "every marble's owner is enabled",
+//		"passed": false,
+//		"failures": ["marble m1490898165086 belongs to disabled owner o99999999"]
+//	}]
+// }
+// ============================================================================================================================
+func health(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var report HealthReport
+	var err error
+	fmt.Println("starting health")
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	// ---- Versions and Counters ---- //
+	report.Version = chaincode_version
+	uiAsBytes, err := stub.GetState("marbles_ui")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.UiVersion = string(uiAsBytes)
+	selfTestAsBytes, err := stub.GetState("selftest")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.SelfTest = string(selfTestAsBytes)
+	report.Marbles, err = get_counter(stub, marbles_counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.Owners, err = get_counter(stub, owners_counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ---- Invariant Checks ---- //
+	ownersDecode := &HealthCheck{Name: "owners_decode", Description: "every owner document is valid JSON", Passed: true}
+	ownerCount := &HealthCheck{Name: "owner_counter", Description: "the owner counter matches the owners in state", Passed: true}
+	marblesDecode := &HealthCheck{Name: "marbles_decode", Description: "every marble document is valid JSON", Passed: true}
+	ownerExists := &HealthCheck{Name: "marble_owner_exists", Description: "every marble's owner exists", Passed: true}
+	ownerEnabled := &HealthCheck{Name: "marble_owner_enabled", Description: "every marble's owner is enabled", Passed: true}
+	ownerRelation := &HealthCheck{Name: "marble_owner_relation", Description: "every marble's username and company match its owner", Passed: true}
+	marbleCount := &HealthCheck{Name: "marble_counter", Description: "the marble counter matches the live marbles in state", Passed: true}
+	report.Checks = []*HealthCheck{ownersDecode, ownerCount, marblesDecode, ownerExists, ownerEnabled, ownerRelation, marbleCount}
+
+	// owners first, the marble checks look them up
+	owners := map[string]Owner{}
+	ownersIterator, err := stub.GetStateByRange("o0", "o9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer ownersIterator.Close()
+	for ownersIterator.HasNext() {
+		aKeyValue, err := ownersIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		owner, err := unmarshal_owner(aKeyValue.Key, aKeyValue.Value)
+		if err != nil {
+			ownersDecode.fail(err.Error())
+		}
+		owners[aKeyValue.Key] = owner //count it either way, it is in state
+	}
+	if len(owners) != report.Owners {
+		ownerCount.fail("counter says " + strconv.Itoa(report.Owners) + ", state has " + strconv.Itoa(len(owners)))
+	}
+
+	liveMarbles := 0
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := unmarshal_marble(aKeyValue.Key, aKeyValue.Value)
+		if err != nil {
+			marblesDecode.fail(err.Error())
+			liveMarbles++ //recount() counts these as live too
+			continue
+		}
+		if marble.Deleted != nil { //soft deleted marbles don't need a live owner
+			continue
+		}
+		liveMarbles++
+
+		owner, found := owners[marble.Owner.Id]
+		if !found {
+			ownerExists.fail("marble " + marble.Id + " belongs to missing owner " + marble.Owner.Id)
+			continue
+		}
+		if !owner.Enabled {
+			ownerEnabled.fail("marble " + marble.Id + " belongs to disabled owner " + marble.Owner.Id)
+		}
+		if owner.Username != marble.Owner.Username || owner.Company != marble.Owner.Company {
+			ownerRelation.fail("marble " + marble.Id + " says '" + marble.Owner.Username + "' of '" + marble.Owner.Company +
+				"', owner " + owner.Id + " is '" + owner.Username + "' of '" + owner.Company + "'")
+		}
+	}
+	if liveMarbles != report.Marbles {
+		marbleCount.fail("counter says " + strconv.Itoa(report.Marbles) + ", state has " + strconv.Itoa(liveMarbles))
+	}
+
+	report.Healthy = true
+	for _, check := range report.Checks {
+		report.Healthy = report.Healthy && check.Passed
+	}
+
+	//change to array of bytes
+	reportAsBytes, _ := json.Marshal(report) //convert to array of bytes
+	fmt.Println("- end health, healthy:", report.Healthy)
+	return shim.Success(reportAsBytes)
+}
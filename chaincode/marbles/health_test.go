@@ -0,0 +1,101 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func checkHealth(t *testing.T, stub *cidtest.Stub) (HealthReport, map[string]*HealthCheck) {
+	var report HealthReport
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "health"), &report); err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]*HealthCheck{}
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	return report, checks
+}
+
+func TestHealth_Healthy(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "delete_marble", "m002", "united marbles")
+
+	report, checks := checkHealth(t, stub)
+	if !report.Healthy || len(checks) != 7 {
+		t.Fatalf("health returned %+v", report)
+	}
+	if report.Version != chaincode_version || report.UiVersion != ui_version || report.SelfTest != "314" || report.Marbles != 1 || report.Owners != 3 {
+		t.Fatalf("health returned %+v", report)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 0", "health", "now")
+}
+
+func TestHealth_Failures(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "disable_owner", "o002", "united marbles")
+	putRaw(t, stub, "m001", `{"docType":"marble","id":"m001","color":"blue","size":35,"owner":{"id":"o001","username":"al","company":"united marbles"}}`)
+	putRaw(t, stub, "m003", `{"docType":"marble","id":"m003","color":"blue","size":35,"owner":{"id":"o009","username":"x","company":"y"}}`)
+	putRaw(t, stub, "m004", `{"id":"m004", "broken`)
+	putRaw(t, stub, "o004", `{"id":"o004", "broken`)
+
+	report, checks := checkHealth(t, stub)
+	if report.Healthy {
+		t.Fatalf("health returned healthy")
+	}
+	for name, failures := range map[string]int{
+		"owners_decode":         1,
+		"owner_counter":         1,
+		"marbles_decode":        1,
+		"marble_owner_exists":   1,
+		"marble_owner_enabled":  1,
+		"marble_owner_relation": 1,
+		"marble_counter":        1,
+	} {
+		if len(checks[name].Failures) != failures || checks[name].Passed {
+			t.Errorf("%s failed with %v", name, checks[name].Failures)
+		}
+	}
+
+	// an admin's init recounts, which fixes the counters only
+	stub.CheckInvoke(t, user, "init", "314")
+	if _, checks = checkHealth(t, stub); checks["owner_counter"].Passed {
+		t.Fatalf("A user's init recounted")
+	}
+	stub.CheckInvoke(t, admin, "init", "314")
+	_, checks = checkHealth(t, stub)
+	if !checks["owner_counter"].Passed || !checks["marble_counter"].Passed {
+		t.Fatalf("Counters still fail after init: %v %v", checks["owner_counter"].Failures, checks["marble_counter"].Failures)
+	}
+}
+
+func TestHealth_FailuresAreCapped(t *testing.T) {
+	check := &HealthCheck{Passed: true}
+	for i := 0; i < max_reported_failures+10; i++ {
+		check.fail("failure")
+	}
+	if check.Passed || len(check.Failures) != max_reported_failures+1 || check.Failures[max_reported_failures] != "... more failures not listed" {
+		t.Fatalf("%d failures listed", len(check.Failures))
+	}
+}
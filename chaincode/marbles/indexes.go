@@ -0,0 +1,207 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Marble Indexes - composite keys that let us find marbles by owner, company, color and size without CouchDB
+//
+// Each index entry is a composite key of index name + indexed value + marble id with a tiny placeholder value,
+// the marble itself is only stored once under its id. Composite keys live outside the normal key space, so
+// they never show up in read_everything() or getMarblesByRange().
+// ============================================================================================================================
+const owner_index = "owner~id"
+const company_index = "company~id"
+const color_index = "color~id"
+const size_index = "size~id"
+
+const default_page_size = 25
+const max_page_size = 100
+
+// ----- Marble Page ----- //
+type MarblePage struct {
+	Marbles  []Marble `json:"marbles"`
+	Count    int      `json:"count"`    //number of marbles in this page
+	Bookmark string   `json:"bookmark"` //pass back in to get the next page, empty when there are no more
+}
+
+// sizes are zero padded so the index sorts numerically
+func size_attribute(size int) string {
+	return fmt.Sprintf("%010d", size)
+}
+
+// ========================================================
+// Marble Index Keys - every index key a marble should have
+// ========================================================
+func marble_index_keys(stub shim.ChaincodeStubInterface, marble Marble) ([]string, error) {
+	entries := [][]string{
+		{owner_index, marble.Owner.Id},
+		{company_index, marble.Owner.Company},
+		{color_index, marble.Color},
+		{size_index, size_attribute(marble.Size)},
+	}
+	var keys []string
+	for _, entry := range entries {
+		key, err := stub.CreateCompositeKey(entry[0], []string{entry[1], marble.Id})
+		if err != nil {
+			return nil, errors.New("Failed to create " + entry[0] + " index key for marble " + marble.Id + " - " + err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ========================================================
+// Index Marble - write every index entry for the marble
+// ========================================================
+func index_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marble_index_keys(stub, marble)
+	if err != nil {
+		return err
+	}
+	value := []byte{0x00} //only the key matters, the value can't be nil
+	for _, key := range keys {
+		err = stub.PutState(key, value)
+		if err != nil {
+			return errors.New("Failed to write index entry for marble " + marble.Id + " - " + err.Error())
+		}
+	}
+	return nil
+}
+
+// ========================================================
+// Unindex Marble - remove every index entry for the marble, call with the marble as it was last stored
+// ========================================================
+func unindex_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	keys, err := marble_index_keys(stub, marble)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return errors.New("Failed to delete index entry for marble " + marble.Id + " - " + err.Error())
+		}
+	}
+	return nil
+}
+
+// ========================================================
+// Parse Page Args - optional page size and bookmark that follow a query's own arguments
+// ========================================================
+func parse_page_args(args []string) (int, string, error) {
+	pageSize := default_page_size
+	bookmark := ""
+	if len(args) > 2 {
+		return 0, "", errors.New("Too many paging arguments. Expecting page size and bookmark")
+	}
+	if len(args) > 0 && len(args[0]) > 0 {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size <= 0 {
+			return 0, "", errors.New("Page size must be a positive number")
+		}
+		if size > max_page_size {
+			size = max_page_size
+		}
+		pageSize = size
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return pageSize, bookmark, nil
+}
+
+// ========================================================
+// Query Marble Index - walk one index and return a page of marbles
+//
+// accept() is called with the index attributes (indexed value, marble id) of each entry, it says if the
+// marble belongs in the result and if the walk can stop because nothing later can match.
+// The bookmark is the last index key returned, base64 encoded so it survives as a plain argument.
+// ========================================================
+func query_marble_index(stub shim.ChaincodeStubInterface, index string, prefix []string, accept func([]string) (bool, bool), pageSize int, bookmark string) (MarblePage, error) {
+	var page MarblePage
+	page.Marbles = []Marble{}
+
+	var after string
+	if len(bookmark) > 0 {
+		decoded, err := base64.StdEncoding.DecodeString(bookmark)
+		if err != nil {
+			return page, errors.New("Invalid bookmark - " + bookmark)
+		}
+		after = string(decoded)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(index, prefix)
+	if err != nil {
+		return page, err
+	}
+	defer resultsIterator.Close()
+
+	lastKey := ""
+	for resultsIterator.HasNext() {
+		indexEntry, err := resultsIterator.Next()
+		if err != nil {
+			return page, err
+		}
+		if len(after) > 0 && indexEntry.Key <= after { //already returned on an earlier page
+			continue
+		}
+		_, attributes, err := stub.SplitCompositeKey(indexEntry.Key)
+		if err != nil {
+			return page, err
+		}
+		include, stop := accept(attributes)
+		if stop {
+			break
+		}
+		if !include {
+			continue
+		}
+		if page.Count == pageSize { //there is at least one more, leave a bookmark
+			page.Bookmark = base64.StdEncoding.EncodeToString([]byte(lastKey))
+			break
+		}
+
+		marbleId := attributes[len(attributes)-1]
+		marble, err := get_marble(stub, marbleId)
+		if err != nil {
+			return page, errors.New("Index " + index + " points at a missing marble - " + err.Error())
+		}
+		page.Marbles = append(page.Marbles, marble)
+		page.Count++
+		lastKey = indexEntry.Key
+	}
+	return page, nil
+}
+
+// ========================================================
+// Accept All - for indexes where the partial key already selects exactly what we want
+// ========================================================
+func accept_all(attributes []string) (bool, bool) {
+	return true, false
+}
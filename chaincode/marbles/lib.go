@@ -20,25 +20,46 @@ under the License.
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"strconv"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
 // ============================================================================================================================
-// Get Marble - get a marble asset from ledger
+// Get Marble - get a live (not deleted) marble asset from ledger
 // ============================================================================================================================
 func get_marble(stub shim.ChaincodeStubInterface, id string) (Marble, error) {
+	marble, err := get_marble_record(stub, id)
+	if err != nil {
+		return marble, err
+	}
+	if marble.Deleted != nil {                               //soft deleted marbles only come back through restore_marble
+		return marble, errors.New("Marble has been deleted - " + id)
+	}
+	return marble, nil
+}
+
+// ============================================================================================================================
+// Get Marble Record - get a marble asset from ledger, even if it is soft deleted
+// ============================================================================================================================
+func get_marble_record(stub shim.ChaincodeStubInterface, id string) (Marble, error) {
 	var marble Marble
 	marbleAsBytes, err := stub.GetState(id)                  //getState retreives a key/value from the ledger
 	if err != nil {                                          //this seems to always succeed, even if key didn't exist
 		return marble, errors.New("Failed to find marble - " + id)
 	}
-	json.Unmarshal(marbleAsBytes, &marble)                   //un stringify it aka JSON.parse()
+	if marbleAsBytes == nil {                                //test if marble is actually here or just nil
+		return marble, errors.New("Marble does not exist - " + id)
+	}
 
-	if marble.Id != id {                                     //test if marble is actually here or just nil
+	marble, err = unmarshal_marble(id, marbleAsBytes)
+	if err != nil {
+		return marble, err
+	}
+	if marble.Id != id {                                     //test if this key really holds a marble
 		return marble, errors.New("Marble does not exist - " + id)
 	}
 
@@ -54,15 +75,32 @@ func get_owner(stub shim.ChaincodeStubInterface, id string) (Owner, error) {
 	if err != nil {                                            //this seems to always succeed, even if key didn't exist
 		return owner, errors.New("Failed to get owner - " + id)
 	}
-	json.Unmarshal(ownerAsBytes, &owner)                       //un stringify it aka JSON.parse()
+	if ownerAsBytes == nil {                                   //test if owner is actually here or just nil
+		return owner, errors.New("Owner does not exist - " + id)
+	}
 
-	if len(owner.Username) == 0 {                              //test if owner is actually here or just nil
+	owner, err = unmarshal_owner(id, ownerAsBytes)
+	if err != nil {
+		return owner, err
+	}
+	if len(owner.Username) == 0 {                              //test if this key really holds an owner
 		return owner, errors.New("Owner does not exist - " + id + ", '" + owner.Username + "' '" + owner.Company + "'")
 	}
 	
 	return owner, nil
 }
 
+// ============================================================================================================================
+// Key Exists - true if anything at all is stored under the key, even a document that no longer decodes
+// ============================================================================================================================
+func key_exists(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	valAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + key + " - " + err.Error())
+	}
+	return valAsBytes != nil, nil
+}
+
 // ========================================================
 // Input Sanitation - dumb input checking, look for empty strings
 // ========================================================
@@ -77,3 +115,188 @@ func sanitize_arguments(strs []string) error{
 	}
 	return nil
 }
+
+
+// ========================================================
+// Assert Admin - the creator's certificate must carry the marbles admin attribute
+// ========================================================
+func assert_admin(stub shim.ChaincodeStubInterface) error {
+	err := cid.AssertAttributeValue(stub, admin_attribute, "true")
+	if err != nil {
+		return errors.New("Caller is not a marbles admin - " + err.Error())
+	}
+	return nil
+}
+
+// ========================================================
+// Get Creator - get the msp id and cid id of the identity that submitted the transaction
+// ========================================================
+func get_creator(stub shim.ChaincodeStubInterface) (string, string, error) {
+	mspId, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", "", errors.New("Failed to get creator msp id - " + err.Error())
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", "", errors.New("Failed to get creator id - " + err.Error())
+	}
+	return mspId, id, nil
+}
+
+// ========================================================
+// Get Tx Time - get the transaction timestamp, this is the same on every endorser (unlike time.Now())
+// ========================================================
+func get_tx_time(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Failed to get transaction timestamp - " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// ========================================================
+// Get Retention - how long a soft deleted marble can still be restored
+// ========================================================
+func get_retention(stub shim.ChaincodeStubInterface) (time.Duration, error) {
+	days := default_retention_days
+	kvKey, err := stub.CreateCompositeKey(admin_kv_prefix, []string{retention_days_key})
+	if err != nil {
+		return 0, err
+	}
+	valAsBytes, err := stub.GetState(kvKey)
+	if err != nil {
+		return 0, errors.New("Failed to get " + retention_days_key + " - " + err.Error())
+	}
+	if valAsBytes != nil {
+		days, err = strconv.Atoi(string(valAsBytes))
+		if err != nil || days < 0 {
+			return 0, errors.New("Admin value " + retention_days_key + " must be a non-negative number of days")
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// ========================================================
+// Counters - running totals kept next to the data so health() never has to scan for them
+//
+// A counter is not one key, every change writes its own delta row keyed by counter name and tx id, and the
+// total is the sum of the rows. Concurrent transactions changing a counter then never read or write the same
+// key, so they don't fail each other's MVCC check (see high-throughput in fabric-samples). prune_counters()
+// collapses the rows into one. A counter written as a single counter~name key by an older version reads as
+// its first row.
+// ========================================================
+const counter_prefix = "counter"                //composite key namespace for the counters, counter~name~txId
+const marbles_counter = "marbles"               //live (not deleted) marbles
+const owners_counter = "owners"                 //every owner, enabled or not
+
+func get_counter(stub shim.ChaincodeStubInterface, name string) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(counter_prefix, []string{name})
+	if err != nil {
+		return 0, errors.New("Failed to get counter " + name + " - " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return 0, errors.New("Failed to get counter " + name + " - " + err.Error())
+		}
+		delta, err := strconv.Atoi(string(aKeyValue.Value))
+		if err != nil {
+			return 0, errors.New("Counter " + name + " has a row that is not a number - " + string(aKeyValue.Value))
+		}
+		count += delta
+	}
+	return count, nil
+}
+
+// set_counter replaces every row of a counter with a single one holding count
+func set_counter(stub shim.ChaincodeStubInterface, name string, count int) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(counter_prefix, []string{name})
+	if err != nil {
+		return errors.New("Failed to set counter " + name + " - " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var rows []string
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return errors.New("Failed to set counter " + name + " - " + err.Error())
+		}
+		rows = append(rows, aKeyValue.Key)
+	}
+	for _, key := range rows {
+		err = stub.DelState(key)
+		if err != nil {
+			return errors.New("Failed to set counter " + name + " - " + err.Error())
+		}
+	}
+	return add_to_counter(stub, name, count)
+}
+
+// add_to_counter writes the delta row of this transaction, a transaction changes a counter at most once
+func add_to_counter(stub shim.ChaincodeStubInterface, name string, delta int) error {
+	key, err := stub.CreateCompositeKey(counter_prefix, []string{name, stub.GetTxID()})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, []byte(strconv.Itoa(delta)))
+	if err != nil {
+		return errors.New("Failed to set counter " + name + " - " + err.Error())
+	}
+	return nil
+}
+
+// prune_counter sums the rows of a counter into one and returns the total
+func prune_counter(stub shim.ChaincodeStubInterface, name string) (int, error) {
+	count, err := get_counter(stub, name)
+	if err != nil {
+		return 0, err
+	}
+	return count, set_counter(stub, name, count)
+}
+
+// ========================================================
+// Recount - set the counters from a full scan, Init() does this so an upgrade starts with the right totals
+// ========================================================
+func recount(stub shim.ChaincodeStubInterface) error {
+	marbles := 0
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		marble, err := unmarshal_marble(aKeyValue.Key, aKeyValue.Value)
+		if err == nil && marble.Deleted != nil {           //malformed marbles still count, they are not deleted
+			continue
+		}
+		marbles++
+	}
+
+	owners := 0
+	ownersIterator, err := stub.GetStateByRange("o0", "o9999999999999999999")
+	if err != nil {
+		return err
+	}
+	defer ownersIterator.Close()
+	for ownersIterator.HasNext() {
+		_, err := ownersIterator.Next()
+		if err != nil {
+			return err
+		}
+		owners++
+	}
+
+	err = set_counter(stub, marbles_counter, marbles)
+	if err != nil {
+		return err
+	}
+	return set_counter(stub, owners_counter, owners)
+}
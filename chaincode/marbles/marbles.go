@@ -31,6 +31,9 @@ import (
 type SimpleChaincode struct {
 }
 
+const chaincode_version = "4.1.0"            //semantic version of this chaincode, reported by health
+const ui_version = "4.0.1"                   //compatible marbles application version, stored as "marbles_ui"
+
 // ============================================================================================================================
 // Asset Definitions - The ledger will store marbles and owners
 // ============================================================================================================================
@@ -42,6 +45,19 @@ type Marble struct {
 	Color      string        `json:"color"`
 	Size       int           `json:"size"`    //size in mm of marble
 	Owner      OwnerRelation `json:"owner"`
+	Deleted    *Tombstone    `json:"deleted,omitempty"` //set while the marble is soft deleted
+}
+
+// ----- Tombstones ----- //
+const default_retention_days = 30                 //how long a deleted marble can be restored, unless the admin value below is set
+const retention_days_key = "delete_retention_days" //admin key/value (see admin_write) that overrides the retention window
+
+type Tombstone struct {
+	Company    string `json:"company"`     //company that authorized the delete, only it may restore
+	MspId      string `json:"mspId"`       //msp of the identity that deleted the marble
+	DeletedBy  string `json:"deletedBy"`   //cid id of the identity that deleted the marble
+	DeletedAt  string `json:"deletedAt"`   //transaction timestamp, RFC 3339
+	TxId       string `json:"txId"`
 }
 
 // ----- Owners ----- //
@@ -59,6 +75,22 @@ type OwnerRelation struct {
 	Company    string `json:"company"`     //this is mostly cosmetic/handy, the real relation is by Id not Company
 }
 
+// ----- Admin Key/Values ----- //
+const admin_attribute = "marbles.admin"      //certificate attribute (value "true") required to use the admin key/value functions
+const admin_kv_prefix = "admin_kv"           //composite key namespace for admin values, can never collide with a marble or owner id
+const admin_audit_prefix = "admin_kv_audit"  //composite key namespace for the audit trail, keyed by admin key + tx id
+
+type AdminAudit struct {
+	ObjectType string `json:"docType"`     //field for couchdb
+	TxId       string `json:"txId"`        //transaction that made the write
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	MspId      string `json:"mspId"`       //msp of the admin that made the write
+	WriterId   string `json:"writerId"`    //cid id of the admin that made the write
+	Timestamp  string `json:"timestamp"`   //transaction timestamp, RFC 3339
+	GrantId    string `json:"grantId,omitempty"` //grant the writer used, when it is not an admin itself
+}
+
 // ============================================================================================================================
 // Main
 // ============================================================================================================================
@@ -85,6 +117,16 @@ func main() {
 // Returns - shim.Success or error
 // ============================================================================================================================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return t.init_marbles(stub, true)
+}
+
+// ============================================================================================================================
+// Init Marbles - the work of Init(), also run by invoking "init" to reset
+//
+// Recounting scans every marble and owner and rewrites the counters, which conflicts with any transaction
+// changing them. Instantiate and upgrade always recount, an "init" invoke only does for a marbles admin.
+// ============================================================================================================================
+func (t *SimpleChaincode) init_marbles(stub shim.ChaincodeStubInterface, recount_counters bool) pb.Response {
 	fmt.Println("Marbles Is Starting Up")
 	funcName, args := stub.GetFunctionAndParameters()
 	var number int
@@ -128,11 +170,21 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("  GetStringArgs() args found:", alt)
 
 	// store compatible marbles application version
-	err = stub.PutState("marbles_ui", []byte("4.0.1"))
+	err = stub.PutState("marbles_ui", []byte(ui_version))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	// (re)count marbles and owners, from here on the counters are kept up to date by every write
+	if recount_counters {
+		err = recount(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		fmt.Println("  Not a marbles admin, the counters are not recounted")
+	}
+
 	fmt.Println("Ready for action")                          //self-test pass
 	return shim.Success(nil)
 }
@@ -148,13 +200,21 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 	// Handle different functions
 	if function == "init" {                    //initialize the chaincode state, used as reset
-		return t.Init(stub)
+		return t.init_marbles(stub, assert_admin(stub) == nil)
 	} else if function == "read" {             //generic read ledger
 		return read(stub, args)
-	} else if function == "write" {            //generic writes to ledger
-		return write(stub, args)
-	} else if function == "delete_marble" {    //deletes a marble from state
+	} else if function == "admin_write" {      //admin only writes to the reserved key/value namespace
+		return admin_write(stub, args)
+	} else if function == "admin_read" {       //read a value from the reserved key/value namespace
+		return admin_read(stub, args)
+	} else if function == "getAdminAudit" {    //read the audit trail of an admin key
+		return getAdminAudit(stub, args)
+	} else if function == "delete_marble" {    //soft deletes a marble, it can be restored for a while
 		return delete_marble(stub, args)
+	} else if function == "restore_marble" {   //undo a soft delete
+		return restore_marble(stub, args)
+	} else if function == "purge_marble" {     //hard delete a soft deleted marble from state
+		return purge_marble(stub, args)
 	} else if function == "init_marble" {      //create a new marble
 		return init_marble(stub, args)
 	} else if function == "set_owner" {        //change owner of a marble
@@ -169,6 +229,28 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return getMarblesByRange(stub, args)
 	} else if function == "disable_owner"{     //disable a marble owner from appearing on the UI
 		return disable_owner(stub, args)
+	} else if function == "repairMarble"{      //rewrite a malformed marble document (admin)
+		return repairMarble(stub, args)
+	} else if function == "reindex_marbles"{   //write index entries for marbles created before the indexes (admin)
+		return reindex_marbles(stub, args)
+	} else if function == "prune_counters"{    //collapse the delta rows of the counters (admin)
+		return prune_counters(stub, args)
+	} else if function == "getMarblesByOwner"{ //page of marbles owned by an owner id
+		return getMarblesByOwner(stub, args)
+	} else if function == "getMarblesByCompany"{ //page of marbles owned by anyone in a company
+		return getMarblesByCompany(stub, args)
+	} else if function == "getMarblesByColor"{ //page of marbles of a color
+		return getMarblesByColor(stub, args)
+	} else if function == "getMarblesBySize"{  //page of marbles with a size in a range
+		return getMarblesBySize(stub, args)
+	} else if function == "health"{            //versions, counts and invariant checks
+		return health(stub, args)
+	} else if function == "grant_authority"{   //let another identity use an admin function (admin)
+		return grant_authority(stub, args)
+	} else if function == "revoke_grant"{      //end a grant early
+		return revoke_grant(stub, args)
+	} else if function == "list_grants"{       //grants the caller received or gave
+		return list_grants(stub, args)
 	}
 
 	// error out
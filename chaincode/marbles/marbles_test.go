@@ -0,0 +1,218 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	user  = cidtest.Identity{MSPID: "Org1MSP", CommonName: "user"}
+	admin = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{"marbles.admin": "true"}}
+)
+
+// newStub returns marbles with owners o001 (alice) and o002 (bob) of united marbles and
+// o003 (carol) of marble inc, and marbles m001 (blue, 35, alice) and m002 (red, 50, bob)
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("marbles", new(SimpleChaincode))
+	if res := stub.InitAs(user, "init", "314"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.CheckInvoke(t, user, "init_owner", "o001", "alice", "united marbles")
+	stub.CheckInvoke(t, user, "init_owner", "o002", "bob", "united marbles")
+	stub.CheckInvoke(t, user, "init_owner", "o003", "carol", "marble inc")
+	stub.CheckInvoke(t, user, "init_marble", "m001", "blue", "35", "o001", "united marbles")
+	stub.CheckInvoke(t, user, "init_marble", "m002", "red", "50", "o002", "united marbles")
+	return stub
+}
+
+func TestMarbles_Init(t *testing.T) {
+	stub := cidtest.NewStub("marbles", new(SimpleChaincode))
+	stub.SetIdentity(user)
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("abc")}); res.Status == shim.OK {
+		t.Fatalf("Init with a non numeric argument should have failed")
+	}
+	if res := stub.MockInit("init", [][]byte{[]byte("init"), []byte("314")}); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	if selftest := stub.CheckInvoke(t, user, "read", "selftest"); string(selftest) != "314" {
+		t.Fatalf("selftest is %s", selftest)
+	}
+	if ui := stub.CheckInvoke(t, user, "read", "marbles_ui"); string(ui) != ui_version {
+		t.Fatalf("marbles_ui is %s", ui)
+	}
+
+	// init through Invoke resets the counters from state, for an admin only
+	putRaw(t, stub, "o001", `{"docType":"marble_owner","id":"o001","username":"alice","company":"united marbles","enabled":true}`)
+	stub.CheckInvoke(t, user, "init")
+	if count, _ := get_counter(stub, owners_counter); count != 0 {
+		t.Fatalf("owners counter is %d after a user init", count)
+	}
+	stub.CheckInvoke(t, admin, "init")
+	if count, _ := get_counter(stub, owners_counter); count != 1 {
+		t.Fatalf("owners counter is %d", count)
+	}
+
+	stub.CheckInvokeError(t, user, "Received unknown invoke function name - 'transfer'", "transfer")
+	res := new(SimpleChaincode).Query(stub)
+	if res.Status == shim.OK {
+		t.Fatalf("Query should fail")
+	}
+}
+
+func TestMarbles_InitOwner(t *testing.T) {
+	stub := newStub(t)
+
+	var owner Owner
+	json.Unmarshal(stub.CheckInvoke(t, user, "read", "o001"), &owner)
+	if owner.Username != "alice" || owner.Company != "united marbles" || !owner.Enabled || owner.ObjectType != "marble_owner" {
+		t.Fatalf("o001 is %+v", owner)
+	}
+
+	stub.CheckInvokeError(t, user, "This owner already exists - o001", "init_owner", "o001", "dave", "united marbles")
+	stub.CheckInvokeError(t, user, "Expecting 3", "init_owner", "o004", "dave")
+	stub.CheckInvokeError(t, user, "Argument 1 must be a non-empty string", "init_owner", "o004", "", "united marbles")
+	stub.CheckInvokeError(t, user, "Argument 2 must be <= 32 characters", "init_owner", "o004", "dave", strings.Repeat("x", 33))
+
+	// usernames and companies with quotes make valid documents
+	stub.CheckInvoke(t, user, "init_owner", "o004", `d"ave\`, `o'reilly "marbles"`)
+	json.Unmarshal(stub.CheckInvoke(t, user, "read", "o004"), &owner)
+	if owner.Username != `d"ave\` || owner.Company != `o'reilly "marbles"` {
+		t.Fatalf("o004 is %+v", owner)
+	}
+}
+
+func TestMarbles_InitMarble(t *testing.T) {
+	stub := newStub(t)
+
+	marble := checkMarble(t, stub, "m001")
+	if marble.Color != "blue" || marble.Size != 35 || marble.Owner != (OwnerRelation{"o001", "alice", "united marbles"}) || marble.ObjectType != "marble" {
+		t.Fatalf("m001 is %+v", marble)
+	}
+
+	stub.CheckInvokeError(t, user, "This marble already exists - m001", "init_marble", "m001", "blue", "35", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "This marble already exists - o001", "init_marble", "o001", "blue", "35", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "Expecting 5", "init_marble", "m003", "blue", "35", "o001")
+	stub.CheckInvokeError(t, user, "3rd argument must be a numeric string", "init_marble", "m003", "blue", "big", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "3rd argument must not be negative", "init_marble", "m003", "blue", "-1", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "Owner does not exist - o009", "init_marble", "m003", "blue", "35", "o009", "united marbles")
+	stub.CheckInvokeError(t, user, "The company 'marble inc' cannot authorize creation for 'united marbles'", "init_marble", "m003", "blue", "35", "o001", "marble inc")
+
+	// a malformed document still blocks the id
+	putRaw(t, stub, "m009", `{"id":"m009", "username":"bo"b"}`)
+	stub.CheckInvokeError(t, user, "This marble already exists - m009", "init_marble", "m009", "blue", "35", "o001", "united marbles")
+}
+
+func TestMarbles_SetOwner(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, user, "set_owner", "m001", "o003", "united marbles")
+	if marble := checkMarble(t, stub, "m001"); marble.Owner != (OwnerRelation{"o003", "carol", "marble inc"}) {
+		t.Fatalf("m001 is owned by %+v", marble.Owner)
+	}
+	stub.CheckInvokeError(t, user, "The company 'united marbles' cannot authorize transfers for 'marble inc'", "set_owner", "m001", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "This owner does not exist - o009", "set_owner", "m001", "o009", "marble inc")
+	stub.CheckInvokeError(t, user, "Marble does not exist - m009", "set_owner", "m009", "o001", "marble inc")
+	stub.CheckInvokeError(t, user, "Expecting 3", "set_owner", "m001", "o001")
+}
+
+func TestMarbles_DisableOwner(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "cannot change another companies marble owner", "disable_owner", "o001", "marble inc")
+	stub.CheckInvoke(t, user, "disable_owner", "o001", "united marbles")
+	var owner Owner
+	json.Unmarshal(stub.CheckInvoke(t, user, "read", "o001"), &owner)
+	if owner.Enabled {
+		t.Fatalf("o001 is still enabled")
+	}
+	stub.CheckInvokeError(t, user, "This owner does not exist - o009", "disable_owner", "o009", "united marbles")
+	stub.CheckInvokeError(t, user, "Expecting 2", "disable_owner", "o001")
+}
+
+func TestMarbles_Read(t *testing.T) {
+	stub := newStub(t)
+
+	if value := stub.CheckInvoke(t, user, "read", "nothing"); value != nil {
+		t.Fatalf("read of a missing key returned %s", value)
+	}
+	stub.CheckInvokeError(t, user, "Expecting key of the var to query", "read")
+	stub.CheckInvokeError(t, user, "Argument 0 must be a non-empty string", "read", "")
+
+	var everything struct {
+		Owners  []Owner  `json:"owners"`
+		Marbles []Marble `json:"marbles"`
+	}
+	stub.CheckInvoke(t, user, "disable_owner", "o003", "marble inc")
+	json.Unmarshal(stub.CheckInvoke(t, user, "read_everything"), &everything)
+	if len(everything.Owners) != 2 || len(everything.Marbles) != 2 || everything.Marbles[0].Id != "m001" {
+		t.Fatalf("read_everything returned %+v", everything)
+	}
+
+	putRaw(t, stub, "m009", `{"id":"m009", "username":"bo"b"}`)
+	stub.CheckInvokeError(t, user, "Failed to decode marble - m009", "read_everything")
+}
+
+func TestMarbles_GetMarblesByRange(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "init_marble", "m003", "green", "10", "o003", "marble inc")
+	stub.CheckInvoke(t, user, "delete_marble", "m002", "united marbles")
+
+	var results []struct {
+		Key    string `json:"Key"`
+		Record Marble `json:"Record"`
+	}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "getMarblesByRange", "m001", "m004"), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Key != "m001" || results[1].Record.Color != "green" {
+		t.Fatalf("getMarblesByRange returned %+v", results)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "getMarblesByRange", "m001")
+}
+
+// MockStub has no history database, only the argument check of getHistory can be tested
+func TestMarbles_GetHistory(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvokeError(t, user, "Expecting 1", "getHistory")
+	stub.CheckInvokeError(t, user, "not implemented", "getHistory", "m001")
+}
+
+// putRaw writes a value the way an older version of the chaincode could have
+func putRaw(t *testing.T, stub *cidtest.Stub, key string, value string) {
+	stub.MockTransactionStart("raw")
+	if err := stub.PutState(key, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	stub.MockTransactionEnd("raw")
+}
+
+func checkMarble(t *testing.T, stub *cidtest.Stub, id string) Marble {
+	var marble Marble
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "read", id), &marble); err != nil {
+		t.Fatal(err)
+	}
+	return marble
+}
@@ -0,0 +1,107 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ============================================================================================================================
+// Marshaling - every marble and owner goes through these functions on its way to and from the ledger
+//
+// The documents are always built with encoding/json from the Go structures, never by hand, so any
+// username or company (quotes, backslashes, etc) produces valid JSON. Decode errors are returned
+// to the caller instead of being dropped.
+// ============================================================================================================================
+
+// ----- Marbles ----- //
+func marshal_marble(marble Marble) ([]byte, error) {
+	marble.ObjectType = "marble"
+	marbleAsBytes, err := json.Marshal(marble) //convert to array of bytes
+	if err != nil {
+		return nil, errors.New("Failed to encode marble - " + marble.Id + " - " + err.Error())
+	}
+	return marbleAsBytes, nil
+}
+
+func unmarshal_marble(key string, marbleAsBytes []byte) (Marble, error) {
+	var marble Marble
+	err := json.Unmarshal(marbleAsBytes, &marble) //un stringify it aka JSON.parse()
+	if err != nil {
+		return marble, errors.New("Failed to decode marble - " + key + " - " + err.Error())
+	}
+	return marble, nil
+}
+
+func put_marble(stub shim.ChaincodeStubInterface, marble Marble) error {
+	marbleAsBytes, err := marshal_marble(marble)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(marble.Id, marbleAsBytes) //store marble with id as key
+}
+
+// ----- Owners ----- //
+func marshal_owner(owner Owner) ([]byte, error) {
+	owner.ObjectType = "marble_owner"
+	ownerAsBytes, err := json.Marshal(owner) //convert to array of bytes
+	if err != nil {
+		return nil, errors.New("Failed to encode owner - " + owner.Id + " - " + err.Error())
+	}
+	return ownerAsBytes, nil
+}
+
+func unmarshal_owner(key string, ownerAsBytes []byte) (Owner, error) {
+	var owner Owner
+	err := json.Unmarshal(ownerAsBytes, &owner) //un stringify it aka JSON.parse()
+	if err != nil {
+		return owner, errors.New("Failed to decode owner - " + key + " - " + err.Error())
+	}
+	return owner, nil
+}
+
+func put_owner(stub shim.ChaincodeStubInterface, owner Owner) error {
+	ownerAsBytes, err := marshal_owner(owner)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(owner.Id, ownerAsBytes) //store owner by its Id
+}
+
+// ============================================================================================================================
+// Recover Legacy Marble - pull the fields out of a marble that init_marble built by string concatenation
+//
+// The old template always wrote color, size and owner id in that order, before the username and company
+// (the fields most likely to have broken the JSON). The owner relation is rebuilt from the owner record
+// by the caller, the real relation is by owner id anyway.
+// ============================================================================================================================
+var legacy_marble_regexp = regexp.MustCompile(`(?s)"color":\s*"(.*?)",\s*"size":\s*(\d+),\s*"owner":\s*\{\s*"id":\s*"(.*?)",\s*"username":`)
+
+func recover_legacy_marble(id string, marbleAsBytes []byte) (color string, size string, ownerId string, err error) {
+	found := legacy_marble_regexp.FindSubmatch(marbleAsBytes)
+	if found == nil {
+		return "", "", "", errors.New("Marble " + id + " is not in the legacy init_marble layout, cannot recover its fields")
+	}
+	return string(found[1]), string(found[2]), string(found[3]), nil
+}
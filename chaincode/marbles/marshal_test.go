@@ -0,0 +1,56 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshal_Quotes(t *testing.T) {
+	stub := newStub(t)
+
+	// usernames and companies with quotes make valid documents
+	stub.CheckInvoke(t, user, "init_owner", "o004", `d"ave\`, `o'reilly "marbles"`)
+	var owner Owner
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "read", "o004"), &owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner.Username != `d"ave\` || owner.Company != `o'reilly "marbles"` || owner.ObjectType != "marble_owner" {
+		t.Fatalf("o004 is %+v", owner)
+	}
+
+	stub.CheckInvoke(t, user, "init_marble", "m003", "green", "10", "o004", `o'reilly "marbles"`)
+	if marble := checkMarble(t, stub, "m003"); marble.Owner != (OwnerRelation{"o004", `d"ave\`, `o'reilly "marbles"`}) || marble.ObjectType != "marble" {
+		t.Fatalf("m003 is %+v", marble)
+	}
+}
+
+func TestMarshal_DecodeErrors(t *testing.T) {
+	stub := newStub(t)
+	putRaw(t, stub, "m009", `{"id":"m009", "username":"bo"b"}`)
+
+	// a malformed document still blocks the id
+	stub.CheckInvokeError(t, user, "This marble already exists - m009", "init_marble", "m009", "blue", "35", "o001", "united marbles")
+	stub.CheckInvokeError(t, user, "This owner already exists - m009", "init_owner", "m009", "dave", "united marbles")
+
+	stub.CheckInvokeError(t, user, "Failed to decode marble - m009", "set_owner", "m009", "o002", "united marbles")
+	stub.CheckInvokeError(t, user, "Failed to decode marble - m009", "read_everything")
+}
@@ -23,6 +23,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -66,6 +68,101 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	return shim.Success(valAsbytes)                  //send it onward
 }
 
+// ============================================================================================================================
+// admin_read() - read a value from the reserved admin key/value namespace
+//
+// Inputs - Array of strings
+//  0
+//  key
+//  "abc"
+//
+// Returns - string
+// ============================================================================================================================
+func admin_read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting admin_read")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting key of the var to query")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	kvKey, err := stub.CreateCompositeKey(admin_kv_prefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	valAsbytes, err := stub.GetState(kvKey)
+	if err != nil {
+		return shim.Error("{\"Error\":\"Failed to get state for " + args[0] + "\"}")
+	}
+
+	fmt.Println("- end admin_read")
+	return shim.Success(valAsbytes)
+}
+
+// ============================================================================================================================
+// Get audit trail of an admin key - every admin_write() that touched the key, ordered by tx id (not by time)
+//
+// Shows Off GetStateByPartialCompositeKey() - reading all keys that share a prefix
+//
+// Inputs - Array of strings
+//  0
+//  key
+//  "abc"
+//
+// Returns:
+// [{
+//	"docType": "admin_kv_audit",
+//	"txId": "f2a3...",
+//	"key": "abc",
+//	"value": "test",
+//	"mspId": "Org1MSP",
+//	"writerId": "eDUwOTo6Q049...",
+//	"timestamp": "2018-07-26T10:00:00Z"
+// }]
+// ============================================================================================================================
+func getAdminAudit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var audits []AdminAudit
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(admin_audit_prefix, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var audit AdminAudit
+		err = json.Unmarshal(aKeyValue.Value, &audit)            //un stringify it aka JSON.parse()
+		if err != nil {
+			return shim.Error("Failed to decode audit entry " + aKeyValue.Key + " - " + err.Error())
+		}
+		audits = append(audits, audit)
+	}
+
+	//change to array of bytes
+	auditsAsBytes, _ := json.Marshal(audits)                     //convert to array of bytes
+	return shim.Success(auditsAsBytes)
+}
+
 // ============================================================================================================================
 // Get everything we need (owners + marbles + companies)
 //
@@ -112,8 +209,13 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		queryKeyAsStr := aKeyValue.Key
 		queryValAsBytes := aKeyValue.Value
 		fmt.Println("on marble id - ", queryKeyAsStr)
-		var marble Marble
-		json.Unmarshal(queryValAsBytes, &marble)                  //un stringify it aka JSON.parse()
+		marble, err := unmarshal_marble(queryKeyAsStr, queryValAsBytes)
+		if err != nil {
+			return shim.Error(err.Error() + " (an admin can fix it with repairMarble)")
+		}
+		if marble.Deleted != nil {                                //soft deleted marbles are not listed
+			continue
+		}
 		everything.Marbles = append(everything.Marbles, marble)   //add this marble to the list
 	}
 	fmt.Println("marble array - ", everything.Marbles)
@@ -133,8 +235,10 @@ func read_everything(stub shim.ChaincodeStubInterface) pb.Response {
 		queryKeyAsStr := aKeyValue.Key
 		queryValAsBytes := aKeyValue.Value
 		fmt.Println("on owner id - ", queryKeyAsStr)
-		var owner Owner
-		json.Unmarshal(queryValAsBytes, &owner)                   //un stringify it aka JSON.parse()
+		owner, err := unmarshal_owner(queryKeyAsStr, queryValAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 
 		if owner.Enabled {                                        //only return enabled owners
 			everything.Owners = append(everything.Owners, owner)  //add this marble to the list
@@ -161,9 +265,9 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	type AuditHistory struct {
 		TxId    string   `json:"txId"`
 		Value   Marble   `json:"value"`
+		Error   string   `json:"error,omitempty"`   //set if this version of the marble does not decode
 	}
 	var history []AuditHistory;
-	var marble Marble
 
 	if len(args) != 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
@@ -187,12 +291,14 @@ func getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 		var tx AuditHistory
 		tx.TxId = historyData.TxId                     //copy transaction id over
-		json.Unmarshal(historyData.Value, &marble)     //un stringify it aka JSON.parse()
 		if historyData.Value == nil {                  //marble has been deleted
 			var emptyMarble Marble
 			tx.Value = emptyMarble                 //copy nil marble
 		} else {
-			json.Unmarshal(historyData.Value, &marble) //un stringify it aka JSON.parse()
+			marble, err := unmarshal_marble(marbleId, historyData.Value)
+			if err != nil {                        //old versions can't be repaired, report it on the entry
+				tx.Error = err.Error()
+			}
 			tx.Value = marble                      //copy marble over
 		}
 		history = append(history, tx)              //add this tx to the list
@@ -241,6 +347,14 @@ func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 		queryResultKey := aKeyValue.Key
 		queryResultValue := aKeyValue.Value
 
+		// skip soft deleted marbles, anything else in the range is returned as is
+		var tombstoned struct {
+			Deleted *Tombstone `json:"deleted"`
+		}
+		if json.Unmarshal(queryResultValue, &tombstoned) == nil && tombstoned.Deleted != nil {
+			continue
+		}
+
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -262,3 +376,132 @@ func getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 
 	return shim.Success(buffer.Bytes())
 }
+
+// ============================================================================================================================
+// Marble Catalogue Queries - pages of marbles found through the composite key indexes (works on LevelDB)
+//
+// Shows Off GetStateByPartialCompositeKey() - reading an index instead of a rich query
+//
+// Every query takes optional page size and bookmark arguments after its own arguments. The page size defaults
+// to 25 and is capped at 100, the bookmark comes from the previous page.
+//
+// Returns:
+// {
+//	"marbles": [{
+//		"docType": "marble",
+//		"id": "m1490898165086",
+//		"color": "white",
+//		"size": 35,
+//		"owner": {
+//			"id": "o99999999",
+//			"username": "alice",
+//			"company": "United Marbles"
+//		}
+//	}],
+//	"count": 1,
+//	"bookmark": ""
+// }
+// ============================================================================================================================
+
+// ----- By Owner ----- //
+// Inputs - Array of strings
+//        0        ,     1     ,     2
+//     owner id    , page size , bookmark
+// "o9999999999999",    "25"   ,    ""
+func getMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return query_marbles_by_value(stub, owner_index, "owner id", args)
+}
+
+// ----- By Company ----- //
+// Inputs - Array of strings
+//        0        ,     1     ,     2
+//     company     , page size , bookmark
+// "united marbles",    "25"   ,    ""
+func getMarblesByCompany(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return query_marbles_by_value(stub, company_index, "company", args)
+}
+
+// ----- By Color ----- //
+// Inputs - Array of strings
+//     0  ,     1     ,     2
+//   color, page size , bookmark
+//  "blue",    "25"   ,    ""
+func getMarblesByColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 0 {
+		args[0] = strings.ToLower(args[0])                       //colors are stored lower case
+	}
+	return query_marbles_by_value(stub, color_index, "color", args)
+}
+
+// ----- By Size Range ----- //
+// Inputs - Array of strings
+//     0   ,   1  ,     2     ,     3
+//  min mm , max mm, page size , bookmark
+//   "10"  , "40" ,    "25"   ,    ""
+func getMarblesBySize(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting getMarblesBySize")
+
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting min size, max size and optionally page size and bookmark")
+	}
+	minSize, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("1st argument must be a numeric string")
+	}
+	maxSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("2nd argument must be a numeric string")
+	}
+	if minSize > maxSize {
+		return shim.Error("Min size must not be larger than max size")
+	}
+	pageSize, bookmark, err := parse_page_args(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the size index is sorted by size, skip until min and stop after max
+	minAttr := size_attribute(minSize)
+	maxAttr := size_attribute(maxSize)
+	inRange := func(attributes []string) (bool, bool) {
+		if attributes[0] > maxAttr {
+			return false, true
+		}
+		return attributes[0] >= minAttr, false
+	}
+
+	page, err := query_marble_index(stub, size_index, []string{}, inRange, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageAsBytes, _ := json.Marshal(page)                         //convert to array of bytes
+	fmt.Println("- end getMarblesBySize, found", page.Count)
+	return shim.Success(pageAsBytes)
+}
+
+// ========================================================
+// Query Marbles By Value - shared body of the single value catalogue queries
+// ========================================================
+func query_marbles_by_value(stub shim.ChaincodeStubInterface, index string, name string, args []string) pb.Response {
+	fmt.Println("starting query on " + index)
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting " + name + " and optionally page size and bookmark")
+	}
+	err := sanitize_arguments(args[:1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageSize, bookmark, err := parse_page_args(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page, err := query_marble_index(stub, index, []string{args[0]}, accept_all, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pageAsBytes, _ := json.Marshal(page)                         //convert to array of bytes
+	fmt.Println("- end query on " + index + ", found", page.Count)
+	return shim.Success(pageAsBytes)
+}
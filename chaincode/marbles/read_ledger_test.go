@@ -0,0 +1,133 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func queryPage(t *testing.T, stub *cidtest.Stub, args ...string) MarblePage {
+	var page MarblePage
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, args...), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != len(page.Marbles) {
+		t.Fatalf("Page counts %d marbles but has %d", page.Count, len(page.Marbles))
+	}
+	return page
+}
+
+func marbleIds(page MarblePage) []string {
+	ids := []string{}
+	for _, marble := range page.Marbles {
+		ids = append(ids, marble.Id)
+	}
+	return ids
+}
+
+// newCatalogueStub adds m003 to m006 to newStub's marbles
+func newCatalogueStub(t *testing.T) *cidtest.Stub {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "init_marble", "m003", "blue", "10", "o003", "marble inc")
+	stub.CheckInvoke(t, user, "init_marble", "m004", "blue", "100", "o001", "united marbles")
+	stub.CheckInvoke(t, user, "init_marble", "m005", "green", "35", "o002", "united marbles")
+	stub.CheckInvoke(t, user, "init_marble", "m006", "blue", "9", "o001", "united marbles")
+	return stub
+}
+
+func TestReadLedger_Catalogue(t *testing.T) {
+	stub := newCatalogueStub(t)
+
+	for _, c := range []struct {
+		args []string
+		ids  string
+	}{
+		{[]string{"getMarblesByOwner", "o001"}, "m001 m004 m006"},
+		{[]string{"getMarblesByOwner", "o009"}, ""},
+		{[]string{"getMarblesByCompany", "united marbles"}, "m001 m002 m004 m005 m006"},
+		{[]string{"getMarblesByColor", "BLUE"}, "m001 m003 m004 m006"},
+		{[]string{"getMarblesBySize", "10", "50"}, "m003 m001 m005 m002"},
+		{[]string{"getMarblesBySize", "0", "9"}, "m006"},
+		{[]string{"getMarblesBySize", "101", "1000"}, ""},
+	} {
+		if ids := fmt.Sprint(marbleIds(queryPage(t, stub, c.args...))); ids != "["+c.ids+"]" {
+			t.Errorf("%v returned %s, expected [%s]", c.args, ids, c.ids)
+		}
+	}
+
+	// the indexes follow transfers and deletes
+	stub.CheckInvoke(t, user, "set_owner", "m001", "o003", "united marbles")
+	stub.CheckInvoke(t, user, "delete_marble", "m004", "united marbles")
+	if ids := fmt.Sprint(marbleIds(queryPage(t, stub, "getMarblesByOwner", "o001"))); ids != "[m006]" {
+		t.Fatalf("getMarblesByOwner o001 returned %s", ids)
+	}
+	if ids := fmt.Sprint(marbleIds(queryPage(t, stub, "getMarblesByCompany", "marble inc"))); ids != "[m001 m003]" {
+		t.Fatalf("getMarblesByCompany marble inc returned %s", ids)
+	}
+}
+
+func TestReadLedger_Paging(t *testing.T) {
+	stub := newCatalogueStub(t)
+
+	page := queryPage(t, stub, "getMarblesByCompany", "united marbles", "2")
+	ids := marbleIds(page)
+	for page.Bookmark != "" {
+		page = queryPage(t, stub, "getMarblesByCompany", "united marbles", "2", page.Bookmark)
+		ids = append(ids, marbleIds(page)...)
+	}
+	if fmt.Sprint(ids) != "[m001 m002 m004 m005 m006]" {
+		t.Fatalf("Paging returned %v", ids)
+	}
+
+	page = queryPage(t, stub, "getMarblesBySize", "0", "100", "3")
+	if fmt.Sprint(marbleIds(page)) != "[m006 m003 m001]" || page.Bookmark == "" {
+		t.Fatalf("First page by size is %v, bookmark %q", marbleIds(page), page.Bookmark)
+	}
+	page = queryPage(t, stub, "getMarblesBySize", "0", "100", "3", page.Bookmark)
+	if fmt.Sprint(marbleIds(page)) != "[m005 m002 m004]" || page.Bookmark != "" {
+		t.Fatalf("Second page by size is %v, bookmark %q", marbleIds(page), page.Bookmark)
+	}
+
+	// page sizes above the maximum are capped
+	if page := queryPage(t, stub, "getMarblesByColor", "blue", "1000"); page.Count != 4 {
+		t.Fatalf("getMarblesByColor returned %d marbles", page.Count)
+	}
+}
+
+func TestReadLedger_CatalogueErrors(t *testing.T) {
+	stub := newCatalogueStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting owner id and optionally page size and bookmark", "getMarblesByOwner")
+	stub.CheckInvokeError(t, user, "Expecting company and optionally page size and bookmark", "getMarblesByCompany", "a", "1", "", "extra")
+	stub.CheckInvokeError(t, user, "Argument 0 must be a non-empty string", "getMarblesByColor", "")
+	stub.CheckInvokeError(t, user, "Page size must be a positive number", "getMarblesByColor", "blue", "0")
+	stub.CheckInvokeError(t, user, "Page size must be a positive number", "getMarblesByColor", "blue", "many")
+	stub.CheckInvokeError(t, user, "Invalid bookmark - !!", "getMarblesByColor", "blue", "1", "!!")
+
+	stub.CheckInvokeError(t, user, "Expecting min size, max size", "getMarblesBySize", "1")
+	stub.CheckInvokeError(t, user, "1st argument must be a numeric string", "getMarblesBySize", "a", "1")
+	stub.CheckInvokeError(t, user, "2nd argument must be a numeric string", "getMarblesBySize", "1", "b")
+	stub.CheckInvokeError(t, user, "Min size must not be larger than max size", "getMarblesBySize", "10", "1")
+	stub.CheckInvokeError(t, user, "Page size must be a positive number", "getMarblesBySize", "1", "10", "-1")
+}
@@ -24,51 +24,107 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 // ============================================================================================================================
-// write() - genric write variable into ledger
-// 
+// admin_write() - write a value into the reserved admin key/value namespace
+//
+// Only identities whose certificate carries the "marbles.admin" attribute with a value of "true" may write,
+// or identities an admin gave a grant for the key with grant_authority().
+// Values are stored under a composite key, so this can never overwrite a marble or owner record.
+// Every write also stores an audit entry with the writer's identity and the transaction id.
+//
 // Shows Off PutState() - writting a key/value into the ledger
+// Shows Off CreateCompositeKey() - keeping a namespace apart from the rest of state
 //
 // Inputs - Array of strings
 //    0   ,    1
 //   key  ,  value
 //  "abc" , "test"
 // ============================================================================================================================
-func write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var key, value string
+func admin_write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	fmt.Println("starting write")
+	fmt.Println("starting admin_write")
 
 	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2. key of the variable and value to set")
 	}
 
-	// input sanitation
-	err = sanitize_arguments(args)
+	// input sanitation, the value may be longer than a normal argument
+	err = sanitize_arguments(args[:1])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if len(args[1]) <= 0 {
+		return shim.Error("Argument 1 must be a non-empty string")
+	}
 
-	key = args[0]                                   //rename for funsies
-	value = args[1]
-	err = stub.PutState(key, []byte(value))         //write the variable into the ledger
+	key := args[0]
+	value := args[1]
+
+	// only admins, or identities an admin granted this key to, may write here
+	grantId, err := assert_admin_or_grant(stub, "admin_write", key)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	fmt.Println("- end write")
+	// who is writing and when
+	mspId, writerId, err := get_creator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// write the value into the reserved namespace
+	kvKey, err := stub.CreateCompositeKey(admin_kv_prefix, []string{key})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(kvKey, []byte(value))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store the audit entry next to it
+	var audit AdminAudit
+	audit.ObjectType = "admin_kv_audit"
+	audit.TxId = stub.GetTxID()
+	audit.Key = key
+	audit.Value = value
+	audit.MspId = mspId
+	audit.WriterId = writerId
+	audit.Timestamp = txTime.Format(time.RFC3339)
+	audit.GrantId = grantId
+
+	auditKey, err := stub.CreateCompositeKey(admin_audit_prefix, []string{key, audit.TxId})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	auditAsBytes, err := json.Marshal(audit)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(auditKey, auditAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end admin_write")
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
-// delete_marble() - remove a marble from state and from marble index
-// 
-// Shows Off DelState() - "removing"" a key/value from the ledger
+// delete_marble() - soft delete a marble, it stays in state with a tombstone and leaves the marble indexes
+//
+// The tombstone records the company, who deleted it and when. The same company can undo it with restore_marble()
+// until the retention window runs out, purge_marble() removes it for good.
 //
 // Inputs - Array of strings
 //      0      ,         1
@@ -103,20 +159,175 @@ func delete_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize deletion for '" + marble.Owner.Company + "'.")
 	}
 
-	// remove the marble
+	// who is deleting it and when
+	mspId, deletedBy, err := get_creator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// tombstone the marble and remove its index entries so it drops out of every listing
+	err = unindex_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marble.Deleted = &Tombstone{
+		Company:   authed_by_company,
+		MspId:     mspId,
+		DeletedBy: deletedBy,
+		DeletedAt: txTime.Format(time.RFC3339),
+		TxId:      stub.GetTxID(),
+	}
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = add_to_counter(stub, marbles_counter, -1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end delete_marble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// restore_marble() - undo a soft delete, only the company that deleted the marble may restore it
+//
+// Inputs - Array of strings
+//      0      ,         1
+//     id      ,  authed_by_company
+// "m999999999", "united marbles"
+// ============================================================================================================================
+func restore_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
+	fmt.Println("starting restore_marble")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id := args[0]
+	authed_by_company := args[1]
+
+	// get the deleted marble
+	marble, err := get_marble_record(stub, id)
+	if err != nil{
+		return shim.Error(err.Error())
+	}
+	if marble.Deleted == nil {
+		return shim.Error("Marble is not deleted - " + id)
+	}
+
+	// check authorizing company
+	if marble.Deleted.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot restore a marble deleted by '" + marble.Deleted.Company + "'.")
+	}
+
+	// check the retention window
+	retention, err := get_retention(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deletedAt, err := time.Parse(time.RFC3339, marble.Deleted.DeletedAt)
+	if err != nil {
+		return shim.Error("Marble " + id + " has a bad deletion time '" + marble.Deleted.DeletedAt + "'")
+	}
+	txTime, err := get_tx_time(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if txTime.After(deletedAt.Add(retention)) {
+		return shim.Error("Marble " + id + " was deleted at " + marble.Deleted.DeletedAt + ", past the retention window of " + retention.String())
+	}
+
+	// the owner may have been removed in the meantime
+	_, err = get_owner(stub, marble.Owner.Id)
+	if err != nil {
+		return shim.Error("Cannot restore marble " + id + " - " + err.Error())
+	}
+
+	// bring it back
+	marble.Deleted = nil
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = add_to_counter(stub, marbles_counter, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end restore_marble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// purge_marble() - hard delete a marble that was already soft deleted, this cannot be undone
+//
+// Shows Off DelState() - "removing"" a key/value from the ledger
+//
+// Inputs - Array of strings
+//      0      ,         1
+//     id      ,  authed_by_company
+// "m999999999", "united marbles"
+// ============================================================================================================================
+func purge_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response) {
+	fmt.Println("starting purge_marble")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	// input sanitation
+	err := sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id := args[0]
+	authed_by_company := args[1]
+
+	// only soft deleted marbles can be purged
+	marble, err := get_marble_record(stub, id)
+	if err != nil{
+		return shim.Error(err.Error())
+	}
+	if marble.Deleted == nil {
+		return shim.Error("Marble " + id + " must be deleted with delete_marble before it can be purged")
+	}
+
+	// check authorizing company
+	if marble.Deleted.Company != authed_by_company {
+		return shim.Error("The company '" + authed_by_company + "' cannot purge a marble deleted by '" + marble.Deleted.Company + "'.")
+	}
+
+	// remove the marble, its index entries went away with the soft delete
 	err = stub.DelState(id)                                                 //remove the key from chaincode state
 	if err != nil {
 		return shim.Error("Failed to delete state")
 	}
 
-	fmt.Println("- end delete_marble")
+	fmt.Println("- end purge_marble")
 	return shim.Success(nil)
 }
 
 // ============================================================================================================================
 // Init Marble - create a new marble, store into chaincode state
 //
-// Shows off building a key's JSON value manually
+// Shows off building key's value from GoLang Structure
 //
 // Inputs - Array of strings
 //      0      ,    1  ,  2  ,      3          ,       4
@@ -145,6 +356,9 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 	if err != nil {
 		return shim.Error("3rd argument must be a numeric string")
 	}
+	if size < 0 {
+		return shim.Error("3rd argument must not be negative")
+	}
 
 	//check if new owner exists
 	owner, err := get_owner(stub, owner_id)
@@ -158,27 +372,33 @@ func init_marble(stub shim.ChaincodeStubInterface, args []string) (pb.Response)
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize creation for '" + owner.Company + "'.")
 	}
 
-	//check if marble id already exists
-	marble, err := get_marble(stub, id)
-	if err == nil {
+	//check if marble id already exists, even a malformed document counts
+	exists, err := key_exists(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
 		fmt.Println("This marble already exists - " + id)
-		fmt.Println(marble)
 		return shim.Error("This marble already exists - " + id)  //all stop a marble by this id exists
 	}
 
-	//build the marble json string manually
-	str := `{
-		"docType":"marble", 
-		"id": "` + id + `", 
-		"color": "` + color + `", 
-		"size": ` + strconv.Itoa(size) + `, 
-		"owner": {
-			"id": "` + owner_id + `", 
-			"username": "` + owner.Username + `", 
-			"company": "` + owner.Company + `"
-		}
-	}`
-	err = stub.PutState(id, []byte(str))                         //store marble with id as key
+	//build the marble
+	var marble Marble
+	marble.Id = id
+	marble.Color = color
+	marble.Size = size
+	marble.Owner.Id = owner_id
+	marble.Owner.Username = owner.Username
+	marble.Owner.Company = owner.Company
+	err = put_marble(stub, marble)                               //store marble with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_marble(stub, marble)                             //make it findable by owner, company, color and size
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = add_to_counter(stub, marbles_counter, 1)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -212,7 +432,6 @@ func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	var owner Owner
-	owner.ObjectType = "marble_owner"
 	owner.Id =  args[0]
 	owner.Username = strings.ToLower(args[1])
 	owner.Company = args[2]
@@ -220,19 +439,25 @@ func init_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	fmt.Println(owner)
 
 	//check if user already exists
-	_, err = get_owner(stub, owner.Id)
-	if err == nil {
+	exists, err := key_exists(stub, owner.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
 		fmt.Println("This owner already exists - " + owner.Id)
 		return shim.Error("This owner already exists - " + owner.Id)
 	}
 
 	//store user
-	ownerAsBytes, _ := json.Marshal(owner)                         //convert to array of bytes
-	err = stub.PutState(owner.Id, ownerAsBytes)                    //store owner by its Id
+	err = put_owner(stub, owner)                                   //store owner by its Id
 	if err != nil {
 		fmt.Println("Could not store user")
 		return shim.Error(err.Error())
 	}
+	err = add_to_counter(stub, owners_counter, 1)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end init_owner marble")
 	return shim.Success(nil)
@@ -279,24 +504,29 @@ func set_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	// get marble's current state
-	marbleAsBytes, err := stub.GetState(marble_id)
+	res, err := get_marble(stub, marble_id)
 	if err != nil {
-		return shim.Error("Failed to get marble")
+		return shim.Error(err.Error())
 	}
-	res := Marble{}
-	json.Unmarshal(marbleAsBytes, &res)           //un stringify it aka JSON.parse()
 
 	// check authorizing company
 	if res.Owner.Company != authed_by_company{
 		return shim.Error("The company '" + authed_by_company + "' cannot authorize transfers for '" + res.Owner.Company + "'.")
 	}
 
-	// transfer the marble
+	// transfer the marble, the owner and company index entries move with it
+	err = unindex_marble(stub, res)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	res.Owner.Id = new_owner_id                   //change the owner
 	res.Owner.Username = owner.Username
 	res.Owner.Company = owner.Company
-	jsonAsBytes, _ := json.Marshal(res)           //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes)     //rewrite the marble with id as key
+	err = put_marble(stub, res)                   //rewrite the marble with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_marble(stub, res)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -345,12 +575,177 @@ func disable_owner(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 	// disable the owner
 	owner.Enabled = false
-	jsonAsBytes, _ := json.Marshal(owner)         //convert to array of bytes
-	err = stub.PutState(args[0], jsonAsBytes)     //rewrite the owner
+	err = put_owner(stub, owner)                  //rewrite the owner
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	fmt.Println("- end disable_owner")
 	return shim.Success(nil)
-}
\ No newline at end of file
+}
+
+// ============================================================================================================================
+// Repair Marble - rewrite a marble whose stored document is not valid JSON (admin only)
+//
+// Marbles created before init_marble used encoding/json could hold broken documents, for example a username
+// with a quote in it. The color, size and owner id are recovered from the legacy layout and the owner
+// relation is rebuilt from the owner record. The result is stored through the canonical marshaling.
+//
+// Inputs - Array of Strings
+//       0
+//   marble id
+// "m999999999"
+// ============================================================================================================================
+func repairMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting repairMarble")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	// input sanitation
+	err = sanitize_arguments(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id := args[0]
+
+	// only admins, or identities an admin granted this marble to, may repair
+	_, err = assert_admin_or_grant(stub, "repairMarble", id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return shim.Error("Failed to get marble - " + id)
+	}
+	if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist - " + id)
+	}
+
+	// nothing to do if it already decodes
+	_, err = unmarshal_marble(id, marbleAsBytes)
+	if err == nil {
+		return shim.Error("Marble " + id + " is not malformed, nothing to repair")
+	}
+
+	// pull what we can out of the broken document
+	color, sizeStr, owner_id, err := recover_legacy_marble(id, marbleAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil {
+		return shim.Error("Marble " + id + " has a non numeric size '" + sizeStr + "'")
+	}
+	owner, err := get_owner(stub, owner_id)
+	if err != nil {
+		return shim.Error("Cannot repair marble " + id + " - " + err.Error())
+	}
+
+	// rebuild and store it canonically
+	var marble Marble
+	marble.Id = id
+	marble.Color = strings.ToLower(color)
+	marble.Size = size
+	marble.Owner.Id = owner.Id
+	marble.Owner.Username = owner.Username
+	marble.Owner.Company = owner.Company
+	err = put_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = index_marble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end repairMarble")
+	return shim.Success(nil)
+}
+
+// ============================================================================================================================
+// Reindex Marbles - write the index entries of every marble (admin only)
+//
+// Marbles created before the owner/company/color/size indexes existed have no entries, run this once after
+// upgrading. Writing an entry that already exists is harmless.
+//
+// Inputs - none
+// ============================================================================================================================
+func reindex_marbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting reindex_marbles")
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	// only admins, or identities an admin granted reindexing to, may reindex
+	_, err := assert_admin_or_grant(stub, "reindex_marbles", any_resource)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, err := stub.GetStateByRange("m0", "m9999999999999999999")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marble, err := unmarshal_marble(aKeyValue.Key, aKeyValue.Value)
+		if err != nil {
+			return shim.Error(err.Error() + " (an admin can fix it with repairMarble)")
+		}
+		if marble.Deleted != nil {                                   //deleted marbles stay out of the indexes
+			continue
+		}
+		err = index_marble(stub, marble)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		count++
+	}
+
+	fmt.Println("- end reindex_marbles, indexed", count)
+	return shim.Success([]byte(strconv.Itoa(count)))
+}
+
+// ============================================================================================================================
+// Prune Counters - sum the delta rows of each counter into a single row (admin only)
+//
+// Every marble or owner change adds a row to a counter, run this when the ledger is quiet so reading the
+// counters stays cheap. It conflicts with transactions changing the counters at the same time, these fail
+// and can be resubmitted.
+//
+// Inputs - none
+// ============================================================================================================================
+func prune_counters(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting prune_counters")
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+	err := assert_admin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marbles, err := prune_counter(stub, marbles_counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owners, err := prune_counter(stub, owners_counter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end prune_counters, marbles", marbles, "owners", owners)
+	return shim.Success(nil)
+}
@@ -0,0 +1,269 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+// backdateDelete moves the deletion time of a soft deleted marble into the past
+func backdateDelete(t *testing.T, stub *cidtest.Stub, id string, age time.Duration) {
+	marble, err := get_marble_record(stub, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marble.Deleted.DeletedAt = time.Now().UTC().Add(-age).Format(time.RFC3339)
+	marbleAsBytes, _ := marshal_marble(marble)
+	putRaw(t, stub, id, string(marbleAsBytes))
+}
+
+func TestWriteLedger_DeleteAndRestore(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "The company 'marble inc' cannot authorize deletion for 'united marbles'", "delete_marble", "m001", "marble inc")
+	stub.CheckInvoke(t, user, "delete_marble", "m001", "united marbles")
+
+	marble, _ := get_marble_record(stub, "m001")
+	if marble.Deleted == nil || marble.Deleted.Company != "united marbles" || marble.Deleted.MspId != "Org1MSP" || marble.Deleted.TxId == "" {
+		t.Fatalf("m001 has tombstone %+v", marble.Deleted)
+	}
+	stub.CheckInvokeError(t, user, "Marble has been deleted - m001", "set_owner", "m001", "o002", "united marbles")
+	stub.CheckInvokeError(t, user, "Marble has been deleted - m001", "delete_marble", "m001", "united marbles")
+	if count, _ := get_counter(stub, marbles_counter); count != 1 {
+		t.Fatalf("marbles counter is %d", count)
+	}
+
+	// deleted marbles are left out of the listings
+	var everything struct {
+		Marbles []Marble `json:"marbles"`
+	}
+	json.Unmarshal(stub.CheckInvoke(t, user, "read_everything"), &everything)
+	if len(everything.Marbles) != 1 || everything.Marbles[0].Id != "m002" {
+		t.Fatalf("read_everything returned %+v", everything.Marbles)
+	}
+	var results []struct {
+		Key string `json:"Key"`
+	}
+	json.Unmarshal(stub.CheckInvoke(t, user, "getMarblesByRange", "m001", "m002"), &results)
+	if len(results) != 1 || results[0].Key != "m002" {
+		t.Fatalf("getMarblesByRange returned %+v", results)
+	}
+
+	stub.CheckInvokeError(t, user, "The company 'marble inc' cannot restore a marble deleted by 'united marbles'", "restore_marble", "m001", "marble inc")
+	stub.CheckInvoke(t, user, "restore_marble", "m001", "united marbles")
+	if marble := checkMarble(t, stub, "m001"); marble.Deleted != nil || marble.Color != "blue" {
+		t.Fatalf("m001 is %+v", marble)
+	}
+	if count, _ := get_counter(stub, marbles_counter); count != 2 {
+		t.Fatalf("marbles counter is %d", count)
+	}
+	stub.CheckInvokeError(t, user, "Marble is not deleted - m001", "restore_marble", "m001", "united marbles")
+
+	stub.CheckInvokeError(t, user, "Marble does not exist - m009", "delete_marble", "m009", "united marbles")
+	stub.CheckInvokeError(t, user, "Marble does not exist - m009", "restore_marble", "m009", "united marbles")
+	stub.CheckInvokeError(t, user, "Expecting 2", "delete_marble", "m001")
+	stub.CheckInvokeError(t, user, "Expecting 2", "restore_marble", "m001")
+}
+
+func TestWriteLedger_Retention(t *testing.T) {
+	stub := newStub(t)
+
+	// past the default window of 30 days
+	stub.CheckInvoke(t, user, "delete_marble", "m001", "united marbles")
+	backdateDelete(t, stub, "m001", 31*24*time.Hour)
+	stub.CheckInvokeError(t, user, "past the retention window of 720h0m0s", "restore_marble", "m001", "united marbles")
+
+	// an admin can widen the window
+	stub.CheckInvoke(t, admin, "admin_write", retention_days_key, "60")
+	stub.CheckInvoke(t, user, "restore_marble", "m001", "united marbles")
+
+	stub.CheckInvoke(t, admin, "admin_write", retention_days_key, "forever")
+	stub.CheckInvoke(t, user, "delete_marble", "m002", "united marbles")
+	stub.CheckInvokeError(t, user, "must be a non-negative number of days", "restore_marble", "m002", "united marbles")
+}
+
+func TestWriteLedger_RestoreWithoutOwner(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "delete_marble", "m001", "united marbles")
+	putRaw(t, stub, "o001", `{"docType":"marble_owner","id":"o001"}`)
+	stub.CheckInvokeError(t, user, "Cannot restore marble m001 - Owner does not exist - o001", "restore_marble", "m001", "united marbles")
+}
+
+func TestWriteLedger_Purge(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "must be deleted with delete_marble before it can be purged", "purge_marble", "m001", "united marbles")
+	stub.CheckInvoke(t, user, "delete_marble", "m001", "united marbles")
+	stub.CheckInvokeError(t, user, "The company 'marble inc' cannot purge a marble deleted by 'united marbles'", "purge_marble", "m001", "marble inc")
+	stub.CheckInvoke(t, user, "purge_marble", "m001", "united marbles")
+	if value := stub.CheckInvoke(t, user, "read", "m001"); value != nil {
+		t.Fatalf("m001 is still in state: %s", value)
+	}
+	stub.CheckInvokeError(t, user, "Marble does not exist - m001", "purge_marble", "m001", "united marbles")
+	stub.CheckInvokeError(t, user, "Expecting 2", "purge_marble", "m001")
+}
+
+func TestWriteLedger_AdminWrite(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Caller is not a marbles admin", "admin_write", "abc", "test")
+	stub.CheckInvoke(t, admin, "admin_write", "abc", "test")
+	stub.CheckInvoke(t, admin, "admin_write", "abc", "test 2")
+	if value := stub.CheckInvoke(t, user, "admin_read", "abc"); string(value) != "test 2" {
+		t.Fatalf("admin_read returned %s", value)
+	}
+	// the admin namespace never collides with plain keys
+	if value := stub.CheckInvoke(t, user, "read", "abc"); value != nil {
+		t.Fatalf("read returned %s", value)
+	}
+
+	var audits []AdminAudit
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "getAdminAudit", "abc"), &audits); err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 2 || audits[0].Key != "abc" || audits[0].MspId != "Org1MSP" || audits[0].WriterId == "" || audits[0].TxId == audits[1].TxId {
+		t.Fatalf("getAdminAudit returned %+v", audits)
+	}
+	values := map[string]bool{audits[0].Value: true, audits[1].Value: true}
+	if !values["test"] || !values["test 2"] {
+		t.Fatalf("getAdminAudit returned values %v", values)
+	}
+
+	stub.CheckInvokeError(t, admin, "Expecting 2", "admin_write", "abc")
+	stub.CheckInvokeError(t, admin, "Argument 1 must be a non-empty string", "admin_write", "abc", "")
+	stub.CheckInvokeError(t, user, "Expecting key of the var to query", "admin_read")
+	stub.CheckInvokeError(t, user, "Expecting 1", "getAdminAudit")
+
+	// the generic write is gone
+	stub.CheckInvokeError(t, admin, "Received unknown invoke function name - 'write'", "write", "m001", "{}")
+}
+
+const legacyMarble = `{"docType":"marble", "id": "m009", "color": "Blue", "size": 16, "owner": {"id": "o001", "username": "al"ice", "company": "united marbles"}}`
+
+func TestWriteLedger_RepairMarble(t *testing.T) {
+	stub := newStub(t)
+	putRaw(t, stub, "m009", legacyMarble)
+
+	stub.CheckInvokeError(t, user, "Caller is not a marbles admin", "repairMarble", "m009")
+	stub.CheckInvoke(t, admin, "repairMarble", "m009")
+	if marble := checkMarble(t, stub, "m009"); marble.Color != "blue" || marble.Size != 16 || marble.Owner != (OwnerRelation{"o001", "alice", "united marbles"}) {
+		t.Fatalf("m009 is %+v", marble)
+	}
+	stub.CheckInvokeError(t, admin, "Marble m009 is not malformed, nothing to repair", "repairMarble", "m009")
+
+	putRaw(t, stub, "m010", `{"id": "m010", "broken`)
+	stub.CheckInvokeError(t, admin, "is not in the legacy init_marble layout", "repairMarble", "m010")
+	putRaw(t, stub, "m011", `{"docType":"marble", "id": "m011", "color": "red", "size": 16, "owner": {"id": "o009", "username": "x"y"}}`)
+	stub.CheckInvokeError(t, admin, "Cannot repair marble m011 - Owner does not exist - o009", "repairMarble", "m011")
+	stub.CheckInvokeError(t, admin, "Marble does not exist - m012", "repairMarble", "m012")
+	stub.CheckInvokeError(t, admin, "Expecting 1", "repairMarble")
+}
+
+func TestWriteLedger_Reindex(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "delete_marble", "m002", "united marbles")
+
+	// drop the index entries of m001, as if it predated the indexes
+	marble := checkMarble(t, stub, "m001")
+	stub.MockTransactionStart("unindex")
+	unindex_marble(stub, marble)
+	stub.MockTransactionEnd("unindex")
+	if page := queryPage(t, stub, "getMarblesByColor", "blue"); page.Count != 0 {
+		t.Fatalf("m001 is still indexed")
+	}
+
+	stub.CheckInvokeError(t, user, "Caller is not a marbles admin", "reindex_marbles")
+	if count := stub.CheckInvoke(t, admin, "reindex_marbles"); string(count) != "1" {
+		t.Fatalf("reindex_marbles indexed %s marbles", count)
+	}
+	if page := queryPage(t, stub, "getMarblesByColor", "blue"); page.Count != 1 {
+		t.Fatalf("m001 is not indexed")
+	}
+	if page := queryPage(t, stub, "getMarblesByColor", "red"); page.Count != 0 {
+		t.Fatalf("Deleted m002 was indexed")
+	}
+
+	putRaw(t, stub, "m009", legacyMarble)
+	stub.CheckInvokeError(t, admin, "an admin can fix it with repairMarble", "reindex_marbles")
+	stub.CheckInvokeError(t, admin, "Expecting 0", "reindex_marbles", "all")
+}
+
+// counterRows returns the delta rows of a counter
+func counterRows(t *testing.T, stub *cidtest.Stub, name string) map[string]string {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(counter_prefix, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resultsIterator.Close()
+	rows := map[string]string{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows[aKeyValue.Key] = string(aKeyValue.Value)
+	}
+	return rows
+}
+
+func TestWriteLedger_CounterRows(t *testing.T) {
+	stub := newStub(t)
+
+	// Init's recount plus one row per marble created, none of them read by the writes
+	if rows := counterRows(t, stub, marbles_counter); len(rows) != 3 {
+		t.Fatalf("marbles counter has rows %v", rows)
+	}
+	stub.CheckInvoke(t, user, "delete_marble", "m001", "united marbles")
+	if count, _ := get_counter(stub, marbles_counter); count != 1 {
+		t.Fatalf("marbles counter is %d", count)
+	}
+
+	// a counter from an older version, kept under a single key, is added in
+	legacyKey, _ := stub.CreateCompositeKey(counter_prefix, []string{marbles_counter})
+	putRaw(t, stub, legacyKey, "5")
+	if count, _ := get_counter(stub, marbles_counter); count != 6 {
+		t.Fatalf("marbles counter is %d with the legacy key", count)
+	}
+
+	stub.CheckInvokeError(t, user, "Caller is not a marbles admin", "prune_counters")
+	stub.CheckInvokeError(t, admin, "Expecting 0", "prune_counters", "now")
+	stub.CheckInvoke(t, admin, "prune_counters")
+	if rows := counterRows(t, stub, marbles_counter); len(rows) != 1 {
+		t.Fatalf("marbles counter has rows %v after pruning", rows)
+	}
+	if rows := counterRows(t, stub, owners_counter); len(rows) != 1 {
+		t.Fatalf("owners counter has rows %v after pruning", rows)
+	}
+	marbles, _ := get_counter(stub, marbles_counter)
+	owners, _ := get_counter(stub, owners_counter)
+	if marbles != 6 || owners != 3 {
+		t.Fatalf("counters are %d marbles and %d owners after pruning", marbles, owners)
+	}
+
+	// and it keeps counting
+	stub.CheckInvoke(t, user, "restore_marble", "m001", "united marbles")
+	if count, _ := get_counter(stub, marbles_counter); count != 7 {
+		t.Fatalf("marbles counter is %d", count)
+	}
+}
@@ -25,6 +25,8 @@ under the License.
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColorBatch","blue","jerry","100",""]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColorBatch","blue","jerry","100","","true"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
 
 // ==== Query marbles ====
@@ -33,8 +35,10 @@ under the License.
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"marble\",\"owner\":\"tom\"}}"]}'
+
+// Owner Query (Uses a rich query on CouchDB and the owner~name index on LevelDB):
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
 
 // INDEXES TO SUPPORT COUCHDB RICH QUERIES
 //
@@ -152,18 +156,26 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.transferMarble(stub, args)
 	} else if function == "transferMarblesBasedOnColor" { //transfer all marbles of a certain color
 		return t.transferMarblesBasedOnColor(stub, args)
+	} else if function == "transferMarblesBasedOnColorBatch" { //transfer up to N marbles of a certain color, resumable
+		return t.transferMarblesBasedOnColorBatch(stub, args)
 	} else if function == "delete" { //delete a marble
 		return t.delete(stub, args)
 	} else if function == "readMarble" { //read a marble
 		return t.readMarble(stub, args)
-	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query
+	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query or the owner~name index
 		return t.queryMarblesByOwner(stub, args)
 	} else if function == "queryMarbles" { //find marbles based on an ad hoc rich query
 		return t.queryMarbles(stub, args)
+	} else if function == "listIndexes" { //list the packaged CouchDB indexes
+		return t.listIndexes(stub, args)
 	} else if function == "getHistoryForMarble" { //get history of values for a marble
 		return t.getHistoryForMarble(stub, args)
 	} else if function == "getMarblesByRange" { //get marbles based on range query
 		return t.getMarblesByRange(stub, args)
+	} else if function == "verifyIndexes" { //report inconsistent index entries (admin)
+		return t.verifyIndexes(stub, args)
+	} else if function == "rebuildIndexes" { //repair inconsistent index entries (admin)
+		return t.rebuildIndexes(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -235,15 +247,11 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	//  The key is a composite key, with the elements that you want to range query on listed first.
 	//  In our case, the composite key is based on indexName~color~name.
 	//  This will enable very efficient state range queries based on composite keys matching indexName~color~*
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marble.Color, marble.Name})
+	//  See marbleIndexes in indexes.go for every index that is kept.
+	err = updateMarbleIndexes(stub, nil, marble)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
-	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
 
 	// ==== Marble saved and indexed. Return success ====
 	fmt.Println("- end init marble")
@@ -306,18 +314,11 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
 
-	// maintain the index
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
+	// maintain the indexes
+	err = updateMarbleIndexes(stub, &marbleJSON, nil)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	//  Delete index entry to state.
-	err = stub.DelState(colorNameIndexKey)
-	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
-	}
 	return shim.Success(nil)
 }
 
@@ -348,14 +349,24 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	marbleBefore := marbleToTransfer
 	marbleToTransfer.Owner = newOwner //change the owner
 
-	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
+	marbleJSONasBytes, err := json.Marshal(marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
+	// maintain the indexes
+	err = updateMarbleIndexes(stub, &marbleBefore, &marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	fmt.Println("- end transferMarble (success)")
 	return shim.Success(nil)
 }
@@ -425,6 +436,8 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 // between endorsement time and commit time. The transaction is invalidated by the
 // committing peers if the result set has changed between endorsement time and commit time.
 // Therefore, range queries are a safe option for performing update transactions based on query results.
+// Every marble of the color is transferred in one transaction; for large numbers of marbles use
+// transferMarblesBasedOnColorBatch so the read/write set stays small enough to endorse.
 // ===========================================================================================
 func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
@@ -478,6 +491,136 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	return shim.Success([]byte(responsePayload))
 }
 
+// maxBatchSize caps the batch size a client may ask transferMarblesBasedOnColorBatch for
+const maxBatchSize = 500
+
+// batchTransfer is one marble examined by transferMarblesBasedOnColorBatch
+type batchTransfer struct {
+	Name   string `json:"name"`
+	From   string `json:"from,omitempty"`
+	Reason string `json:"reason,omitempty"` // why the marble was skipped
+}
+
+// batchTransferResult is returned by transferMarblesBasedOnColorBatch
+type batchTransferResult struct {
+	Color        string          `json:"color"`
+	NewOwner     string          `json:"newOwner"`
+	DryRun       bool            `json:"dryRun"`
+	Moved        []batchTransfer `json:"moved"`        // transferred, or would be in a dry run
+	Skipped      []batchTransfer `json:"skipped"`      // left alone, with the reason
+	Continuation string          `json:"continuation"` // pass back in to carry on, empty when done
+}
+
+// ==== Example: bounded GetStateByPartialCompositeKey =======================================
+// transferMarblesBasedOnColorBatch transfers at most maxCount marbles of a color per call.
+// Every marble examined counts toward maxCount, whether it is moved or skipped, so the
+// read/write set of one transaction stays bounded. When more marbles remain the result
+// carries a continuation token (the last marble name examined) to pass to the next call.
+// With dryRun set to "true" nothing is written and the result lists which marbles would
+// move and why the others would be skipped.
+// ===========================================================================================
+func (t *SimpleChaincode) transferMarblesBasedOnColorBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1       2          3             4
+	// "color", "bob", "100", "continuation", "dryRun"
+	if len(args) < 3 || len(args) > 5 {
+		return shim.Error("Incorrect number of arguments. Expecting color, new owner, max count and optionally continuation and dry run")
+	}
+
+	color := strings.ToLower(args[0])
+	newOwner := strings.ToLower(args[1])
+	if len(newOwner) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	maxCount, err := strconv.Atoi(args[2])
+	if err != nil || maxCount <= 0 || maxCount > maxBatchSize {
+		return shim.Error(fmt.Sprintf("3rd argument must be a number between 1 and %d", maxBatchSize))
+	}
+	continuation := ""
+	if len(args) > 3 {
+		continuation = args[3]
+	}
+	dryRun := false
+	if len(args) > 4 {
+		dryRun, err = strconv.ParseBool(args[4])
+		if err != nil {
+			return shim.Error("5th argument must be true or false")
+		}
+	}
+	fmt.Println("- start transferMarblesBasedOnColorBatch ", color, newOwner, maxCount, continuation, dryRun)
+
+	result := batchTransferResult{Color: color, NewOwner: newOwner, DryRun: dryRun, Moved: []batchTransfer{}, Skipped: []batchTransfer{}}
+
+	coloredMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey("color~name", []string{color})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer coloredMarbleResultsIterator.Close()
+
+	examined := 0
+	lastName := ""
+	for coloredMarbleResultsIterator.HasNext() {
+		responseRange, err := coloredMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		marbleName := compositeKeyParts[1]
+
+		// the index is sorted by name, so everything up to the token was handled by an earlier call
+		if continuation != "" && marbleName <= continuation {
+			continue
+		}
+		if examined == maxCount {
+			result.Continuation = lastName
+			break
+		}
+		examined++
+		lastName = marbleName
+
+		marbleAsBytes, err := stub.GetState(marbleName)
+		if err != nil {
+			return shim.Error("Failed to get marble:" + err.Error())
+		} else if marbleAsBytes == nil {
+			result.Skipped = append(result.Skipped, batchTransfer{Name: marbleName, Reason: "marble does not exist, the index entry is orphaned"})
+			continue
+		}
+		marbleToTransfer := marble{}
+		err = json.Unmarshal(marbleAsBytes, &marbleToTransfer)
+		if err != nil {
+			result.Skipped = append(result.Skipped, batchTransfer{Name: marbleName, Reason: "marble does not decode: " + err.Error()})
+			continue
+		}
+		if marbleToTransfer.Color != color {
+			result.Skipped = append(result.Skipped, batchTransfer{Name: marbleName, From: marbleToTransfer.Owner, Reason: "marble is " + marbleToTransfer.Color + ", the index entry is stale"})
+			continue
+		}
+		if marbleToTransfer.Owner == newOwner {
+			result.Skipped = append(result.Skipped, batchTransfer{Name: marbleName, From: marbleToTransfer.Owner, Reason: "already owned by " + newOwner})
+			continue
+		}
+
+		if !dryRun {
+			response := t.transferMarble(stub, []string{marbleName, newOwner})
+			// if the transfer failed return error, nothing of this batch is committed
+			if response.Status != shim.OK {
+				return shim.Error("Transfer failed: " + response.Message)
+			}
+		}
+		result.Moved = append(result.Moved, batchTransfer{Name: marbleName, From: marbleToTransfer.Owner})
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end transferMarblesBasedOnColorBatch:\n%s\n", resultAsBytes)
+	return shim.Success(resultAsBytes)
+}
+
 // =======Rich queries =========================================================================
 // Two examples of rich queries are provided below (parameterized query and ad hoc query).
 // Rich queries pass a query string to the state database.
@@ -495,7 +638,9 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 // queryMarblesByOwner queries for marbles based on a passed in owner.
 // This is an example of a parameterized query where the query logic is baked into the chaincode,
 // and accepting a single query parameter (owner).
-// Only available on state databases that support rich query (e.g. CouchDB)
+// State databases without rich query (e.g. LevelDB) reject the query; the marbles are then
+// read through the owner~name index instead, and returned in the same JSON. Any other
+// query error is returned as is.
 // =========================================================================================
 func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
@@ -510,15 +655,85 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil && richQueryUnsupported(err) {
+		fmt.Printf("- queryMarblesByOwner rich query unavailable (%s), using owner~name index\n", err)
+		queryResults, err = getQueryResultForOwnerIndex(stub, owner)
+	}
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
+// leveldbQueryError is what GetQueryResult fails with on a peer using LevelDB
+const leveldbQueryError = "ExecuteQuery not supported for leveldb"
+
+// richQueryUnsupported reports whether a query failed only because the state
+// database has no rich queries. Other failures, such as a CouchDB error or a
+// bad query, must not be hidden by answering from the index instead.
+func richQueryUnsupported(err error) bool {
+	return strings.Contains(err.Error(), leveldbQueryError)
+}
+
+// =========================================================================================
+// getQueryResultForOwnerIndex returns the marbles of an owner found through the owner~name
+// index, as the same JSON array of {"Key", "Record"} that getQueryResultForQueryString builds.
+// =========================================================================================
+func getQueryResultForOwnerIndex(stub shim.ChaincodeStubInterface, owner string) ([]byte, error) {
+
+	ownerMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey("owner~name", []string{owner})
+	if err != nil {
+		return nil, err
+	}
+	defer ownerMarbleResultsIterator.Close()
+
+	// buffer is a JSON array containing QueryRecords
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for ownerMarbleResultsIterator.HasNext() {
+		responseRange, err := ownerMarbleResultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		marbleName := compositeKeyParts[1]
+		marbleAsBytes, err := stub.GetState(marbleName)
+		if err != nil {
+			return nil, err
+		} else if marbleAsBytes == nil {
+			return nil, fmt.Errorf("owner~name index entry points to missing marble %s, run verifyIndexes", marbleName)
+		}
+
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(marbleName)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		// Record is a JSON object, so we write as-is
+		buffer.WriteString(string(marbleAsBytes))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- getQueryResultForOwnerIndex queryResult:\n%s\n", buffer.String())
+
+	return buffer.Bytes(), nil
+}
+
 // ===== Example: Ad hoc rich query ========================================================
 // queryMarbles uses a query string to perform a query for marbles.
-// Query string matching state database syntax is passed in and executed as is.
+// Query string matching state database syntax is checked by guardQuery before it is executed.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
 // Only available on state databases that support rich query (e.g. CouchDB)
@@ -531,7 +746,14 @@ func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	queryString := args[0]
+	guard, err := callerQueryGuard(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryString, err := guardQuery(guard, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
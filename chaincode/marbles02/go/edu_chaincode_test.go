@@ -0,0 +1,362 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var (
+	user  = cidtest.Identity{MSPID: "Org1MSP", CommonName: "user"}
+	admin = cidtest.Identity{MSPID: "Org1MSP", CommonName: "admin", Attributes: map[string]interface{}{adminAttribute: "true"}}
+)
+
+// putRaw writes a value without going through the chaincode, so without index entries
+func putRaw(t *testing.T, stub *cidtest.Stub, key string, value string) {
+	stub.MockTransactionStart("raw")
+	if err := stub.PutState(key, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	stub.MockTransactionEnd("raw")
+}
+
+func checkMarble(t *testing.T, stub *cidtest.Stub, name string) marble {
+	var m marble
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "readMarble", name), &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// queryRecord is one element of the JSON arrays the query functions return
+type queryRecord struct {
+	Key    string
+	Record marble
+}
+
+func queryRecords(t *testing.T, payload []byte) []queryRecord {
+	var records []queryRecord
+	if err := json.Unmarshal(payload, &records); err != nil {
+		t.Fatalf("%s: %s", err, payload)
+	}
+	return records
+}
+
+func recordKeys(records []queryRecord) string {
+	keys := make([]string, len(records))
+	for i, record := range records {
+		keys[i] = record.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+// newStub returns marbles marble1 (blue, 35, tom), marble2 (red, 50, tom) and marble3 (blue, 70, jerry)
+func newStub(t *testing.T) *cidtest.Stub {
+	stub := cidtest.NewStub("marbles02", new(SimpleChaincode))
+	if res := stub.InitAs(user, "init"); res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	stub.CheckInvoke(t, user, "initMarble", "marble1", "blue", "35", "tom")
+	stub.CheckInvoke(t, user, "initMarble", "marble2", "Red", "50", "Tom")
+	stub.CheckInvoke(t, user, "initMarble", "marble3", "blue", "70", "jerry")
+	return stub
+}
+
+func TestEdu_InitMarble(t *testing.T) {
+	stub := newStub(t)
+
+	if m := checkMarble(t, stub, "marble2"); m != (marble{"marble", "marble2", "red", 50, "tom"}) {
+		t.Fatalf("marble2 is %+v", m)
+	}
+	stub.CheckInvokeError(t, user, "This marble already exists: marble1", "initMarble", "marble1", "green", "10", "tom")
+	stub.CheckInvokeError(t, user, "Expecting 4", "initMarble", "marble4", "green", "10")
+	stub.CheckInvokeError(t, user, "1st argument", "initMarble", "", "green", "10", "tom")
+	stub.CheckInvokeError(t, user, "2nd argument", "initMarble", "marble4", "", "10", "tom")
+	stub.CheckInvokeError(t, user, "3rd argument must be a non-empty", "initMarble", "marble4", "green", "", "tom")
+	stub.CheckInvokeError(t, user, "4th argument", "initMarble", "marble4", "green", "10", "")
+	stub.CheckInvokeError(t, user, "3rd argument must be a numeric string", "initMarble", "marble4", "green", "ten", "tom")
+	stub.CheckInvokeError(t, user, "Received unknown function invocation", "initMarbles")
+}
+
+func TestEdu_ReadAndDelete(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting name of the marble", "readMarble")
+	stub.CheckInvokeError(t, user, "Marble does not exist: marble9", "readMarble", "marble9")
+
+	stub.CheckInvoke(t, user, "delete", "marble1")
+	stub.CheckInvokeError(t, user, "Marble does not exist: marble1", "readMarble", "marble1")
+	stub.CheckInvokeError(t, user, "Marble does not exist: marble1", "delete", "marble1")
+	stub.CheckInvokeError(t, user, "Expecting 1", "delete")
+
+	putRaw(t, stub, "broken", "{")
+	stub.CheckInvokeError(t, user, "Failed to decode JSON of: broken", "delete", "broken")
+
+	// the deleted marble's index entries went with it
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "tom")); recordKeys(records) != "marble2" {
+		t.Fatalf("tom owns %s", recordKeys(records))
+	}
+	result := batchTransferResult{}
+	json.Unmarshal(stub.CheckInvoke(t, user, "transferMarblesBasedOnColorBatch", "blue", "jerry", "10", "", "true"), &result)
+	if len(result.Moved)+len(result.Skipped) != 1 {
+		t.Fatalf("blue marbles after delete: %+v", result)
+	}
+}
+
+func TestEdu_TransferMarble(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvoke(t, user, "transferMarble", "marble1", "Jerry")
+	if m := checkMarble(t, stub, "marble1"); m.Owner != "jerry" {
+		t.Fatalf("marble1 is owned by %s", m.Owner)
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "jerry")); recordKeys(records) != "marble1,marble3" {
+		t.Fatalf("jerry owns %s", recordKeys(records))
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "tom")); recordKeys(records) != "marble2" {
+		t.Fatalf("tom owns %s", recordKeys(records))
+	}
+
+	stub.CheckInvokeError(t, user, "Expecting 2", "transferMarble", "marble1")
+	stub.CheckInvokeError(t, user, "Marble does not exist", "transferMarble", "marble9", "tom")
+	putRaw(t, stub, "broken", "{")
+	stub.CheckInvokeError(t, user, "unexpected end of JSON input", "transferMarble", "broken", "tom")
+}
+
+func TestEdu_TransferMarblesBasedOnColor(t *testing.T) {
+	stub := newStub(t)
+
+	if payload := stub.CheckInvoke(t, user, "transferMarblesBasedOnColor", "blue", "Jerry"); string(payload) != "Transferred 2 blue marbles to jerry" {
+		t.Fatalf("transferMarblesBasedOnColor returned %s", payload)
+	}
+	for _, name := range []string{"marble1", "marble3"} {
+		if m := checkMarble(t, stub, name); m.Owner != "jerry" {
+			t.Fatalf("%s is owned by %s", name, m.Owner)
+		}
+	}
+	if m := checkMarble(t, stub, "marble2"); m.Owner != "tom" {
+		t.Fatalf("marble2 is owned by %s", m.Owner)
+	}
+	if payload := stub.CheckInvoke(t, user, "transferMarblesBasedOnColor", "green", "tom"); string(payload) != "Transferred 0 green marbles to tom" {
+		t.Fatalf("transferMarblesBasedOnColor returned %s", payload)
+	}
+
+	stub.CheckInvokeError(t, user, "Expecting 2", "transferMarblesBasedOnColor", "blue")
+
+	// an index entry left behind by a marble that is gone fails the whole transfer
+	stub.MockTransactionStart("raw")
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble0", "blue", 1, "tom"})
+	stub.MockTransactionEnd("raw")
+	stub.CheckInvokeError(t, user, "Transfer failed: Marble does not exist", "transferMarblesBasedOnColor", "blue", "tom")
+}
+
+func TestEdu_QueryMarblesByOwner(t *testing.T) {
+	stub := newStub(t)
+
+	// MockStub has no rich query, so the owner~name index answers
+	records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "TOM"))
+	if recordKeys(records) != "marble1,marble2" {
+		t.Fatalf("tom owns %s", recordKeys(records))
+	}
+	if records[0].Record != (marble{"marble", "marble1", "blue", 35, "tom"}) {
+		t.Fatalf("marble1 is %+v", records[0].Record)
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "nobody")); len(records) != 0 {
+		t.Fatalf("nobody owns %s", recordKeys(records))
+	}
+
+	// an owner change moves the marble between index entries
+	stub.CheckInvoke(t, user, "transferMarble", "marble1", "jerry")
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "jerry")); recordKeys(records) != "marble1,marble3" {
+		t.Fatalf("jerry owns %s", recordKeys(records))
+	}
+	stub.CheckInvoke(t, user, "delete", "marble2")
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "tom")); len(records) != 0 {
+		t.Fatalf("tom owns %s", recordKeys(records))
+	}
+
+	stub.CheckInvokeError(t, user, "Expecting 1", "queryMarblesByOwner")
+
+	stub.MockTransactionStart("raw")
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble0", "blue", 1, "tom"})
+	stub.MockTransactionEnd("raw")
+	stub.CheckInvokeError(t, user, "owner~name index entry points to missing marble marble0", "queryMarblesByOwner", "tom")
+}
+
+func TestEdu_TransferMarblesBasedOnColorBatch(t *testing.T) {
+	stub := newStub(t)
+	for i := 4; i <= 7; i++ {
+		stub.CheckInvoke(t, user, "initMarble", fmt.Sprintf("marble%d", i), "blue", "10", "tom")
+	}
+
+	transfer := func(args ...string) batchTransferResult {
+		result := batchTransferResult{}
+		payload := stub.CheckInvoke(t, user, append([]string{"transferMarblesBasedOnColorBatch"}, args...)...)
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	names := func(transfers []batchTransfer) string {
+		n := make([]string, len(transfers))
+		for i, transfer := range transfers {
+			n[i] = transfer.Name
+		}
+		return strings.Join(n, ",")
+	}
+
+	// a dry run reports without writing
+	result := transfer("Blue", "jerry", "3", "", "true")
+	if !result.DryRun || names(result.Moved) != "marble1,marble4" || names(result.Skipped) != "marble3" || result.Continuation != "marble4" {
+		t.Fatalf("dry run returned %+v", result)
+	}
+	if result.Skipped[0].Reason != "already owned by jerry" {
+		t.Fatalf("marble3 skipped because %s", result.Skipped[0].Reason)
+	}
+	if m := checkMarble(t, stub, "marble1"); m.Owner != "tom" {
+		t.Fatalf("dry run transferred marble1 to %s", m.Owner)
+	}
+
+	// batches carry on from the continuation until it is empty
+	result = transfer("blue", "jerry", "3")
+	if names(result.Moved) != "marble1,marble4" || result.Continuation != "marble4" {
+		t.Fatalf("first batch returned %+v", result)
+	}
+	result = transfer("blue", "jerry", "3", result.Continuation)
+	if names(result.Moved) != "marble5,marble6,marble7" || result.Continuation != "" {
+		t.Fatalf("second batch returned %+v", result)
+	}
+	for i := 1; i <= 7; i++ {
+		name := fmt.Sprintf("marble%d", i)
+		if m := checkMarble(t, stub, name); m.Color == "blue" && m.Owner != "jerry" {
+			t.Fatalf("%s is owned by %s", name, m.Owner)
+		}
+	}
+
+	// orphaned, undecodable and stale index entries are skipped with the reason
+	stub.MockTransactionStart("raw")
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble0", "blue", 1, "tom"})
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble8", "blue", 1, "tom"})
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble9", "blue", 1, "tom"})
+	stub.PutState("marble8", []byte("{"))
+	stub.MockTransactionEnd("raw")
+	stub.CheckInvoke(t, user, "initMarble", "marble9", "green", "1", "tom")
+	result = transfer("blue", "tom", "100", "marble7")
+	if len(result.Moved) != 0 || names(result.Skipped) != "marble8,marble9" {
+		t.Fatalf("batch after marble7 returned %+v", result)
+	}
+	if !strings.HasPrefix(result.Skipped[0].Reason, "marble does not decode") || result.Skipped[1].Reason != "marble is green, the index entry is stale" {
+		t.Fatalf("skipped %+v", result.Skipped)
+	}
+	result = transfer("blue", "tom", "1")
+	if names(result.Skipped) != "marble0" || result.Skipped[0].Reason != "marble does not exist, the index entry is orphaned" || result.Continuation != "marble0" {
+		t.Fatalf("batch from the start returned %+v", result)
+	}
+
+	stub.CheckInvokeError(t, user, "Expecting color, new owner, max count", "transferMarblesBasedOnColorBatch", "blue", "tom")
+	stub.CheckInvokeError(t, user, "Expecting color, new owner, max count", "transferMarblesBasedOnColorBatch", "blue", "tom", "1", "", "true", "x")
+	stub.CheckInvokeError(t, user, "2nd argument must be a non-empty string", "transferMarblesBasedOnColorBatch", "blue", "", "1")
+	for _, maxCount := range []string{"0", "501", "many"} {
+		stub.CheckInvokeError(t, user, "3rd argument must be a number between 1 and 500", "transferMarblesBasedOnColorBatch", "blue", "tom", maxCount)
+	}
+	stub.CheckInvokeError(t, user, "5th argument must be true or false", "transferMarblesBasedOnColorBatch", "blue", "tom", "1", "", "maybe")
+}
+
+// TestEdu_BatchesTransferEveryMarbleOnce checks that, whatever the batch size, following the
+// continuation moves each marble of the color exactly once and leaves the other colors alone
+func TestEdu_BatchesTransferEveryMarbleOnce(t *testing.T) {
+	property := func(colors []bool, batchSize uint8) bool {
+		stub := newStub(t)
+		blue := 2 // marble1 and marble3 of newStub
+		for i, isBlue := range colors {
+			color := "red"
+			if isBlue {
+				color = "blue"
+				blue++
+			}
+			stub.CheckInvoke(t, user, "initMarble", fmt.Sprintf("bulk%03d", i), color, "1", "tom")
+		}
+
+		maxCount := fmt.Sprint(int(batchSize)%10 + 1)
+		moved := map[string]int{}
+		continuation := ""
+		for {
+			result := batchTransferResult{}
+			payload := stub.CheckInvoke(t, user, "transferMarblesBasedOnColorBatch", "blue", "ann", maxCount, continuation)
+			if err := json.Unmarshal(payload, &result); err != nil {
+				t.Fatal(err)
+			}
+			for _, transfer := range result.Moved {
+				moved[transfer.Name]++
+			}
+			if result.Continuation == "" {
+				break
+			}
+			continuation = result.Continuation
+		}
+		if len(moved) != blue {
+			return false
+		}
+		for _, count := range moved {
+			if count != 1 {
+				return false
+			}
+		}
+		owned := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "ann"))
+		for _, record := range owned {
+			if record.Record.Color != "blue" {
+				return false
+			}
+		}
+		return len(owned) == blue
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 20}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEdu_GetMarblesByRange(t *testing.T) {
+	stub := newStub(t)
+
+	// the end key is exclusive on a peer but not in MockStub, so end on a key that doesn't exist
+	records := queryRecords(t, stub.CheckInvoke(t, user, "getMarblesByRange", "marble2", "marble4"))
+	if recordKeys(records) != "marble2,marble3" {
+		t.Fatalf("range marble2-marble4 returned %s", recordKeys(records))
+	}
+	if records[0].Record.Color != "red" {
+		t.Fatalf("marble2 is %+v", records[0].Record)
+	}
+	stub.CheckInvokeError(t, user, "Expecting 2", "getMarblesByRange", "marble1")
+}
+
+func TestEdu_GetHistoryForMarble(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting 1", "getHistoryForMarble")
+	// MockStub keeps no history
+	stub.CheckInvokeError(t, user, "not implemented", "getHistoryForMarble", "marble1")
+}
@@ -0,0 +1,112 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+)
+
+func checkIndexReport(t *testing.T, stub *cidtest.Stub, function string) indexReport {
+	report := indexReport{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, admin, function), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestIndexes_Consistent(t *testing.T) {
+	stub := newStub(t)
+	stub.CheckInvoke(t, user, "transferMarble", "marble1", "jerry")
+	stub.CheckInvoke(t, user, "transferMarblesBasedOnColor", "red", "jerry")
+	stub.CheckInvoke(t, user, "delete", "marble2")
+
+	report := checkIndexReport(t, stub, "verifyIndexes")
+	if !report.Consistent || report.MarblesChecked != 2 || report.EntriesChecked != 4 {
+		t.Fatalf("verifyIndexes returned %+v", report)
+	}
+}
+
+func TestIndexes_VerifyAndRebuild(t *testing.T) {
+	stub := newStub(t)
+
+	// marble4 was written without index entries, marble0 left its entries behind
+	// and marble1 changed color behind the index's back
+	putRaw(t, stub, "marble4", `{"docType":"marble","name":"marble4","color":"green","size":5,"owner":"ann"}`)
+	stub.MockTransactionStart("raw")
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble0", "blue", 1, "tom"})
+	stub.MockTransactionEnd("raw")
+	stub.State["marble1"] = []byte(`{"docType":"marble","name":"marble1","color":"yellow","size":35,"owner":"tom"}`)
+	putRaw(t, stub, "settings", `{"docType":"settings"}`)
+
+	report := checkIndexReport(t, stub, "verifyIndexes")
+	if report.Consistent || report.MarblesChecked != 4 {
+		t.Fatalf("verifyIndexes returned %+v", report)
+	}
+	orphaned := map[string]string{}
+	for _, entry := range report.Orphaned {
+		orphaned[entry.Index+" "+entry.Attributes[0]+" "+entry.Attributes[1]] = entry.Reason
+	}
+	expected := map[string]string{
+		"color~name blue marble0": "marble marble0 does not exist",
+		"owner~name tom marble0":  "marble marble0 does not exist",
+		"color~name blue marble1": "marble marble1 has different values",
+	}
+	if len(orphaned) != len(expected) {
+		t.Fatalf("orphaned %+v", report.Orphaned)
+	}
+	for entry, reason := range expected {
+		if orphaned[entry] != reason {
+			t.Fatalf("orphaned %s is %q, expected %q", entry, orphaned[entry], reason)
+		}
+	}
+	if len(report.Missing) != 3 {
+		t.Fatalf("missing %+v", report.Missing)
+	}
+
+	// verifying writes nothing
+	if report := checkIndexReport(t, stub, "verifyIndexes"); report.Consistent {
+		t.Fatalf("verifyIndexes repaired the indexes")
+	}
+	if repaired := checkIndexReport(t, stub, "rebuildIndexes"); len(repaired.Orphaned) != 3 || len(repaired.Missing) != 3 {
+		t.Fatalf("rebuildIndexes returned %+v", repaired)
+	}
+	if report := checkIndexReport(t, stub, "verifyIndexes"); !report.Consistent || report.EntriesChecked != 8 {
+		t.Fatalf("verifyIndexes after rebuild returned %+v", report)
+	}
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "ann")); recordKeys(records) != "marble4" {
+		t.Fatalf("ann owns %s", recordKeys(records))
+	}
+}
+
+func TestIndexes_Errors(t *testing.T) {
+	stub := newStub(t)
+
+	for _, function := range []string{"verifyIndexes", "rebuildIndexes"} {
+		stub.CheckInvokeError(t, user, "Attribute '"+adminAttribute+"' was not found", function)
+		stub.CheckInvokeError(t, admin, "Expecting 0", function, "marble1")
+	}
+
+	putRaw(t, stub, "broken", "{")
+	stub.CheckInvokeError(t, admin, "failed to decode marble broken", "verifyIndexes")
+	stub.CheckInvokeError(t, admin, "failed to decode marble broken", "rebuildIndexes")
+}
@@ -0,0 +1,430 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+// ==== Rich query guardrails ====
+// queryMarbles runs client supplied queries only after guardQuery has checked them.
+// Sorts need a packaged index, and use_index must name one of the packaged indexes:
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"marble\",\"owner\":\"tom\"},\"sort\":[{\"size\":\"desc\"}],\"use_index\":\"_design/indexSizeSortDoc\",\"limit\":10}"]}'
+//
+// List the indexes packaged with the chaincode, to pick a use_index value:
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["listIndexes"]}'
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Rich queries return at most queryLimit marbles, or adminQueryLimit for callers
+// with the admin attribute
+const (
+	queryLimit      = 100
+	adminQueryLimit = 1000
+)
+
+// packagedIndexes mirrors the index definitions under META-INF/statedb/couchdb/indexes.
+// Chaincode can't read its META-INF at runtime, so keep the two in step.
+var packagedIndexes = []couchIndex{
+	{"indexOwnerDoc", "indexOwner", []string{"docType", "owner"}},
+	{"indexSizeSortDoc", "indexSizeSortDesc", []string{"docType", "owner", "size"}},
+}
+
+// callerQueryGuard returns the guard for the invoking identity. Marbles are
+// public, so every caller may see every field of a marble.
+func callerQueryGuard(stub shim.ChaincodeStubInterface) (queryGuard, error) {
+	guard := queryGuard{docTypes: []string{"marble"}, maxLimit: queryLimit}
+
+	admin, _, err := cid.GetAttributeValue(stub, adminAttribute)
+	if err != nil {
+		return guard, err
+	}
+	if admin == "true" {
+		guard.maxLimit = adminQueryLimit
+	}
+	return guard, nil
+}
+
+// queryGuard describes what a caller may ask the state database for through
+// an ad hoc rich query
+type queryGuard struct {
+	docTypes []string // docTypes the selector may be restricted to
+	fields   []string // fields the caller may see, nil for every field
+	maxLimit int      // largest number of documents a single query may return
+}
+
+// couchIndex is one index packaged under META-INF/statedb/couchdb/indexes
+type couchIndex struct {
+	DesignDoc string   `json:"ddoc"`
+	Name      string   `json:"name"`
+	Fields    []string `json:"fields"`
+}
+
+// queryError is returned, JSON encoded, when a query is refused. Reason is one
+// of the constants below so clients can act on it without parsing Message.
+type queryError struct {
+	Message string       `json:"Error"`
+	Reason  string       `json:"reason"`
+	Allowed []string     `json:"allowed,omitempty"`
+	Indexes []couchIndex `json:"indexes,omitempty"`
+}
+
+const (
+	reasonInvalidQuery     = "invalid_query"
+	reasonDocTypeForbidden = "doctype_not_allowed"
+	reasonFieldForbidden   = "field_not_allowed"
+	reasonInvalidLimit     = "invalid_limit"
+	reasonUnindexedSort    = "unindexed_sort"
+	reasonUnknownIndex     = "unknown_index"
+)
+
+func (e *queryError) Error() string {
+	errorAsBytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(errorAsBytes)
+}
+
+// ===========================================================================================
+// listIndexes returns the CouchDB indexes packaged with this chaincode, so clients
+// can choose a use_index value that queryMarbles accepts
+// ===========================================================================================
+func (t *SimpleChaincode) listIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	indexesAsBytes, err := json.Marshal(packagedIndexes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(indexesAsBytes)
+}
+
+// ===========================================================================================
+// guardQuery validates a client supplied query string against the caller's guard
+// and returns the query string that is actually sent to the state database:
+//   - the selector must restrict docType to docTypes the caller may query
+//   - the selector may only test fields the caller may see, also inside $and, $or, $nor and $not
+//   - limit is capped at the guard's maxLimit, and set to it when missing
+//   - every sort field must be visible to the caller and covered by a packaged index
+//     (the use_index one if given)
+//   - fields the caller may not see are stripped, and fields is filled in when missing
+//   - use_index must name a packaged index
+//
+// ===========================================================================================
+func guardQuery(guard queryGuard, queryString string) (string, error) {
+	var query map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(queryString))
+	decoder.UseNumber()
+	if err := decoder.Decode(&query); err != nil {
+		return "", &queryError{Message: "Query is not a JSON object: " + err.Error(), Reason: reasonInvalidQuery}
+	}
+	selector, ok := query["selector"].(map[string]interface{})
+	if !ok {
+		return "", &queryError{Message: "Query must have a selector object", Reason: reasonInvalidQuery}
+	}
+
+	// ==== docType ====
+	docTypes, ok := selectorDocTypes(selector["docType"])
+	if !ok {
+		return "", &queryError{
+			Message: "Selector must restrict docType with a string, $eq or $in",
+			Reason:  reasonDocTypeForbidden,
+			Allowed: guard.docTypes,
+		}
+	}
+	for _, docType := range docTypes {
+		if !containsString(guard.docTypes, docType) {
+			return "", &queryError{
+				Message: "Querying docType " + docType + " is not allowed",
+				Reason:  reasonDocTypeForbidden,
+				Allowed: guard.docTypes,
+			}
+		}
+	}
+
+	// ==== selector fields ====
+	if err := checkSelectorFields(guard, selector); err != nil {
+		return "", err
+	}
+
+	// ==== use_index ====
+	indexes := packagedIndexes
+	if useIndex, present := query["use_index"]; present {
+		index, err := findPackagedIndex(useIndex)
+		if err != nil {
+			return "", err
+		}
+		indexes = []couchIndex{index}
+	}
+
+	// ==== sort ====
+	if sortSpec, present := query["sort"]; present {
+		fields, err := sortFields(sortSpec)
+		if err != nil {
+			return "", err
+		}
+		if err := checkVisibleFields(guard, fields); err != nil {
+			return "", err
+		}
+		if !indexCovers(indexes, fields) {
+			return "", &queryError{
+				Message: "No packaged index covers sort on " + strings.Join(fields, ","),
+				Reason:  reasonUnindexedSort,
+				Indexes: indexes,
+			}
+		}
+	}
+
+	// ==== limit ====
+	limit := guard.maxLimit
+	if limitSpec, present := query["limit"]; present {
+		number, ok := limitSpec.(json.Number)
+		if !ok {
+			return "", &queryError{Message: "limit must be a number", Reason: reasonInvalidLimit}
+		}
+		requested, err := number.Int64()
+		if err != nil || requested <= 0 {
+			return "", &queryError{Message: "limit must be a positive integer", Reason: reasonInvalidLimit}
+		}
+		if requested < int64(limit) {
+			limit = int(requested)
+		}
+	}
+	query["limit"] = limit
+
+	// ==== fields ====
+	if guard.fields != nil {
+		var visible []string
+		if fieldsSpec, present := query["fields"]; present {
+			requested, ok := fieldsSpec.([]interface{})
+			if !ok {
+				return "", &queryError{Message: "fields must be an array of field names", Reason: reasonInvalidQuery}
+			}
+			for _, field := range requested {
+				name, ok := field.(string)
+				if !ok {
+					return "", &queryError{Message: "fields must be an array of field names", Reason: reasonInvalidQuery}
+				}
+				if containsString(guard.fields, strings.SplitN(name, ".", 2)[0]) {
+					visible = append(visible, name)
+				} else {
+					fmt.Println("- guardQuery stripping field " + name)
+				}
+			}
+		}
+		if len(visible) == 0 {
+			visible = guard.fields
+		}
+		query["fields"] = visible
+	}
+
+	queryAsBytes, err := json.Marshal(query)
+	if err != nil {
+		return "", &queryError{Message: "Failed to encode query: " + err.Error(), Reason: reasonInvalidQuery}
+	}
+	return string(queryAsBytes), nil
+}
+
+// selectorDocTypes returns the docTypes a selector's docType condition allows,
+// or false when the condition doesn't pin docType to a known set of values
+func selectorDocTypes(condition interface{}) ([]string, bool) {
+	switch value := condition.(type) {
+	case string:
+		return []string{value}, true
+	case map[string]interface{}:
+		if len(value) != 1 {
+			return nil, false
+		}
+		if eq, ok := value["$eq"].(string); ok {
+			return []string{eq}, true
+		}
+		in, ok := value["$in"].([]interface{})
+		if !ok || len(in) == 0 {
+			return nil, false
+		}
+		docTypes := make([]string, 0, len(in))
+		for _, docType := range in {
+			name, ok := docType.(string)
+			if !ok {
+				return nil, false
+			}
+			docTypes = append(docTypes, name)
+		}
+		return docTypes, true
+	}
+	return nil, false
+}
+
+// checkSelectorFields rejects a selector that tests a field the caller may not
+// see, as matching on a hidden field reveals its value just as reading it does.
+// Field names are looked up in the $and, $or and $nor arrays and in $not.
+func checkSelectorFields(guard queryGuard, selector map[string]interface{}) error {
+	if guard.fields == nil {
+		return nil
+	}
+	for key, condition := range selector {
+		switch key {
+		case "$and", "$or", "$nor":
+			selectors, ok := condition.([]interface{})
+			if !ok {
+				return &queryError{Message: key + " must be an array of selectors", Reason: reasonInvalidQuery}
+			}
+			for _, s := range selectors {
+				nested, ok := s.(map[string]interface{})
+				if !ok {
+					return &queryError{Message: key + " must be an array of selectors", Reason: reasonInvalidQuery}
+				}
+				if err := checkSelectorFields(guard, nested); err != nil {
+					return err
+				}
+			}
+		case "$not":
+			nested, ok := condition.(map[string]interface{})
+			if !ok {
+				return &queryError{Message: "$not must be a selector", Reason: reasonInvalidQuery}
+			}
+			if err := checkSelectorFields(guard, nested); err != nil {
+				return err
+			}
+		default:
+			if strings.HasPrefix(key, "$") {
+				return &queryError{Message: "Selector operator " + key + " is not allowed", Reason: reasonInvalidQuery}
+			}
+			if err := checkVisibleFields(guard, []string{key}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkVisibleFields fails on the first field the caller may not see. A nested
+// field such as "a.b" is visible when its top level field "a" is.
+func checkVisibleFields(guard queryGuard, fields []string) error {
+	if guard.fields == nil {
+		return nil
+	}
+	for _, field := range fields {
+		if !containsString(guard.fields, strings.SplitN(field, ".", 2)[0]) {
+			return &queryError{
+				Message: "Querying field " + field + " is not allowed",
+				Reason:  reasonFieldForbidden,
+				Allowed: guard.fields,
+			}
+		}
+	}
+	return nil
+}
+
+// sortFields returns the field names of a sort specification, which is an
+// array of field names or of single entry {"field": "asc|desc"} objects
+func sortFields(sortSpec interface{}) ([]string, error) {
+	invalid := &queryError{Message: "sort must be an array of field names or {\"field\":\"asc|desc\"} objects", Reason: reasonInvalidQuery}
+
+	entries, ok := sortSpec.([]interface{})
+	if !ok {
+		return nil, invalid
+	}
+	var fields []string
+	for _, entry := range entries {
+		switch value := entry.(type) {
+		case string:
+			fields = append(fields, value)
+		case map[string]interface{}:
+			if len(value) != 1 {
+				return nil, invalid
+			}
+			for field, direction := range value {
+				if direction != "asc" && direction != "desc" {
+					return nil, invalid
+				}
+				fields = append(fields, field)
+			}
+		default:
+			return nil, invalid
+		}
+	}
+	return fields, nil
+}
+
+// indexCovers reports whether one of the indexes contains every field
+func indexCovers(indexes []couchIndex, fields []string) bool {
+	for _, index := range indexes {
+		covered := true
+		for _, field := range fields {
+			if !containsString(index.Fields, field) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// findPackagedIndex resolves a use_index value, either "ddoc" or ["ddoc", "name"]
+// with or without the _design/ prefix, to one of the packaged indexes
+func findPackagedIndex(useIndex interface{}) (couchIndex, error) {
+	var designDoc, name string
+	switch value := useIndex.(type) {
+	case string:
+		designDoc = value
+	case []interface{}:
+		if len(value) < 1 || len(value) > 2 {
+			break
+		}
+		designDoc, _ = value[0].(string)
+		if len(value) == 2 {
+			name, _ = value[1].(string)
+			if name == "" {
+				designDoc = ""
+			}
+		}
+	}
+	designDoc = strings.TrimPrefix(designDoc, "_design/")
+
+	if designDoc != "" {
+		for _, index := range packagedIndexes {
+			if index.DesignDoc == designDoc && (name == "" || index.Name == name) {
+				return index, nil
+			}
+		}
+	}
+	useIndexAsBytes, _ := json.Marshal(useIndex)
+	return couchIndex{}, &queryError{
+		Message: "use_index " + string(useIndexAsBytes) + " is not one of the indexes packaged with this chaincode",
+		Reason:  reasonUnknownIndex,
+		Indexes: packagedIndexes,
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,296 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/chaincode/cidtest"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// checkQueryError expects guardQuery to refuse the query with reason
+func checkQueryError(t *testing.T, guard queryGuard, queryString string, reason string) *queryError {
+	_, err := guardQuery(guard, queryString)
+	queryErr, ok := err.(*queryError)
+	if !ok {
+		t.Fatalf("%s returned %v, expected a queryError", queryString, err)
+	}
+	if queryErr.Reason != reason {
+		t.Fatalf("%s was refused with %s (%s), expected %s", queryString, queryErr.Reason, queryErr.Message, reason)
+	}
+	return queryErr
+}
+
+// checkGuardedQuery expects guardQuery to accept the query and returns what it sends on
+func checkGuardedQuery(t *testing.T, guard queryGuard, queryString string) map[string]interface{} {
+	guarded, err := guardQuery(guard, queryString)
+	if err != nil {
+		t.Fatalf("%s was refused: %s", queryString, err)
+	}
+	query := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(guarded), &query); err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestRichQuery_GuardQuery(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"marble"}, maxLimit: queryLimit}
+
+	query := checkGuardedQuery(t, guard, `{"selector":{"docType":"marble","owner":"tom"}}`)
+	if query["limit"] != float64(queryLimit) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	if _, present := query["fields"]; present {
+		t.Fatalf("fields were added for a guard without field restrictions")
+	}
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":{"$eq":"marble"}},"limit":10}`); query["limit"] != float64(10) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	if query := checkGuardedQuery(t, guard, `{"selector":{"docType":{"$in":["marble"]}},"limit":5000}`); query["limit"] != float64(queryLimit) {
+		t.Fatalf("limit is %v", query["limit"])
+	}
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"},"sort":[{"size":"desc"}],"use_index":"_design/indexSizeSortDoc"}`)
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"},"sort":["owner"],"use_index":["indexOwnerDoc","indexOwner"]}`)
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"},"sort":["size"]}`)
+
+	checkQueryError(t, guard, `not json`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"docType":"marble"}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"owner":"tom"}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":{"$gt":""}}}`, reasonDocTypeForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":{"$in":[]}}}`, reasonDocTypeForbidden)
+	if queryErr := checkQueryError(t, guard, `{"selector":{"docType":{"$in":["marble","owner"]}}}`, reasonDocTypeForbidden); !reflect.DeepEqual(queryErr.Allowed, guard.docTypes) {
+		t.Fatalf("allowed docTypes are %v", queryErr.Allowed)
+	}
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"limit":"10"}`, reasonInvalidLimit)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"limit":0}`, reasonInvalidLimit)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"limit":1.5}`, reasonInvalidLimit)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":"size"}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":[{"size":"up"}]}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":[{"size":"asc","owner":"asc"}]}`, reasonInvalidQuery)
+	if queryErr := checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":["color"]}`, reasonUnindexedSort); len(queryErr.Indexes) != len(packagedIndexes) {
+		t.Fatalf("indexes are %v", queryErr.Indexes)
+	}
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":["size"],"use_index":"indexOwnerDoc"}`, reasonUnindexedSort)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"use_index":"_design/indexColorDoc"}`, reasonUnknownIndex)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"use_index":["indexOwnerDoc","indexSizeSortDesc"]}`, reasonUnknownIndex)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"use_index":["indexOwnerDoc",""]}`, reasonUnknownIndex)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"use_index":7}`, reasonUnknownIndex)
+}
+
+func TestRichQuery_GuardFields(t *testing.T) {
+	guard := queryGuard{docTypes: []string{"marble"}, fields: []string{"docType", "name", "color"}, maxLimit: queryLimit}
+
+	query := checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"},"fields":["name","owner","color.shade"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"name", "color.shade"}) {
+		t.Fatalf("fields are %v", query["fields"])
+	}
+	query = checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"},"fields":["owner"]}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"docType", "name", "color"}) {
+		t.Fatalf("fields are %v", query["fields"])
+	}
+	query = checkGuardedQuery(t, guard, `{"selector":{"docType":"marble"}}`)
+	if !reflect.DeepEqual(query["fields"], []interface{}{"docType", "name", "color"}) {
+		t.Fatalf("fields are %v", query["fields"])
+	}
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"fields":"name"}`, reasonInvalidQuery)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"fields":[1]}`, reasonInvalidQuery)
+
+	// fields that aren't visible can't be tested or sorted on either
+	checkGuardedQuery(t, guard, `{"selector":{"docType":"marble","$or":[{"color":"red"},{"$not":{"name":"marble1"}}]}}`)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble","owner":"tom"}}`, reasonFieldForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble","$and":[{"color":"red"},{"$nor":[{"size":1}]}]}}`, reasonFieldForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble","$not":{"owner.name":"tom"}}}`, reasonFieldForbidden)
+	checkQueryError(t, guard, `{"selector":{"docType":"marble"},"sort":[{"owner":"asc"}]}`, reasonFieldForbidden)
+}
+
+func TestRichQuery_QueryMarbles(t *testing.T) {
+	stub := newStub(t)
+
+	stub.CheckInvokeError(t, user, "Expecting 1", "queryMarbles")
+	stub.CheckInvokeError(t, user, reasonDocTypeForbidden, "queryMarbles", `{"selector":{"owner":"tom"}}`)
+	// the guard passes the query on, but without rich queries the state database refuses it
+	stub.CheckInvokeError(t, user, "not supported for leveldb", "queryMarbles", `{"selector":{"docType":"marble","owner":"tom"}}`)
+
+	stub.SetCreator(nil)
+	if res := stub.MockInvoke("nocreator", [][]byte{[]byte("queryMarbles"), []byte(`{"selector":{"docType":"marble"}}`)}); res.Status == shim.OK {
+		t.Fatalf("queryMarbles without a creator should have failed")
+	}
+}
+
+func TestRichQuery_QueryMarblesOnCouchDB(t *testing.T) {
+	stub := newStub(t)
+	stub.SetRichQuery(true)
+	stub.CheckInvoke(t, user, "initMarble", "marble4", "green", "20", "tom")
+
+	query := func(id cidtest.Identity, queryString string) string {
+		return recordKeys(queryRecords(t, stub.CheckInvoke(t, id, "queryMarbles", queryString)))
+	}
+	tests := []struct {
+		query string
+		keys  string
+	}{
+		{`{"selector":{"docType":"marble","owner":"tom"}}`, "marble1,marble2,marble4"},
+		{`{"selector":{"docType":"marble","size":{"$gt":30,"$lt":60}}}`, "marble1,marble2"},
+		{`{"selector":{"docType":"marble","color":{"$in":["red","green"]}}}`, "marble2,marble4"},
+		{`{"selector":{"docType":"marble","$or":[{"owner":"jerry"},{"color":"red"}]}}`, "marble2,marble3"},
+		{`{"selector":{"docType":"marble","$and":[{"color":"blue"},{"owner":{"$regex":"^t"}}]}}`, "marble1"},
+		{`{"selector":{"docType":"marble","owner":"tom"},"sort":[{"size":"desc"}],"use_index":"_design/indexSizeSortDoc"}`, "marble2,marble1,marble4"},
+		{`{"selector":{"docType":"marble","owner":"tom"},"sort":["size"],"limit":2}`, "marble4,marble1"},
+	}
+	for _, test := range tests {
+		if keys := query(user, test.query); keys != test.keys {
+			t.Errorf("%s returned %s, expected %s", test.query, keys, test.keys)
+		}
+	}
+
+	records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarbles", `{"selector":{"docType":"marble","name":"marble3"},"fields":["name","size"]}`))
+	if len(records) != 1 || records[0].Record != (marble{Name: "marble3", Size: 70}) {
+		t.Fatalf("fields name and size returned %+v", records)
+	}
+
+	// the guard caps the limit, and bookmarks page through the rest
+	for i := 0; i < queryLimit; i++ {
+		stub.CheckInvoke(t, user, "initMarble", fmt.Sprintf("bulk%03d", i), "yellow", "1", "ann")
+	}
+	yellow := `{"selector":{"docType":"marble","color":"yellow"}`
+	if keys := query(user, yellow+`}`); strings.Count(keys, ",")+1 != queryLimit {
+		t.Fatalf("user query returned %d marbles", strings.Count(keys, ",")+1)
+	}
+	if keys := query(user, yellow+`,"bookmark":"`+stub.Bookmark()+`"}`); keys != "" {
+		t.Fatalf("second page returned %s", keys)
+	}
+	if keys := query(user, yellow+`,"limit":60}`); !strings.HasSuffix(keys, "bulk059") {
+		t.Fatalf("first page of 60 ended with %s", keys[len(keys)-7:])
+	}
+	if keys := query(user, yellow+`,"limit":60,"bookmark":"`+stub.Bookmark()+`"}`); !strings.HasPrefix(keys, "bulk060,") || strings.Count(keys, ",")+1 != queryLimit-60 {
+		t.Fatalf("second page of 60 returned %s", keys)
+	}
+	stub.CheckInvoke(t, user, "initMarble", "bulk999", "yellow", "1", "ann")
+	if keys := query(admin, yellow+`}`); strings.Count(keys, ",")+1 != queryLimit+1 {
+		t.Fatalf("admin query returned %d marbles", strings.Count(keys, ",")+1)
+	}
+
+	stub.CheckInvokeError(t, user, "Unsupported operator $where", "queryMarbles", `{"selector":{"docType":"marble","owner":{"$where":"tom"}}}`)
+	stub.CheckInvokeError(t, user, "Invalid bookmark", "queryMarbles", `{"selector":{"docType":"marble"},"bookmark":"x"}`)
+}
+
+func TestRichQuery_QueryMarblesByOwnerOnCouchDB(t *testing.T) {
+	stub := newStub(t)
+	stub.SetRichQuery(true)
+
+	records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "TOM"))
+	if recordKeys(records) != "marble1,marble2" || records[1].Record != (marble{"marble", "marble2", "red", 50, "tom"}) {
+		t.Fatalf("tom owns %+v", records)
+	}
+
+	// the rich query reads the marbles, not the owner~name index
+	stub.MockTransactionStart("raw")
+	updateMarbleIndexes(stub, nil, &marble{"marble", "marble0", "blue", 1, "tom"})
+	stub.MockTransactionEnd("raw")
+	putRaw(t, stub, "marble9", `{"docType":"marble","name":"marble9","color":"red","size":1,"owner":"tom"}`)
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "tom")); recordKeys(records) != "marble1,marble2,marble9" {
+		t.Fatalf("tom owns %s", recordKeys(records))
+	}
+
+	// both agree once the indexes are rebuilt
+	stub.CheckInvoke(t, admin, "rebuildIndexes")
+	stub.SetRichQuery(false)
+	if records := queryRecords(t, stub.CheckInvoke(t, user, "queryMarblesByOwner", "tom")); recordKeys(records) != "marble1,marble2,marble9" {
+		t.Fatalf("tom owns %s through the index", recordKeys(records))
+	}
+
+	// only LevelDB's refusal falls back to the index; a failing query is reported
+	stub.SetRichQuery(true)
+	res := stub.InvokeAs(user, "queryMarblesByOwner", `tom"`)
+	if res.Status == shim.OK || strings.Contains(res.Message, "not supported for leveldb") {
+		t.Fatalf("a broken owner query returned %d %q", res.Status, res.Message)
+	}
+	stub.SetRichQuery(false)
+	stub.CheckInvoke(t, user, "queryMarblesByOwner", `tom"`)
+}
+
+func TestRichQuery_CallerQueryGuard(t *testing.T) {
+	stub := newStub(t)
+
+	stub.SetIdentity(user)
+	stub.MockTransactionStart("guard")
+	guard, err := callerQueryGuard(stub)
+	stub.MockTransactionEnd("guard")
+	if err != nil || guard.maxLimit != queryLimit || guard.fields != nil || !reflect.DeepEqual(guard.docTypes, []string{"marble"}) {
+		t.Fatalf("user guard is %+v, %v", guard, err)
+	}
+	stub.SetIdentity(admin)
+	stub.MockTransactionStart("guard")
+	guard, err = callerQueryGuard(stub)
+	stub.MockTransactionEnd("guard")
+	if err != nil || guard.maxLimit != adminQueryLimit {
+		t.Fatalf("admin guard is %+v, %v", guard, err)
+	}
+}
+
+func TestRichQuery_ListIndexes(t *testing.T) {
+	stub := newStub(t)
+
+	indexes := []couchIndex{}
+	if err := json.Unmarshal(stub.CheckInvoke(t, user, "listIndexes"), &indexes); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, packagedIndexes) {
+		t.Fatalf("listIndexes returned %+v", indexes)
+	}
+}
+
+// TestRichQuery_PackagedIndexes checks packagedIndexes is in step with META-INF
+func TestRichQuery_PackagedIndexes(t *testing.T) {
+	const indexDir = "META-INF/statedb/couchdb/indexes"
+	files, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var definitions []couchIndex
+	for _, file := range files {
+		definitionAsBytes, err := ioutil.ReadFile(filepath.Join(indexDir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		definition := struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			DesignDoc string `json:"ddoc"`
+			Name      string `json:"name"`
+		}{}
+		if err := json.Unmarshal(definitionAsBytes, &definition); err != nil {
+			t.Fatalf("%s: %s", file.Name(), err)
+		}
+		definitions = append(definitions, couchIndex{definition.DesignDoc, definition.Name, definition.Index.Fields})
+	}
+	if !reflect.DeepEqual(definitions, packagedIndexes) {
+		t.Fatalf("packagedIndexes %+v don't match %s %+v", packagedIndexes, indexDir, definitions)
+	}
+}
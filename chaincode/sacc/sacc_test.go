@@ -0,0 +1,106 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
+	res := stub.MockInit("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+}
+
+func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte, value string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		t.Fatalf("Invoke %s failed: %s", args, res.Message)
+	}
+	if string(res.Payload) != value {
+		t.Fatalf("Invoke %s returned %q, expected %q", args, res.Payload, value)
+	}
+}
+
+func checkInvokeError(t *testing.T, stub *shim.MockStub, args [][]byte, message string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status == shim.OK {
+		t.Fatalf("Invoke %s should have failed", args)
+	}
+	if res.Message != message {
+		t.Fatalf("Invoke %s failed with %q, expected %q", args, res.Message, message)
+	}
+}
+
+func TestSimpleAsset_Init(t *testing.T) {
+	stub := shim.NewMockStub("sacc", new(SimpleAsset))
+
+	res := stub.MockInit("1", [][]byte{[]byte("a")})
+	if res.Status == shim.OK || res.Message != "Incorrect arguments. Expecting a key and a value" {
+		t.Fatalf("Init with one argument returned %d %q", res.Status, res.Message)
+	}
+
+	checkInit(t, stub, [][]byte{[]byte("a"), []byte("10")})
+	if string(stub.State["a"]) != "10" {
+		t.Fatalf("Init stored %q for a, expected 10", stub.State["a"])
+	}
+}
+
+func TestSimpleAsset_Get(t *testing.T) {
+	stub := shim.NewMockStub("sacc", new(SimpleAsset))
+	checkInit(t, stub, [][]byte{[]byte("a"), []byte("10")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("get"), []byte("a")}, "10")
+	// any function other than set is a get
+	checkInvoke(t, stub, [][]byte{[]byte("anything"), []byte("a")}, "10")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("get"), []byte("b")}, "Asset not found: b")
+	checkInvokeError(t, stub, [][]byte{[]byte("get")}, "Incorrect arguments. Expecting a key")
+	checkInvokeError(t, stub, [][]byte{[]byte("get"), []byte("a"), []byte("b")}, "Incorrect arguments. Expecting a key")
+}
+
+func TestSimpleAsset_Set(t *testing.T) {
+	stub := shim.NewMockStub("sacc", new(SimpleAsset))
+	checkInit(t, stub, [][]byte{[]byte("a"), []byte("10")})
+
+	checkInvoke(t, stub, [][]byte{[]byte("set"), []byte("a"), []byte("20")}, "20")
+	checkInvoke(t, stub, [][]byte{[]byte("get"), []byte("a")}, "20")
+	checkInvoke(t, stub, [][]byte{[]byte("set"), []byte("b"), []byte("30")}, "30")
+	checkInvoke(t, stub, [][]byte{[]byte("get"), []byte("b")}, "30")
+
+	checkInvokeError(t, stub, [][]byte{[]byte("set"), []byte("a")}, "Incorrect arguments. Expecting a key and a value")
+}
+
+// Property: get returns the last value set for a key, whatever was set before
+func TestSimpleAsset_SetThenGet(t *testing.T) {
+	stub := shim.NewMockStub("sacc", new(SimpleAsset))
+	checkInit(t, stub, [][]byte{[]byte("a"), []byte("10")})
+
+	property := func(key string, values []string) bool {
+		last := ""
+		for _, value := range values {
+			// the mock ledger doesn't tell an empty value from a missing one
+			if value == "" {
+				continue
+			}
+			stub.MockInvoke("1", [][]byte{[]byte("set"), []byte(key), []byte(value)})
+			last = value
+		}
+		if key == "" || last == "" {
+			return true
+		}
+		res := stub.MockInvoke("1", [][]byte{[]byte("get"), []byte(key)})
+		return res.Status == shim.OK && string(res.Payload) == last
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
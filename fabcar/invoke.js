@@ -55,8 +55,10 @@ Fabric_Client.newDefaultKeyValueStore({ path: store_path
 	tx_id = fabric_client.newTransactionID();
 	console.log("Assigning transaction_id: ", tx_id._transaction_id);
 
-	// createCar chaincode function - requires 5 args, ex: args: ['CAR12', 'Honda', 'Accord', 'Black', 'Tom'],
-	// changeCarOwner chaincode function - requires 2 args , ex: args: ['CAR10', 'Dave'],
+	// createCar chaincode function - requires 7 args, ex: args: ['1HGCR2F39JA000012', 'Honda', 'Accord', 'Black', 'Tom', '2018', 'FAB 012'],
+	// changeCarOwner chaincode function - requires 3 args, the new owner's identity is what whoAmI returns for them,
+	//   ex: args: ['1HGCR2F39JA000012', 'Dave', 'Org1MSP/eDUwOTo6Q049...'],
+	// setCarStatus chaincode function - requires 2 args, ex: args: ['1HGCR2F39JA000012', 'stolen'],
 	// must send the proposal to endorsing peers
 	var request = {
 		//targets: let default to the peer assigned to the client
@@ -49,8 +49,8 @@ Fabric_Client.newDefaultKeyValueStore({ path: store_path
 		throw new Error('Failed to get user1.... run registerUser.js');
 	}
 
-	// queryCar chaincode function - requires 1 argument, ex: args: ['CAR4'],
-	// queryAllCars chaincode function - requires no arguments , ex: args: [''],
+	// queryCar chaincode function - requires 1 argument, ex: args: ['WVWZZZ3C1JE000004'],
+	// queryAllCars chaincode function - optional page size, bookmark and filters, ex: args: ['10', '', 'make=Ford'],
 	const request = {
 		//targets : --- letting this default to the peers assigned to the channel
 		chaincodeId: 'fabcar',
@@ -435,6 +435,9 @@ func main() {
  * All functions below this are for testing traditional editing of a single row
  */
 func (s *SmartContract) putStandard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
 	name := args[0]
 	valStr := args[1]
 
@@ -452,6 +455,9 @@ func (s *SmartContract) putStandard(APIstub shim.ChaincodeStubInterface, args []
 }
 
 func (s *SmartContract) getStandard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
 	name := args[0]
 
 	val, getErr := APIstub.GetState(name)
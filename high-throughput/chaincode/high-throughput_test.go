@@ -0,0 +1,173 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"testing/quick"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var txCounter int
+
+// invoke runs a function in a transaction of its own, deltas are keyed by tx ID
+func invoke(stub *shim.MockStub, args ...string) (int32, string, string) {
+	byteArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		byteArgs[i] = []byte(arg)
+	}
+	txCounter++
+	res := stub.MockInvoke(fmt.Sprintf("tx%d", txCounter), byteArgs)
+	return res.Status, res.Message, string(res.Payload)
+}
+
+func checkOK(t *testing.T, stub *shim.MockStub, args ...string) string {
+	status, message, payload := invoke(stub, args...)
+	if status != OK {
+		t.Fatalf("%v failed: %s", args, message)
+	}
+	return payload
+}
+
+func checkError(t *testing.T, stub *shim.MockStub, message string, args ...string) {
+	status, got, _ := invoke(stub, args...)
+	if status != ERROR {
+		t.Fatalf("%v should have failed", args)
+	}
+	if got != message {
+		t.Fatalf("%v failed with %q, expected %q", args, got, message)
+	}
+}
+
+func newStub(t *testing.T) *shim.MockStub {
+	stub := shim.NewMockStub("high-throughput", new(SmartContract))
+	if res := stub.MockInit("init", nil); res.Status != OK {
+		t.Fatalf("Init failed: %s", res.Message)
+	}
+	return stub
+}
+
+func TestUpdateAndGet(t *testing.T) {
+	stub := newStub(t)
+
+	checkError(t, stub, "No variable by the name x exists", "get", "x")
+	checkOK(t, stub, "update", "x", "10", "+")
+	checkOK(t, stub, "update", "x", "2.5", "-")
+	checkOK(t, stub, "update", "x", "4", "+")
+	if value := checkOK(t, stub, "get", "x"); value != "11.5" {
+		t.Fatalf("x is %s, expected 11.5", value)
+	}
+
+	checkError(t, stub, "Incorrect number of arguments, expecting 3", "update", "x", "1")
+	checkError(t, stub, "Provided value was not a number", "update", "x", "one", "+")
+	checkError(t, stub, "Operator * is unrecognized", "update", "x", "1", "*")
+	checkError(t, stub, "Incorrect number of arguments, expecting 1", "get")
+	checkError(t, stub, "Invalid Smart Contract function name.", "increment", "x")
+}
+
+func TestPrune(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newStub(t)
+		checkOK(t, stub, "update", "x", "10", "+")
+		checkOK(t, stub, "update", "x", "3", "-")
+		checkOK(t, stub, "update", "x", "1", "+")
+
+		checkOK(t, stub, function, "x")
+		if value := checkOK(t, stub, "get", "x"); value != "8" {
+			t.Fatalf("x is %s after %s, expected 8", value, function)
+		}
+		rows, _ := stub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{"x"})
+		count := 0
+		for ; rows.HasNext(); count++ {
+			rows.Next()
+		}
+		rows.Close()
+		if count != 1 {
+			t.Fatalf("%s left %d rows, expected 1", function, count)
+		}
+		if stub.State["x_PRUNE_BACKUP"] != nil {
+			t.Fatalf("%s left its backup behind", function)
+		}
+		checkError(t, stub, "Incorrect number of arguments, expecting 1", "prunefast")
+	}
+
+	stub := newStub(t)
+	checkError(t, stub, "No variable by the name y exists", "prunefast", "y")
+	checkError(t, stub, "Could not retrieve the value of y before pruning, pruning aborted: No variable by the name y exists", "prunesafe", "y")
+	checkError(t, stub, "Incorrect number of arguments, expecting 1 (the name of the variable to prune)", "prunesafe")
+}
+
+func TestDelete(t *testing.T) {
+	stub := newStub(t)
+	checkOK(t, stub, "update", "x", "10", "+")
+	checkOK(t, stub, "update", "x", "3", "-")
+	checkOK(t, stub, "update", "y", "1", "+")
+
+	if message := checkOK(t, stub, "delete", "x"); message != "Deleted x, 2 rows removed" {
+		t.Fatalf("delete returned %q", message)
+	}
+	checkError(t, stub, "No variable by the name x exists", "get", "x")
+	checkError(t, stub, "No variable by the name x exists", "delete", "x")
+	checkError(t, stub, "Incorrect number of arguments, expecting 1", "delete")
+	if value := checkOK(t, stub, "get", "y"); value != "1" {
+		t.Fatalf("deleting x changed y to %s", value)
+	}
+}
+
+func TestStandard(t *testing.T) {
+	stub := newStub(t)
+	checkOK(t, stub, "putstandard", "x", "42")
+	if value := checkOK(t, stub, "getstandard", "x"); value != "42" {
+		t.Fatalf("x is %s, expected 42", value)
+	}
+	if value := checkOK(t, stub, "getstandard", "y"); value != "" {
+		t.Fatalf("y is %s, expected nothing", value)
+	}
+	checkError(t, stub, "Incorrect number of arguments, expecting 2", "putstandard", "x")
+	checkError(t, stub, "Incorrect number of arguments, expecting 1", "getstandard")
+}
+
+// Property: after any sequence of updates and prunes, get returns the
+// arithmetic sum of the deltas
+func TestGetIsSumOfDeltas(t *testing.T) {
+	type step struct {
+		Delta int16
+		Prune uint8
+	}
+	property := func(steps []step) bool {
+		if len(steps) == 0 {
+			return true
+		}
+		stub := newStub(t)
+		sum := 0
+		for _, s := range steps {
+			op, value := "+", int(s.Delta)
+			if s.Delta < 0 {
+				op, value = "-", -value
+			}
+			if status, _, _ := invoke(stub, "update", "x", strconv.Itoa(value), op); status != OK {
+				return false
+			}
+			sum += int(s.Delta)
+
+			switch s.Prune % 8 {
+			case 0:
+				invoke(stub, "prunefast", "x")
+			case 1:
+				invoke(stub, "prunesafe", "x")
+			}
+		}
+		status, _, payload := invoke(stub, "get", "x")
+		return status == OK && payload == strconv.Itoa(sum)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}